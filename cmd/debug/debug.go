@@ -4,7 +4,9 @@ import (
 	"coins/pkg/blockchain"
 	"coins/pkg/crypto"
 	"coins/pkg/model"
+	"context"
 	"fmt"
+	"runtime"
 )
 
 func main() {
@@ -53,13 +55,11 @@ func main() {
 		Registrations: []model.Registration{{Wallet: "testwallet123", PublicKey: "testkey"}, {Wallet: wal.Address, PublicKey: keyString}},
 	}
 
-	secondBlock.Hash = secondBlock.GetHash()
+	secondBlock.StateRoot, _ = bc.StateRootAfter(secondBlock)
 
 	fmt.Println("Mining the Second Block")
 
-	stop := false
-
-	secondBlock.Mine(&stop)
+	secondBlock.Mine(context.Background(), runtime.NumCPU(), nil)
 
 	fmt.Printf("\nSecond Block:%+v\n", secondBlock)
 
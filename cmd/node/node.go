@@ -1,30 +1,44 @@
 package main
 
 import (
+	"bufio"
+	"coins/pkg/api"
 	"coins/pkg/blockchain"
-	"coins/pkg/model"
 	"coins/pkg/relay"
+	"coins/pkg/storage"
+	"crypto/tls"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
 	"runtime/pprof"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 )
 
-const MaxBlocksPerRequest = 100
-
 var cpuprofile = flag.String("cpuprofile", "", "write cpu profile to file")
 
 func main() {
 	enableRelay := flag.Bool("relay-enable", false, "Whether or not to enable relaying on the relay port")
 	relayPort := flag.String("relay-port", "10505", "The port used to relay messages to other nodes")
+	dataDir := flag.String("data-dir", "chaindata", "Directory the block store is kept in")
+	snapshotExport := flag.String("snapshot-export", "", "Export a snapshot of the chainstate to this file and exit")
+	snapshotImport := flag.String("snapshot-import", "", "Import a chainstate snapshot from this file before starting")
+	pruneDepth := flag.Uint64("prune", 0, "Only keep this many recent blocks, 0 keeps the full history")
 	peerFile := flag.String("peer-file", "peers.json", "Path to the file containing peer nodes to establish connections with")
+	enableAPI := flag.Bool("api-enable", false, "Whether or not to serve the http api on the api port")
+	apiPort := flag.String("api-port", "10506", "The port used to serve the http api")
 	enableMiner := flag.Bool("miner-enable", false, "Whether or not to mine coins")
+	minerThreads := flag.Int("miner-threads", runtime.NumCPU(), "The amount of goroutines searching for a nonce")
+	enableTLS := flag.Bool("tls-enable", false, "Whether or not to encrypt and authenticate peer connections with TLS 1.3, our peers have to enable it as well")
+	allowlistFile := flag.String("allowlist", "", "Path to a file listing the node identities allowed to connect to us, requires tls-enable")
+	maxOutbound := flag.Int("max-outbound", relay.TARGET_OUTBOUND, "The amount of outbound connections to keep")
 	showHelp := flag.Bool("help", false, "Shows this Help page")
 
 	flag.Parse()
@@ -56,44 +70,162 @@ func main() {
 		}
 	}
 
-	// Parse the blockchain file
-	var bc blockchain.BlockChain
-	// if a blockchain.json exists, parse it
+	// Open the block store
+	store, err := storage.OpenDiskStore(*dataDir)
+	if err != nil {
+		log.Fatalf("could not open block store with error %v\n", err)
+	}
+	// Install an imported snapshot, so we only need to replay the blocks after it
+	if *snapshotImport != "" {
+		snap, err := storage.ReadSnapshot(*snapshotImport)
+		if err != nil {
+			log.Fatalf("could not read snapshot with error %v\n", err)
+		}
+		err = storage.Import(store, snap)
+		if err != nil {
+			log.Fatalf("could not import snapshot with error %v\n", err)
+		}
+		log.Printf("imported snapshot at block %v\n", snap.Height)
+	}
 	log.Println("starting to read blockchain")
-	chain, err := blockchain.ReadFile()
+	chain, err := storage.Load(store)
+	if err != nil {
+		log.Fatalf("could not load blockchain from store with error %v\n", err)
+	}
+	// Migrate a legacy blockchain.json into the empty store
+	if len(chain.Blocks) == 0 {
+		legacy, err := blockchain.ReadFile()
+		if err == nil {
+			log.Println("migrating legacy blockchain file into the block store")
+			chain, err = blockchain.Migrate(legacy)
+			if err != nil {
+				log.Fatalf("could not migrate legacy blockchain with error %v\n", err)
+			}
+		} else if _, statErr := os.Stat("blockchain.json"); statErr == nil {
+			log.Fatalf("could not read legacy blockchain with error %v\n", err)
+		} else if *pruneDepth > 0 {
+			// A pruning node does not want the full history, it bootstraps from its first peer instead
+			log.Println("no blockchain found, bootstrapping from the first peer")
+			chain.Chainstate.Wallets = make(map[string]*blockchain.WalletInfo)
+		} else {
+			log.Println("no blockchain found, now initializing")
+			chain = blockchain.NewBlockChain()
+		}
+	}
+	// Replay the blocks we accepted after the last commit
+	wal, err := storage.OpenWAL(filepath.Join(*dataDir, "blocks.wal"))
 	if err != nil {
-		log.Printf("could not read blockchain with error %v now initializing\n", err)
-		chain = &blockchain.BlockChain{
-			Blocks: []*model.Block{},
-			Chainstate: blockchain.Chainstate{
-				Wallets: make(map[string]*blockchain.WalletInfo),
-			},
+		log.Fatalf("could not open write-ahead log with error %v\n", err)
+	}
+	replayed, err := storage.Replay(chain, wal)
+	if err != nil {
+		log.Fatalf("could not replay write-ahead log with error %v\n", err)
+	}
+	log.Printf("replayed %v blocks from the write-ahead log\n", replayed)
+	// Drop the blocks we dont keep in pruning mode
+	if *pruneDepth > 0 {
+		if *pruneDepth < blockchain.MinPruneDepth {
+			log.Fatalf("cannot prune to less than %v blocks\n", blockchain.MinPruneDepth)
+		}
+		chain.Prune(*pruneDepth)
+	}
+	log.Println("successfully read blockchain")
+	bc := *chain
+
+	// Export a snapshot of the chainstate and stop
+	if *snapshotExport != "" {
+		err = storage.WriteSnapshot(*snapshotExport, storage.NewSnapshot(chain))
+		if err != nil {
+			log.Fatalf("could not export snapshot with error %v\n", err)
 		}
+		log.Printf("exported snapshot at block %v to %v\n", chain.Chainstate.LastBlock.ID, *snapshotExport)
+		os.Exit(0)
 	}
-	log.Println("successfully read blockchain file")
-	bc = *chain
 
-	// Parse the peer file
+	// Parse the peer file, without one we rely on the peers we learned in previous runs
+	var peers []string
 	content, err := ioutil.ReadFile(*peerFile)
-	if err != nil {
+	if err == nil {
+		err = json.Unmarshal(content, &peers)
+		if err != nil {
+			log.Fatalf("could not unmarshall peer file with error %v\n", err)
+		}
+	} else if os.IsNotExist(err) {
+		log.Printf("no peer file found, using the address book only\n")
+	} else {
 		log.Fatalf("could not read peer file with error %v\n", err)
 	}
-	var peers []string
-	err = json.Unmarshal(content, &peers)
+
+	// Read the peers we learned about in previous runs
+	addrs, err := relay.OpenAddrBook(filepath.Join(*dataDir, "addrbook.json"))
 	if err != nil {
-		log.Fatalf("could not unmarshall peer file with error %v\n", err)
+		log.Fatalf("could not open address book with error %v\n", err)
+	}
+
+	// Tell our peers where we accept connections
+	listenPort := uint64(0)
+	if *enableRelay {
+		listenPort, err = strconv.ParseUint(*relayPort, 10, 16)
+		if err != nil {
+			log.Fatalf("invalid relay port %v\n", *relayPort)
+		}
 	}
 
-	restart := false
+	// Read the peers we banned in previous runs
+	bans, err := relay.OpenBanList(filepath.Join(*dataDir, "banlist.json"))
+	if err != nil {
+		log.Fatalf("could not open ban list with error %v\n", err)
+	}
+
+	// Encrypt our peer connections with our identity key
+	var tlsConfig *tls.Config
+	if *enableTLS {
+		identity, err := relay.OpenIdentity(relay.IDENTITY_FILE)
+		if err != nil {
+			log.Fatalf("could not open node identity with error %v\n", err)
+		}
+		log.Printf("node identity is %v\n", identity.ID())
+		// Only let the nodes on the allowlist connect if we have one
+		var allowlist *relay.Allowlist
+		if *allowlistFile != "" {
+			allowlist, err = relay.ReadAllowlist(*allowlistFile)
+			if err != nil {
+				log.Fatalf("could not read allowlist with error %v\n", err)
+			}
+			log.Printf("only accepting %v nodes from the allowlist\n", allowlist.Len())
+		}
+		tlsConfig, err = relay.TLSConfig(identity, allowlist)
+		if err != nil {
+			log.Fatalf("could not configure tls with error %v\n", err)
+		}
+	} else if *allowlistFile != "" {
+		log.Fatalf("the allowlist requires tls-enable, plaintext peers cannot be identified\n")
+	}
 
 	// Create our Relay
 	relay := relay.Relay{
-		Local:         *enableRelay,
-		Blockchain:    bc,
-		Peers:         peers,
-		Wallet:        *wallet,
-		RestartMiner:  &restart,
-		PeerSyncMutex: &sync.Mutex{},
+		Local:          !*enableRelay,
+		Blockchain:     bc,
+		Peers:          peers,
+		Wallet:         *wallet,
+		Events:         relay.NewEvents(),
+		ChainMutex:     &sync.RWMutex{},
+		Store:          store,
+		WAL:            wal,
+		PruneDepth:     *pruneDepth,
+		Workers:        relay.NewWorkerPool(relay.MESSAGE_WORKERS, relay.MESSAGE_QUEUE),
+		Metrics:        relay.NewMetrics(),
+		Bans:           bans,
+		PeerManager:    relay.NewPeerManager(),
+		Seen:           relay.NewInvCache(relay.SEEN_CACHE_SIZE),
+		Requests:       relay.NewRequests(),
+		Sync:           relay.NewHeaderSync(),
+		Addrs:          addrs,
+		Outbound:       relay.NewPeerSet(),
+		TargetOutbound: *maxOutbound,
+		ListenPort:     uint16(listenPort),
+		TLS:            tlsConfig,
+		Miner:          relay.NewMiner(*minerThreads),
 	}
 
 	// Make sure we register with the blockchain
@@ -104,32 +236,98 @@ func main() {
 		go relay.Listen(":" + *relayPort)
 	}
 
+	// Serve the http api if it is enabled
+	if *enableAPI {
+		server := api.Server{Relay: &relay}
+		go server.Listen(":" + *apiPort)
+	}
+
 	// Dial our Peers
 	go relay.ConsumePeers(peers)
 
 	// Start our miner if it is enabled
 	if *enableMiner {
-		go relay.MineBlocks(relay.RestartMiner)
+		relay.StartMining()
 	}
 
+	// Catch up with peers that are ahead of us
+	go relay.SyncBlocks()
+
 	// Make sure we regularly commit the blockchain to disk
 	go relay.CommitBlockchain()
 
-	time.Sleep(time.Minute)
-	return
-
 	// Read stdin and process commands
-	for {
-		inputBuffer, err := ioutil.ReadAll(os.Stdin)
-		if err != nil {
-			fmt.Println("[NODECTL] error parsing command")
-		}
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
 		// Split the command into its parts
-		parts := strings.Split(string(inputBuffer), " ")
+		parts := strings.Fields(scanner.Text())
+		if len(parts) == 0 {
+			continue
+		}
 		// Switch the command type
 		switch parts[0] {
-		case "send":
-		case "":
+		case "bans":
+			for _, ban := range relay.Bans.List() {
+				fmt.Printf("[NODECTL] %v banned until %v\n", ban.Host, ban.Until.Format(time.RFC3339))
+			}
+		case "ban":
+			if len(parts) < 2 {
+				fmt.Println("[NODECTL] usage: ban <host> [duration]")
+				continue
+			}
+			// Without a duration the ban list uses its default
+			duration := time.Duration(0)
+			if len(parts) > 2 {
+				duration, err = time.ParseDuration(parts[2])
+				if err != nil {
+					fmt.Printf("[NODECTL] invalid duration %v\n", parts[2])
+					continue
+				}
+			}
+			err = relay.Bans.Ban(parts[1], duration)
+			if err != nil {
+				fmt.Printf("[NODECTL] could not ban %v with error %v\n", parts[1], err)
+				continue
+			}
+			closed := relay.DisconnectHost(parts[1])
+			fmt.Printf("[NODECTL] banned %v, closed %v connections\n", parts[1], closed)
+		case "unban":
+			if len(parts) < 2 {
+				fmt.Println("[NODECTL] usage: unban <host>")
+				continue
+			}
+			err = relay.Bans.Unban(parts[1])
+			if err != nil {
+				fmt.Printf("[NODECTL] could not unban %v with error %v\n", parts[1], err)
+				continue
+			}
+			fmt.Printf("[NODECTL] unbanned %v\n", parts[1])
+		case "mine":
+			if len(parts) < 2 {
+				fmt.Println("[NODECTL] usage: mine <start|stop|restart|status>")
+				continue
+			}
+			switch parts[1] {
+			case "start":
+				if !relay.StartMining() {
+					fmt.Println("[NODECTL] miner is already running")
+				}
+			case "stop":
+				if !relay.StopMining() {
+					fmt.Println("[NODECTL] miner is not running")
+				}
+			case "restart":
+				relay.RestartMining()
+			case "status":
+				stats := relay.MinerStats()
+				fmt.Printf("[NODECTL] mining=%v threads=%v hashrate=%.0f/s found=%v height=%v difficulty=%v\n", stats.Mining, stats.Threads, stats.Hashrate, stats.BlocksFound, stats.Height, stats.Difficulty)
+			default:
+				fmt.Println("[NODECTL] usage: mine <start|stop|restart|status>")
+			}
+		case "help":
+			fmt.Println("[NODECTL] commands: bans, ban <host> [duration], unban <host>, mine <start|stop|restart|status>")
+		default:
+			fmt.Printf("[NODECTL] unknown command %v, try help\n", parts[0])
 		}
 	}
 	// Block main efficiently
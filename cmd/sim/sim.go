@@ -0,0 +1,102 @@
+package main
+
+import (
+	"coins/pkg/sim"
+	"coins/pkg/transport"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+)
+
+func main() {
+	nodes := flag.Int("nodes", 6, "The amount of relays to simulate")
+	miners := flag.Int("miners", 2, "The amount of relays that mine")
+	peers := flag.Int("peers", 2, "The amount of earlier relays each relay is initially told about")
+	latency := flag.Duration("latency", time.Millisecond*20, "How long a message takes between two relays")
+	jitter := flag.Duration("jitter", time.Millisecond*10, "Up to how much longer a message may take")
+	loss := flag.Float64("loss", 0, "The probability that a message is lost")
+	threads := flag.Int("threads", 1, "The amount of goroutines each miner searches with")
+	seed := flag.Int64("seed", 1, "Seeds the network and the transaction generator")
+	phase := flag.Duration("phase", time.Second*10, "How long each phase of the simulation runs")
+	partition := flag.Bool("partition", true, "Whether or not to split the network in halves during the second phase")
+	txRate := flag.Int("tx-rate", 5, "The amount of transactions attempted per second")
+	settle := flag.Duration("settle", time.Minute, "How long the relays may take to agree on the head after the last phase")
+	verbose := flag.Bool("verbose", false, "Whether or not to show the logs of the relays")
+	flag.Parse()
+
+	if !*verbose {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	s, err := sim.New(sim.Config{
+		Nodes:   *nodes,
+		Miners:  *miners,
+		Peers:   *peers,
+		Link:    transport.Link{Latency: *latency, Jitter: *jitter, Loss: *loss},
+		Seed:    *seed,
+		Threads: *threads,
+	})
+	if err != nil {
+		fmt.Printf("[SIM] could not create simulation with error %v\n", err)
+		os.Exit(1)
+	}
+	s.Start()
+	fmt.Printf("[SIM] started %v relays, %v of them mining\n", *nodes, *miners)
+
+	// Run the phases, the network is split during the second one
+	sent := 0
+	run := func(name string) {
+		fmt.Printf("[SIM] %v for %v\n", name, *phase)
+		end := time.Now().Add(*phase)
+		for time.Now().Before(end) {
+			sent += s.SendTransactions(*txRate)
+			time.Sleep(time.Second)
+		}
+		report(s)
+	}
+	run("connected")
+	if *partition {
+		a, b := s.Halves()
+		s.Partition(a, b)
+		run("partitioned")
+		s.Heal()
+	} else {
+		run("connected")
+	}
+	run("healed")
+	fmt.Printf("[SIM] sent %v transactions\n", sent)
+
+	// The relays have to agree on a single chain whose balances add up. The miners keep running until then,
+	// only new blocks break a tie between forks of the same height
+	failed := false
+	err = s.WaitConverged(*settle)
+	if err != nil {
+		fmt.Printf("[SIM] FAIL %v\n", err)
+		failed = true
+	} else {
+		fmt.Println("[SIM] OK all relays agree on the head")
+	}
+	s.StopMining()
+	err = s.CheckSupply()
+	if err != nil {
+		fmt.Printf("[SIM] FAIL %v\n", err)
+		failed = true
+	} else {
+		fmt.Println("[SIM] OK balances add up to the mined supply on every relay")
+	}
+	report(s)
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// report prints the head of every relay
+func report(s *sim.Sim) {
+	for _, node := range s.Nodes {
+		height, hash := node.Head()
+		fmt.Printf("[SIM] %-10v height=%-5v head=%.16v txs=%-4v reorgs=%v peers=%v\n", node.Host, height, hash, node.TransactionCount(), node.ReorgCount(), len(node.Relay.PeerManager.Peers()))
+	}
+}
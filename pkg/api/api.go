@@ -0,0 +1,47 @@
+package api
+
+import (
+	"coins/pkg/relay"
+	"embed"
+	"io/fs"
+	"log"
+	"net/http"
+)
+
+//go:embed ui
+var ui embed.FS
+
+// Server exposes the state of a relay over http
+type Server struct {
+	Relay *relay.Relay
+}
+
+func (s *Server) Listen(addr string) {
+	log.Printf("[API] now listening for http clients on %v\n", addr)
+	// Register our handlers
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", s.handleEvents)
+	mux.HandleFunc("/api/blocks", s.handleBlocks)
+	mux.HandleFunc("/api/blocks/", s.handleBlock)
+	mux.HandleFunc("/api/transactions", s.handleTransactions)
+	mux.HandleFunc("/api/transactions/", s.handleTransaction)
+	mux.HandleFunc("/api/wallets/", s.handleWallet)
+	mux.HandleFunc("/api/history/", s.handleHistory)
+	mux.HandleFunc("/api/proofs/", s.handleProof)
+	mux.HandleFunc("/api/stats", s.handleStats)
+	mux.HandleFunc("/api/peers", s.handlePeers)
+	mux.HandleFunc("/api/miner", s.handleMiner)
+	mux.HandleFunc("/api/mining/template", s.handleMiningTemplate)
+	mux.HandleFunc("/api/mining/submit", s.handleMiningSubmit)
+	// Serve the embedded explorer ui on everything else
+	static, err := fs.Sub(ui, "ui")
+	if err != nil {
+		log.Fatalf("[API] Could not load embedded ui with error %v\n", err)
+	}
+	mux.Handle("/", http.FileServer(http.FS(static)))
+	// Serve until the listener fails
+	err = http.ListenAndServe(addr, mux)
+	if err != nil {
+		log.Fatalf("[API] Could not serve http with error %v\n", err)
+	}
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"coins/pkg/gorx"
+	"coins/pkg/relay"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	EVENT_NEW_BLOCK              = "newBlock"
+	EVENT_NEW_TRANSACTION        = "newTransaction"
+	EVENT_NEW_REGISTRATION       = "newRegistration"
+	EVENT_REORG                  = "reorg"
+	EVENT_WALLET_BALANCE_CHANGED = "walletBalanceChanged"
+)
+
+// eventBufferSize is the amount of events we queue per client before dropping events for slow clients
+const eventBufferSize = 64
+
+type event struct {
+	Name string
+	Data interface{}
+}
+
+// handleEvents streams the requested relay events to the client as server sent events.
+// Clients select streams with ?events=newBlock,reorg and filter wallet events with ?address=
+func (s *Server) handleEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	// Parse the requested event names, default to all of them
+	names := []string{EVENT_NEW_BLOCK, EVENT_NEW_TRANSACTION, EVENT_NEW_REGISTRATION, EVENT_REORG, EVENT_WALLET_BALANCE_CHANGED}
+	if query := req.URL.Query().Get("events"); query != "" {
+		names = strings.Split(query, ",")
+	}
+	address := req.URL.Query().Get("address")
+	// Subscribe to the requested streams
+	queue := make(chan event, eventBufferSize)
+	subs := []*gorx.Subscription{}
+	defer func() {
+		for _, sub := range subs {
+			sub.Unsubscribe()
+		}
+	}()
+	for _, name := range names {
+		observable := s.observable(name)
+		if observable == nil {
+			http.Error(w, fmt.Sprintf("unknown event %v", name), http.StatusBadRequest)
+			return
+		}
+		alloc := name
+		subs = append(subs, observable.Subscribe(func(v interface{}) {
+			// Only forward wallet events for the requested address
+			if we, ok := v.(relay.WalletEvent); ok && address != "" && we.Address != address {
+				return
+			}
+			// Never block the relay on a slow client
+			select {
+			case queue <- event{Name: alloc, Data: v}:
+			default:
+				log.Printf("[API] dropping %v event for slow client %v\n", alloc, req.RemoteAddr)
+			}
+		}))
+	}
+	// Write the stream headers
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+	// Forward events until the client goes away
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case ev := <-queue:
+			bin, err := json.Marshal(ev.Data)
+			if err != nil {
+				log.Printf("[API] failed to marshall %v event with error %v\n", ev.Name, err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %v\ndata: %v\n\n", ev.Name, string(bin))
+			flusher.Flush()
+		}
+	}
+}
+
+// observable returns the relay stream for an event name or nil if there is none
+func (s *Server) observable(name string) *gorx.Observable {
+	switch name {
+	case EVENT_NEW_BLOCK:
+		return s.Relay.Events.NewBlock
+	case EVENT_NEW_TRANSACTION:
+		return s.Relay.Events.NewTransaction
+	case EVENT_NEW_REGISTRATION:
+		return s.Relay.Events.NewRegistration
+	case EVENT_REORG:
+		return s.Relay.Events.Reorg
+	case EVENT_WALLET_BALANCE_CHANGED:
+		return s.Relay.Events.WalletBalanceChanged
+	}
+	return nil
+}
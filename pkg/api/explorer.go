@@ -0,0 +1,243 @@
+package api
+
+import (
+	"coins/pkg/blockchain"
+	"coins/pkg/model"
+	"coins/pkg/relay"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const defaultPageSize = 20
+const maxPageSize = 100
+
+// maxPage keeps page*size far from overflowing, no chain has that many blocks or transactions
+const maxPage = math.MaxInt32 / maxPageSize
+
+type BlockPage struct {
+	Page   int            // The index of this page
+	Size   int            // The maximum amount of blocks per page
+	Total  int            // The total amount of blocks in the chain
+	Blocks []*model.Block // The blocks on this page, newest first
+}
+
+type TransactionRecord struct {
+	Block       uint64                  // ID of the block that contains the transaction
+	Index       int                     // Position of the transaction inside the block
+	Direction   blockchain.TX_DIRECTION `json:",omitempty"` // Set when the record was looked up for a wallet
+	Transaction model.Transaction       // The transaction itself
+}
+
+type TransactionPage struct {
+	Page         int
+	Size         int
+	Transactions []TransactionRecord
+}
+
+type WalletDetails struct {
+	Address string
+	blockchain.WalletInfo
+}
+
+type Stats struct {
+	Height            uint64            // ID of the head block
+	Head              string            // Hash of the head block
+	Blocks            int               // Amount of blocks stored by this node
+	Wallets           int               // Amount of registered wallets
+	MarketVolume      float64           // Total amount of coins in circulation
+	TransactionVolume uint64            // Total amount of processed transactions
+	FloatingTx        int               // Transactions waiting to be mined
+	FloatingRx        int               // Registrations waiting to be mined
+	DroppedMessages   map[string]uint64 // Messages dropped by the relay, keyed by reason/type
+	InboundPeers      int               // Peers that connected to us
+	OutboundPeers     int               // Peers we connected to
+}
+
+// handleBlocks serves /api/blocks?page=&size= with the newest blocks first
+func (s *Server) handleBlocks(w http.ResponseWriter, req *http.Request) {
+	page, size := parsePage(req)
+	s.Relay.ChainMutex.RLock()
+	defer s.Relay.ChainMutex.RUnlock()
+	blocks := s.Relay.Blockchain.Blocks
+	res := BlockPage{Page: page, Size: size, Total: len(blocks), Blocks: []*model.Block{}}
+	// Walk backwards from the head, skipping the earlier pages
+	for i := len(blocks) - 1 - page*size; i >= 0 && len(res.Blocks) < size; i-- {
+		res.Blocks = append(res.Blocks, blocks[i])
+	}
+	writeJSON(w, res)
+}
+
+// handleBlock serves /api/blocks/{id or hash}
+func (s *Server) handleBlock(w http.ResponseWriter, req *http.Request) {
+	key := strings.TrimPrefix(req.URL.Path, "/api/blocks/")
+	s.Relay.ChainMutex.RLock()
+	defer s.Relay.ChainMutex.RUnlock()
+	var block *model.Block
+	// Numeric keys are block ids, everything else is treated as a hash
+	if id, err := strconv.ParseUint(key, 10, 64); err == nil {
+		block = s.Relay.Blockchain.GetBlock(id)
+	} else {
+		block = s.Relay.Blockchain.GetBlockByHash(key)
+	}
+	if block == nil {
+		http.Error(w, "block not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, block)
+}
+
+// handleTransactions serves /api/transactions?sender=&recipient=&page=&size= with the newest transactions first
+func (s *Server) handleTransactions(w http.ResponseWriter, req *http.Request) {
+	page, size := parsePage(req)
+	sender := req.URL.Query().Get("sender")
+	recipient := req.URL.Query().Get("recipient")
+	s.Relay.ChainMutex.RLock()
+	defer s.Relay.ChainMutex.RUnlock()
+	res := TransactionPage{Page: page, Size: size, Transactions: []TransactionRecord{}}
+	// Filtering by a single side can be answered from the address index
+	if (sender == "") != (recipient == "") {
+		address, direction := sender, blockchain.TX_OUT
+		if recipient != "" {
+			address, direction = recipient, blockchain.TX_IN
+		}
+		res.Transactions = s.resolve(s.Relay.Blockchain.History(address, direction, page, size))
+		writeJSON(w, res)
+		return
+	}
+	skip := page * size
+	blocks := s.Relay.Blockchain.Blocks
+	for i := len(blocks) - 1; i >= 0 && len(res.Transactions) < size; i-- {
+		for j := len(blocks[i].Transactions) - 1; j >= 0 && len(res.Transactions) < size; j-- {
+			tx := blocks[i].Transactions[j]
+			// Apply the filters
+			if (sender != "" && tx.Sender != sender) || (recipient != "" && tx.Recipient != recipient) {
+				continue
+			}
+			if skip > 0 {
+				skip--
+				continue
+			}
+			res.Transactions = append(res.Transactions, TransactionRecord{Block: blocks[i].ID, Index: j, Transaction: tx})
+		}
+	}
+	writeJSON(w, res)
+}
+
+// handleTransaction serves /api/transactions/{hash}
+func (s *Server) handleTransaction(w http.ResponseWriter, req *http.Request) {
+	hash := strings.TrimPrefix(req.URL.Path, "/api/transactions/")
+	s.Relay.ChainMutex.RLock()
+	defer s.Relay.ChainMutex.RUnlock()
+	ref, ok := s.Relay.Blockchain.FindTransaction(hash)
+	if !ok {
+		http.Error(w, "transaction not found", http.StatusNotFound)
+		return
+	}
+	records := s.resolve([]blockchain.TxRef{ref})
+	if len(records) == 0 {
+		http.Error(w, "transaction not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, records[0])
+}
+
+// handleHistory serves /api/history/{address}?page=&size= with incoming and outgoing transactions, newest first
+func (s *Server) handleHistory(w http.ResponseWriter, req *http.Request) {
+	page, size := parsePage(req)
+	address := strings.TrimPrefix(req.URL.Path, "/api/history/")
+	s.Relay.ChainMutex.RLock()
+	defer s.Relay.ChainMutex.RUnlock()
+	res := TransactionPage{Page: page, Size: size}
+	res.Transactions = s.resolve(s.Relay.Blockchain.History(address, "", page, size))
+	writeJSON(w, res)
+}
+
+// resolve looks up the referenced transactions
+func (s *Server) resolve(refs []blockchain.TxRef) []TransactionRecord {
+	records := []TransactionRecord{}
+	for _, ref := range refs {
+		tx := s.Relay.Blockchain.GetTransaction(ref)
+		if tx == nil {
+			continue
+		}
+		records = append(records, TransactionRecord{Block: ref.Block, Index: ref.Index, Direction: ref.Direction, Transaction: *tx})
+	}
+	return records
+}
+
+// handleWallet serves /api/wallets/{address}
+func (s *Server) handleWallet(w http.ResponseWriter, req *http.Request) {
+	address := strings.TrimPrefix(req.URL.Path, "/api/wallets/")
+	s.Relay.ChainMutex.RLock()
+	defer s.Relay.ChainMutex.RUnlock()
+	info := s.Relay.Blockchain.Chainstate.Wallets[address]
+	if info == nil {
+		http.Error(w, "wallet not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, WalletDetails{Address: address, WalletInfo: *info})
+}
+
+// handleProof serves /api/proofs/{address} with a proof of the wallet state against the state root of the head block
+func (s *Server) handleProof(w http.ResponseWriter, req *http.Request) {
+	address := strings.TrimPrefix(req.URL.Path, "/api/proofs/")
+	s.Relay.ChainMutex.RLock()
+	defer s.Relay.ChainMutex.RUnlock()
+	proof, err := s.Relay.Blockchain.ProveAccount(address)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(w, proof)
+}
+
+// handleStats serves /api/stats
+func (s *Server) handleStats(w http.ResponseWriter, req *http.Request) {
+	s.Relay.ChainMutex.RLock()
+	defer s.Relay.ChainMutex.RUnlock()
+	cs := s.Relay.Blockchain.Chainstate
+	writeJSON(w, Stats{
+		Height:            cs.LastBlock.ID,
+		Head:              cs.LastBlock.Hash,
+		Blocks:            len(s.Relay.Blockchain.Blocks),
+		Wallets:           len(cs.Wallets),
+		MarketVolume:      cs.MarketVolume,
+		TransactionVolume: cs.TransactionVolume,
+		FloatingTx:        len(s.Relay.FloatingTx),
+		FloatingRx:        len(s.Relay.FloatingRx),
+		DroppedMessages:   s.Relay.Metrics.Dropped(),
+		InboundPeers:      s.Relay.PeerManager.Count(relay.PEER_INBOUND),
+		OutboundPeers:     s.Relay.PeerManager.Count(relay.PEER_OUTBOUND),
+	})
+}
+
+// parsePage reads the page and size query parameters, falling back to sane defaults
+func parsePage(req *http.Request) (int, int) {
+	page, err := strconv.Atoi(req.URL.Query().Get("page"))
+	if err != nil || page < 0 {
+		page = 0
+	}
+	if page > maxPage {
+		page = maxPage
+	}
+	size, err := strconv.Atoi(req.URL.Query().Get("size"))
+	if err != nil || size <= 0 {
+		size = defaultPageSize
+	}
+	if size > maxPageSize {
+		size = maxPageSize
+	}
+	return page, size
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("[API] failed to write response with error %v\n", err)
+	}
+}
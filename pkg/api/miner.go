@@ -0,0 +1,10 @@
+package api
+
+import (
+	"net/http"
+)
+
+// handleMiner serves /api/miner with the hashrate and progress of our miner
+func (s *Server) handleMiner(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, s.Relay.MinerStats())
+}
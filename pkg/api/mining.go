@@ -0,0 +1,78 @@
+package api
+
+import (
+	"coins/pkg/blockchain"
+	"coins/pkg/model"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// MAX_SUBMIT_SIZE is the largest block body accepted by /api/mining/submit
+const MAX_SUBMIT_SIZE = 1 << 20
+
+// MiningTemplate is the block an external miner searches a nonce for
+type MiningTemplate struct {
+	Header        model.BlockHeader    // The fields covered by the hash, the Nonce is left to find
+	Transactions  []model.Transaction  // The body committed through the TxRoot of the header
+	Registrations []model.Registration // Registered before the transactions are processed
+	Difficulty    byte                 // The hash has to start with exactly this many zero bytes
+	Reward        float64              // Coins the block pays to the miner of the header
+	HashPrefix    string               // The hash is the sha256 of HashPrefix, the decimal nonce and HashSuffix
+	HashSuffix    string
+}
+
+type SubmitResult struct {
+	Accepted bool
+	Result   blockchain.BLOCK_VALIDATION_RESULT
+	Hash     string
+}
+
+// handleMiningTemplate serves /api/mining/template?miner= with the next block on top of our head, the reward
+// goes to our own wallet if no miner is given
+func (s *Server) handleMiningTemplate(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	miner := req.URL.Query().Get("miner")
+	if miner == "" {
+		miner = s.Relay.Wallet.Address
+	}
+	block, res := s.Relay.BlockTemplate(miner)
+	if res != blockchain.B_ACCEPT {
+		http.Error(w, fmt.Sprintf("cannot build a block for miner %v with reason=%v", miner, res), http.StatusBadRequest)
+		return
+	}
+	header := block.Header()
+	prefix, suffix := header.HashAffixes()
+	writeJSON(w, MiningTemplate{
+		Header:        header,
+		Transactions:  block.Transactions,
+		Registrations: block.Registrations,
+		Difficulty:    header.Difficulty(),
+		Reward:        model.BlockReward,
+		HashPrefix:    prefix,
+		HashSuffix:    suffix,
+	})
+}
+
+// handleMiningSubmit serves /api/mining/submit, it takes a mined block built from a template and reports
+// whether it extended our chain. The hash is computed if the block leaves it out
+func (s *Server) handleMiningSubmit(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var block model.Block
+	err := json.NewDecoder(http.MaxBytesReader(w, req.Body, MAX_SUBMIT_SIZE)).Decode(&block)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid block with error %v", err), http.StatusBadRequest)
+		return
+	}
+	if block.Hash == "" {
+		block.Hash = block.GetHash()
+	}
+	res := s.Relay.SubmitBlock(block)
+	writeJSON(w, SubmitResult{Accepted: res == blockchain.B_ACCEPT, Result: res, Hash: block.Hash})
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"bytes"
+	"coins/pkg/blockchain"
+	"coins/pkg/crypto"
+	"coins/pkg/model"
+	"coins/pkg/relay"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// testServer returns a server for a relay on a fresh chain whose wallet waits for its registration
+func testServer(t *testing.T) *Server {
+	t.Helper()
+	wallet, err := blockchain.NewWallet()
+	if err != nil {
+		t.Fatalf("could not create wallet with error %v", err)
+	}
+	r := &relay.Relay{
+		Blockchain:  *blockchain.NewBlockChain(),
+		Wallet:      *wallet,
+		ChainMutex:  &sync.RWMutex{},
+		PeerManager: relay.NewPeerManager(),
+		Seen:        relay.NewInvCache(relay.SEEN_CACHE_SIZE),
+		Requests:    relay.NewRequests(),
+		Sync:        relay.NewHeaderSync(),
+		Local:       true,
+	}
+	r.RegisterOrNop()
+	return &Server{Relay: r}
+}
+
+// fetchTemplate requests a mining template from the server
+func fetchTemplate(t *testing.T, s *Server, query string) (MiningTemplate, int) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.handleMiningTemplate(rec, httptest.NewRequest(http.MethodGet, "/api/mining/template"+query, nil))
+	var template MiningTemplate
+	if rec.Code == http.StatusOK {
+		if err := json.NewDecoder(rec.Body).Decode(&template); err != nil {
+			t.Fatalf("could not decode template with error %v", err)
+		}
+	}
+	return template, rec.Code
+}
+
+// submit posts the block to the server
+func submit(t *testing.T, s *Server, block model.Block) SubmitResult {
+	t.Helper()
+	bin, err := json.Marshal(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	s.handleMiningSubmit(rec, httptest.NewRequest(http.MethodPost, "/api/mining/submit", bytes.NewReader(bin)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("submit failed with status %v", rec.Code)
+	}
+	var result SubmitResult
+	if err := json.NewDecoder(rec.Body).Decode(&result); err != nil {
+		t.Fatalf("could not decode submit result with error %v", err)
+	}
+	return result
+}
+
+func TestMiningRoundTrip(t *testing.T) {
+	s := testServer(t)
+	for i := 0; i < 2; i++ {
+		template, code := fetchTemplate(t, s, "")
+		if code != http.StatusOK {
+			t.Fatalf("template request failed with status %v", code)
+		}
+		// Search the nonce the way an external miner does, from the affixes alone
+		var nonce uint64
+		var hash string
+		for nonce = 0; ; nonce++ {
+			sum := sha256.Sum256([]byte(template.HashPrefix + strconv.FormatUint(nonce, 10) + template.HashSuffix))
+			if crypto.GetHashDiff(sum[:]) == template.Difficulty {
+				hash = hex.EncodeToString(sum[:])
+				break
+			}
+		}
+		header := template.Header
+		block := model.Block{
+			ID:            header.ID,
+			Nonce:         nonce,
+			Previous:      header.Previous,
+			Miner:         header.Miner,
+			TxRoot:        header.TxRoot,
+			StateRoot:     header.StateRoot,
+			Transactions:  template.Transactions,
+			Registrations: template.Registrations,
+		}
+		if block.GetHash() != hash {
+			t.Fatalf("affixes hash to %v while the block hashes to %v", hash, block.GetHash())
+		}
+		result := submit(t, s, block)
+		if !result.Accepted || result.Hash != hash {
+			t.Fatalf("block %v submitted with result %+v", block.ID, result)
+		}
+		// The same block does not extend the chain twice
+		if result := submit(t, s, block); result.Accepted {
+			t.Fatalf("block %v accepted twice", block.ID)
+		}
+	}
+	if got := s.Relay.Blockchain.Chainstate.Wallets[s.Relay.Wallet.Address].Amount; got != 2*model.BlockReward {
+		t.Fatalf("miner owns %v instead of %v", got, 2*model.BlockReward)
+	}
+}
+
+func TestMiningTemplateUnknownMiner(t *testing.T) {
+	s := testServer(t)
+	if _, code := fetchTemplate(t, s, "?miner=unknown"); code != http.StatusBadRequest {
+		t.Fatalf("template for an unregistered miner served with status %v", code)
+	}
+}
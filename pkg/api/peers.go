@@ -0,0 +1,29 @@
+package api
+
+import (
+	"coins/pkg/protocol"
+	"coins/pkg/relay"
+	"net/http"
+	"sort"
+	"time"
+)
+
+type PeerInfo struct {
+	Addr      string
+	Direction relay.PEER_DIRECTION
+	Identity  string // The identity the peer authenticated with, empty on plaintext connections
+	State     relay.PEER_STATE
+	Version   *protocol.VersionContent // What the peer told us about itself in the handshake
+	Connected time.Time
+}
+
+// handlePeers serves /api/peers with the peers we are connected to, the longest connected first
+func (s *Server) handlePeers(w http.ResponseWriter, req *http.Request) {
+	peers := s.Relay.PeerManager.Peers()
+	sort.Slice(peers, func(i, j int) bool { return peers[i].Connected.Before(peers[j].Connected) })
+	res := make([]PeerInfo, len(peers))
+	for i, p := range peers {
+		res[i] = PeerInfo{Addr: p.Addr, Direction: p.Direction, Identity: p.Identity, State: p.State(), Version: p.Version, Connected: p.Connected}
+	}
+	writeJSON(w, res)
+}
@@ -2,6 +2,7 @@ package blockchain
 
 import (
 	"coins/pkg/crypto"
+	"coins/pkg/fsutil"
 	"coins/pkg/model"
 	"encoding/json"
 	"fmt"
@@ -12,6 +13,9 @@ import (
 type BlockChain struct {
 	Blocks     []*model.Block
 	Chainstate Chainstate
+	Undo       map[uint64]*BlockUndo // Undo data of the most recent blocks, keyed by block id
+	Addresses  *AddressIndex         `json:"-"` // Rebuilt from Blocks, never persisted
+	Hashes     *HashIndex            `json:"-"` // Rebuilt from Blocks, never persisted
 }
 
 type Chainstate struct {
@@ -44,25 +48,61 @@ func (bc *BlockChain) PrintWallets() {
 }
 
 func (bc *BlockChain) ProcessAll() {
+	// Without the history from genesis there is nothing to replay
+	if bc.Pruned() {
+		log.Printf("[BlockChain] cannot replay a pruned chain starting at block %v\n", bc.Blocks[0].ID)
+		return
+	}
 	// Reset the Blockchain
+	blocks := bc.Blocks
+	bc.Blocks = []*model.Block{}
 	bc.Chainstate.Wallets = make(map[string]*WalletInfo)
+	bc.Chainstate.LastBlock = model.Block{}
 	bc.Chainstate.MarketVolume = 0
 	bc.Chainstate.TransactionVolume = 0
-	// If transaction blocks actually exist
-	if len(bc.Blocks) > 1 {
-		// Process all the blocks
-		for _, block := range bc.Blocks[1:] {
-			alloc := *block
-			// Validate the Current Block
-			res := bc.ValidateBlock(alloc)
-			if res != B_ACCEPT {
-				log.Printf("[BlockChain] Block %v is invalid and will be skipped, reason=%v\n", alloc.ID, res)
-				continue
-			}
-			// Process the current block
-			bc.ProcessBlock(alloc)
+	bc.Undo = make(map[uint64]*BlockUndo)
+	bc.Reindex()
+	// Keep the genesis block, it carries no state
+	if len(blocks) == 0 {
+		return
+	}
+	bc.Blocks = append(bc.Blocks, blocks[0])
+	bc.index(blocks[0])
+	bc.Chainstate.LastBlock = *blocks[0]
+	// Process all the blocks
+	for _, block := range blocks[1:] {
+		alloc := *block
+		// Validate the Current Block
+		res := bc.ValidateBlock(alloc)
+		if res != B_ACCEPT {
+			log.Printf("[BlockChain] Block %v is invalid and will be skipped, reason=%v\n", alloc.ID, res)
+			continue
 		}
+		// Process the current block
+		bc.ProcessBlock(alloc)
+	}
+}
+
+// GetBlock returns the block with the specified id or nil if we dont have it
+func (bc *BlockChain) GetBlock(id uint64) *model.Block {
+	if len(bc.Blocks) == 0 || id < bc.Blocks[0].ID {
+		return nil
+	}
+	// Blocks are stored in sequence, so the id is an offset from our first block
+	idx := id - bc.Blocks[0].ID
+	if idx >= uint64(len(bc.Blocks)) {
+		return nil
+	}
+	return bc.Blocks[idx]
+}
+
+// GetBlockByHash returns the block with the specified hash or nil if we dont have it
+func (bc *BlockChain) GetBlockByHash(hash string) *model.Block {
+	id, ok := bc.HeightOf(hash)
+	if !ok {
+		return nil
 	}
+	return bc.GetBlock(id)
 }
 
 type BLOCK_VALIDATION_RESULT string
@@ -74,6 +114,9 @@ const (
 	B_REJECT_WRONG_DIFF    = BLOCK_VALIDATION_RESULT("BLOCK_REJECT_WRONG_HASH_DIFF")
 	B_REJECT_BLOCK_INVALID = BLOCK_VALIDATION_RESULT("BLOCK_REJECT_BLOCK_INVALID")
 	B_REJECT_TX_INVALID    = BLOCK_VALIDATION_RESULT("BLOCK_REJECT_TRANSACTION_INVALID")
+	B_REJECT_RX_INVALID    = BLOCK_VALIDATION_RESULT("BLOCK_REJECT_REGISTRATION_INVALID")
+	B_REJECT_HASH_MISMATCH = BLOCK_VALIDATION_RESULT("BLOCK_REJECT_HASH_MISMATCH")
+	B_REJECT_STATE_ROOT    = BLOCK_VALIDATION_RESULT("BLOCK_REJECT_WRONG_STATE_ROOT")
 )
 
 func (bc *BlockChain) ValidateBlock(b model.Block) BLOCK_VALIDATION_RESULT {
@@ -100,30 +143,134 @@ func (bc *BlockChain) ValidateBlock(b model.Block) BLOCK_VALIDATION_RESULT {
 		// if the block is invalid, we just skip it
 		return B_REJECT_BLOCK_INVALID
 	}
-	// Check all transaction signatures
-	for _, tx := range b.Transactions {
-		// find the public key of the sender
-		key, err := StringToKey(bc.Chainstate.Wallets[tx.Sender].PublicKey)
-		if err != nil {
-			return B_REJECT_TX_INVALID
-		}
-		// Verify the transaction
-		if !tx.Verify(key) {
-			return B_REJECT_TX_INVALID
-		}
-		// Check that the transaction has the expected id
-		if tx.TXID != bc.Chainstate.Wallets[tx.Sender].TXC+1 {
-			return B_REJECT_TX_INVALID
+	// Check that the hash covers the header and the header covers the body
+	if b.Hash != b.GetHash() {
+		return B_REJECT_HASH_MISMATCH
+	}
+	if b.TxRoot != b.ComputeTxRoot() {
+		return B_REJECT_BLOCK_INVALID
+	}
+	// Apply the block to copies of the wallets it touches
+	wallets, res := bc.simulate(b)
+	if res != B_ACCEPT {
+		return res
+	}
+	// Check that the block commits to the resulting state
+	if b.StateRoot != stateRoot(bc.Chainstate.Wallets, wallets) {
+		return B_REJECT_STATE_ROOT
+	}
+	return B_ACCEPT
+}
+
+// simulate applies the block to copies of the wallets it touches, in the same order ProcessBlock does,
+// and returns the copies
+func (bc *BlockChain) simulate(b model.Block) (map[string]*WalletInfo, BLOCK_VALIDATION_RESULT) {
+	view := bc.newStateView()
+	// Registrations may not overwrite existing wallets
+	for _, reg := range b.Registrations {
+		if !view.register(reg) {
+			return nil, B_REJECT_RX_INVALID
 		}
-		// Check if enough balance exists to make the transaction
-		if tx.Amount > bc.Chainstate.Wallets[tx.Sender].Amount {
-			return B_REJECT_TX_INVALID
+	}
+	// The miner needs a wallet to receive the reward
+	if !view.reward(b.Miner) {
+		return nil, B_REJECT_BLOCK_INVALID
+	}
+	// Check all transactions
+	for _, tx := range b.Transactions {
+		if !view.transfer(tx) {
+			return nil, B_REJECT_TX_INVALID
 		}
 	}
-	return B_ACCEPT
+	return view.wallets, B_ACCEPT
+}
+
+// stateView applies registrations and transactions to copies of the wallets they touch, the chainstate
+// itself is left as it is
+type stateView struct {
+	chainstate *Chainstate
+	wallets    map[string]*WalletInfo
+}
+
+func (bc *BlockChain) newStateView() *stateView {
+	return &stateView{chainstate: &bc.Chainstate, wallets: make(map[string]*WalletInfo)}
+}
+
+// lookup returns the copy of the wallet, nil if it is not registered
+func (v *stateView) lookup(addr string) *WalletInfo {
+	if info, ok := v.wallets[addr]; ok {
+		return info
+	}
+	if info := v.chainstate.Wallets[addr]; info != nil {
+		alloc := *info
+		v.wallets[addr] = &alloc
+		return &alloc
+	}
+	return nil
+}
+
+// register adds the wallet of the registration if it does not exist yet
+func (v *stateView) register(reg model.Registration) bool {
+	if len(reg.Wallet) == 0 || v.lookup(reg.Wallet) != nil {
+		return false
+	}
+	v.wallets[reg.Wallet] = &WalletInfo{PublicKey: reg.PublicKey}
+	return true
+}
+
+// reward pays the block reward to the miner
+func (v *stateView) reward(miner string) bool {
+	info := v.lookup(miner)
+	if info == nil {
+		return false
+	}
+	info.Amount += model.BlockReward
+	return true
+}
+
+// transfer applies the transaction if it is valid on top of the view, an invalid one changes nothing
+func (v *stateView) transfer(tx model.Transaction) bool {
+	sender := v.lookup(tx.Sender)
+	recipient := v.lookup(tx.Recipient)
+	if sender == nil || recipient == nil {
+		return false
+	}
+	// find the public key of the sender
+	key, err := StringToKey(sender.PublicKey)
+	if err != nil {
+		return false
+	}
+	// Verify the transaction
+	if !tx.Verify(key) {
+		return false
+	}
+	// The index finds transactions by the hash the block carries, a forged one could shadow another transaction
+	if hash, err := tx.GetHash(); err != nil || tx.Hash != hash {
+		return false
+	}
+	// Check that the transaction has the expected id
+	if tx.TXID != sender.TXC+1 {
+		return false
+	}
+	// Check if enough balance exists to make the transaction
+	if tx.Amount < 0 || tx.Amount > sender.Amount {
+		return false
+	}
+	sender.Amount -= tx.Amount
+	recipient.Amount += tx.Amount
+	sender.TXC++
+	return true
 }
 
 func (bc *BlockChain) ProcessBlock(b model.Block) error {
+	// Remember the state we are about to change so the block can be rolled back
+	if bc.Undo == nil {
+		bc.Undo = make(map[uint64]*BlockUndo)
+	}
+	bc.Undo[b.ID] = bc.newUndo(b)
+	if b.ID > MaxUndoDepth {
+		delete(bc.Undo, b.ID-MaxUndoDepth)
+	}
 	// Process the Registrations in this block
 	for _, reg := range b.Registrations {
 		bc.Chainstate.Wallets[reg.Wallet] = &WalletInfo{}
@@ -144,6 +291,8 @@ func (bc *BlockChain) ProcessBlock(b model.Block) error {
 	bc.Chainstate.LastBlock = b
 	// Append the Block
 	bc.Blocks = append(bc.Blocks, &b)
+	// Index the Block
+	bc.index(&b)
 	return nil
 }
 
@@ -171,6 +320,8 @@ func ReadFile() (*BlockChain, error) {
 	if err != nil {
 		return nil, fmt.Errorf("could not deserialize blockchain with error %v", err)
 	}
+	// rebuild the indexes that are not persisted
+	bcf.Reindex()
 	return &bcf, err
 }
 
@@ -181,7 +332,7 @@ func (bc *BlockChain) WriteToFile() error {
 		return fmt.Errorf("could not serialize blockchain with error %v", err)
 	}
 	// write the blockchain to the file
-	err = ioutil.WriteFile("blockchain.json", bin, 0644)
+	err = fsutil.WriteFileAtomic("blockchain.json", bin, 0644)
 	if err != nil {
 		return fmt.Errorf("could not wrtie blockchain with error %v", err)
 	}
@@ -0,0 +1,194 @@
+package blockchain
+
+import (
+	"coins/pkg/crypto"
+	"coins/pkg/model"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"testing"
+)
+
+// testKeys are the keys of the wallets of the test chain, small keys keep the tests fast
+var testKeys = map[string]*rsa.PrivateKey{}
+
+func testKey(t *testing.T, addr string) *rsa.PrivateKey {
+	t.Helper()
+	if key, ok := testKeys[addr]; ok {
+		return key
+	}
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("could not generate key with error %v", err)
+	}
+	testKeys[addr] = key
+	return key
+}
+
+func testRegistration(t *testing.T, addr string) model.Registration {
+	t.Helper()
+	pub, err := KeyToString(&testKey(t, addr).PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return model.Registration{Wallet: addr, PublicKey: pub}
+}
+
+func testTransaction(t *testing.T, id uint64, from string, to string, amount float64) model.Transaction {
+	t.Helper()
+	tx := model.Transaction{TXID: id, Sender: from, Recipient: to, Amount: amount}
+	hash, err := tx.GetHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx.Hash = hash
+	tx.Signature, err = crypto.SignHashB64(crypto.ToBytes(hash), testKey(t, from))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tx
+}
+
+// nextBlock mines a block on top of the head of the chain
+func nextBlock(t *testing.T, bc *BlockChain, miner string, rxs []model.Registration, txs []model.Transaction) model.Block {
+	t.Helper()
+	block := model.Block{
+		ID:            bc.Chainstate.LastBlock.ID + 1,
+		Previous:      bc.Chainstate.LastBlock.Hash,
+		Miner:         miner,
+		Transactions:  txs,
+		Registrations: rxs,
+	}
+	// Invalid blocks have no state root, validation rejects them before looking at it
+	block.StateRoot, _ = bc.StateRootAfter(block)
+	block.Mine(context.Background(), 1, nil)
+	return block
+}
+
+// testChain returns a chain in which alice, bob and carol are registered and alice owns the first reward
+func testChain(t *testing.T) *BlockChain {
+	t.Helper()
+	bc := NewBlockChain()
+	rxs := []model.Registration{testRegistration(t, "alice"), testRegistration(t, "bob"), testRegistration(t, "carol")}
+	block := nextBlock(t, bc, "alice", rxs, nil)
+	if res := bc.ValidateBlock(block); res != B_ACCEPT {
+		t.Fatalf("first block rejected with reason=%v", res)
+	}
+	bc.ProcessBlock(block)
+	return bc
+}
+
+func TestValidateBlockInOrder(t *testing.T) {
+	stdSigned := testTransaction(t, 1, "alice", "bob", 0.5)
+	signature, err := crypto.DecodeB64(stdSigned.Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdSigned.Signature = base64.StdEncoding.EncodeToString(signature)
+	forged := testTransaction(t, 1, "alice", "bob", 1)
+	forged.Hash = testTransaction(t, 1, "alice", "carol", 1).Hash
+	unhashed := testTransaction(t, 1, "alice", "bob", 1)
+	unhashed.Hash = ""
+	tests := []struct {
+		name  string
+		miner string
+		rxs   []model.Registration
+		txs   []model.Transaction
+		want  BLOCK_VALIDATION_RESULT
+	}{
+		{
+			name:  "transfer",
+			miner: "bob",
+			txs:   []model.Transaction{testTransaction(t, 1, "alice", "bob", 1)},
+			want:  B_ACCEPT,
+		},
+		{
+			name:  "spend coins received earlier in the block",
+			miner: "carol",
+			txs:   []model.Transaction{testTransaction(t, 1, "alice", "bob", 1), testTransaction(t, 1, "bob", "carol", 0.5)},
+			want:  B_ACCEPT,
+		},
+		{
+			name:  "spend the reward of the block",
+			miner: "bob",
+			txs:   []model.Transaction{testTransaction(t, 1, "bob", "carol", 1)},
+			want:  B_ACCEPT,
+		},
+		{
+			name:  "signature in the standard alphabet",
+			miner: "bob",
+			txs:   []model.Transaction{stdSigned},
+			want:  B_ACCEPT,
+		},
+		{
+			name:  "spend coins received later in the block",
+			miner: "carol",
+			txs:   []model.Transaction{testTransaction(t, 1, "bob", "carol", 0.5), testTransaction(t, 1, "alice", "bob", 1)},
+			want:  B_REJECT_TX_INVALID,
+		},
+		{
+			name:  "double spend within the block",
+			miner: "carol",
+			txs:   []model.Transaction{testTransaction(t, 1, "alice", "bob", 1), testTransaction(t, 2, "alice", "carol", 1)},
+			want:  B_REJECT_TX_INVALID,
+		},
+		{
+			name:  "negative amount",
+			miner: "carol",
+			txs:   []model.Transaction{testTransaction(t, 1, "bob", "alice", -1)},
+			want:  B_REJECT_TX_INVALID,
+		},
+		{
+			name:  "skipped transaction id",
+			miner: "bob",
+			txs:   []model.Transaction{testTransaction(t, 2, "alice", "bob", 1)},
+			want:  B_REJECT_TX_INVALID,
+		},
+		{
+			name:  "hash of another transaction",
+			miner: "bob",
+			txs:   []model.Transaction{forged},
+			want:  B_REJECT_TX_INVALID,
+		},
+		{
+			name:  "missing hash",
+			miner: "bob",
+			txs:   []model.Transaction{unhashed},
+			want:  B_REJECT_TX_INVALID,
+		},
+		{
+			name:  "unregistered recipient",
+			miner: "bob",
+			txs:   []model.Transaction{testTransaction(t, 1, "alice", "dave", 1)},
+			want:  B_REJECT_TX_INVALID,
+		},
+		{
+			name:  "registration of an existing wallet",
+			miner: "bob",
+			rxs:   []model.Registration{testRegistration(t, "mallory"), {Wallet: "alice", PublicKey: testRegistration(t, "mallory").PublicKey}},
+			want:  B_REJECT_RX_INVALID,
+		},
+		{
+			name:  "miner registered in the block",
+			miner: "dave",
+			rxs:   []model.Registration{testRegistration(t, "dave")},
+			txs:   []model.Transaction{testTransaction(t, 1, "dave", "alice", 1)},
+			want:  B_ACCEPT,
+		},
+		{
+			name:  "miner without a wallet",
+			miner: "erin",
+			want:  B_REJECT_BLOCK_INVALID,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bc := testChain(t)
+			block := nextBlock(t, bc, test.miner, test.rxs, test.txs)
+			if res := bc.ValidateBlock(block); res != test.want {
+				t.Fatalf("block validated with reason=%v instead of %v", res, test.want)
+			}
+		})
+	}
+}
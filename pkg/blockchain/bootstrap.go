@@ -0,0 +1,48 @@
+package blockchain
+
+import (
+	"coins/pkg/crypto"
+	"coins/pkg/model"
+	"fmt"
+)
+
+// Bootstrap builds a pruned chain from a chainstate and the blocks leading up to it. The blocks have to link to
+// each other and end at the last block of the chainstate, whose state root has to match the chainstate
+func Bootstrap(cs Chainstate, blocks []*model.Block) (*BlockChain, error) {
+	if len(blocks) == 0 {
+		return nil, fmt.Errorf("bootstrap requires at least one block")
+	}
+	// Check that the blocks form a chain
+	for i, block := range blocks {
+		if block.Hash != block.GetHash() {
+			return nil, fmt.Errorf("block %v does not match its hash", block.ID)
+		}
+		// Every block but the genesis block has to carry its proof of work
+		header := block.Header()
+		if block.ID > 0 && crypto.GetHashDiff(crypto.ToBytes(block.Hash)) != header.Difficulty() {
+			return nil, fmt.Errorf("block %v does not meet its difficulty", block.ID)
+		}
+		if i > 0 && (block.ID != blocks[i-1].ID+1 || block.Previous != blocks[i-1].Hash) {
+			return nil, fmt.Errorf("block %v does not link to block %v", block.ID, blocks[i-1].ID)
+		}
+	}
+	// Check that the chain ends where the chainstate does
+	last := blocks[len(blocks)-1]
+	if cs.LastBlock.ID != last.ID || cs.LastBlock.Hash != last.Hash {
+		return nil, fmt.Errorf("blocks end at %v but the chainstate at %v", last.ID, cs.LastBlock.ID)
+	}
+	if cs.Wallets == nil {
+		cs.Wallets = make(map[string]*WalletInfo)
+	}
+	// Check that the chainstate is the one the last block commits to
+	if root := cs.StateRoot(); root != last.StateRoot {
+		return nil, fmt.Errorf("chainstate root %v does not match the state root %v of block %v", root, last.StateRoot, last.ID)
+	}
+	// Every block pays exactly one reward, so the market volume follows from the height
+	if cs.MarketVolume != float64(last.ID)*model.BlockReward {
+		return nil, fmt.Errorf("chainstate market volume %v does not match height %v", cs.MarketVolume, last.ID)
+	}
+	bc := &BlockChain{Blocks: blocks, Chainstate: cs, Undo: make(map[uint64]*BlockUndo)}
+	bc.Reindex()
+	return bc, nil
+}
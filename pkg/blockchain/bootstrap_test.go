@@ -0,0 +1,126 @@
+package blockchain
+
+import (
+	"coins/pkg/crypto"
+	"coins/pkg/model"
+	"strings"
+	"testing"
+)
+
+// copyChainstate returns a copy of the chainstate whose wallets can be changed without touching the original
+func copyChainstate(cs Chainstate) Chainstate {
+	wallets := make(map[string]*WalletInfo, len(cs.Wallets))
+	for addr, info := range cs.Wallets {
+		copied := *info
+		wallets[addr] = &copied
+	}
+	cs.Wallets = wallets
+	return cs
+}
+
+func TestBootstrap(t *testing.T) {
+	source := testChain(t)
+	growChain(t, source, 5)
+	recent := source.Blocks[len(source.Blocks)-3:]
+	// unmined returns a copy of the block whose hash does not meet the difficulty
+	unmined := func(block *model.Block) *model.Block {
+		copied := *block
+		for {
+			copied.Nonce++
+			copied.Hash = copied.GetHash()
+			header := copied.Header()
+			if crypto.GetHashDiff(crypto.ToBytes(copied.Hash)) != header.Difficulty() {
+				return &copied
+			}
+		}
+	}
+	tests := []struct {
+		name   string
+		blocks func() []*model.Block
+		state  func(cs *Chainstate)
+		err    string
+	}{
+		{
+			name:   "recent blocks",
+			blocks: func() []*model.Block { return recent },
+		},
+		{
+			name:   "all blocks",
+			blocks: func() []*model.Block { return source.Blocks },
+		},
+		{
+			name:   "no blocks",
+			blocks: func() []*model.Block { return nil },
+			err:    "at least one block",
+		},
+		{
+			name: "block that does not match its hash",
+			blocks: func() []*model.Block {
+				tampered := *recent[0]
+				tampered.Miner = "bob"
+				return []*model.Block{&tampered, recent[1], recent[2]}
+			},
+			err: "does not match its hash",
+		},
+		{
+			name: "block without proof of work",
+			blocks: func() []*model.Block {
+				return []*model.Block{unmined(recent[0]), recent[1], recent[2]}
+			},
+			err: "does not meet its difficulty",
+		},
+		{
+			name:   "gap between the blocks",
+			blocks: func() []*model.Block { return []*model.Block{recent[0], recent[2]} },
+			err:    "does not link",
+		},
+		{
+			name:   "blocks ending before the chainstate",
+			blocks: func() []*model.Block { return recent[:2] },
+			err:    "but the chainstate at",
+		},
+		{
+			name:   "forged balance",
+			blocks: func() []*model.Block { return recent },
+			state:  func(cs *Chainstate) { cs.Wallets["bob"].Amount += 100 },
+			err:    "does not match the state root",
+		},
+		{
+			name:   "forged market volume",
+			blocks: func() []*model.Block { return recent },
+			state:  func(cs *Chainstate) { cs.MarketVolume += 100 },
+			err:    "does not match height",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			cs := copyChainstate(source.Chainstate)
+			if test.state != nil {
+				test.state(&cs)
+			}
+			blocks := test.blocks()
+			bc, err := Bootstrap(cs, blocks)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("bootstrap failed with error %v instead of %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not bootstrap with error %v", err)
+			}
+			if bc.Chainstate.LastBlock.Hash != source.Chainstate.LastBlock.Hash || bc.Pruned() != (blocks[0].ID > 0) {
+				t.Fatalf("bootstrapped chain ends at %v with pruned=%v", bc.Chainstate.LastBlock.ID, bc.Pruned())
+			}
+			if _, ok := bc.HeightOf(blocks[0].Hash); !ok {
+				t.Fatal("bootstrapped blocks are not indexed")
+			}
+			// The bootstrapped chain follows the source chain
+			growChain(t, source, 1)
+			defer source.Rollback(source.Chainstate.LastBlock.ID - 1)
+			if res := bc.ValidateBlock(*source.Blocks[len(source.Blocks)-1]); res != B_ACCEPT {
+				t.Fatalf("next block rejected with reason=%v", res)
+			}
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// Digest returns a deterministic hash over the complete chainstate, which two nodes with the same state always agree on
+func (cs *Chainstate) Digest() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%v|%v|%v|%v\n", cs.LastBlock.ID, cs.LastBlock.Hash, cs.MarketVolume, cs.TransactionVolume)
+	// Map iteration order is random, so the wallets are hashed sorted by address
+	addrs := make([]string, 0, len(cs.Wallets))
+	for addr := range cs.Wallets {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	for _, addr := range addrs {
+		info := cs.Wallets[addr]
+		fmt.Fprintf(h, "%v|%v|%v|%v\n", addr, info.Amount, info.TXC, info.PublicKey)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,22 @@
+package blockchain
+
+import "coins/pkg/model"
+
+// Genesis returns the first block of every chain, it carries no state
+func Genesis() model.Block {
+	genesis := model.Block{}
+	genesis.Hash = genesis.GetHash()
+	return genesis
+}
+
+// NewBlockChain returns a chain that holds only the genesis block
+func NewBlockChain() *BlockChain {
+	genesis := Genesis()
+	bc := &BlockChain{
+		Blocks:     []*model.Block{&genesis},
+		Chainstate: Chainstate{Wallets: make(map[string]*WalletInfo), LastBlock: genesis},
+		Undo:       make(map[uint64]*BlockUndo),
+	}
+	bc.Reindex()
+	return bc
+}
@@ -0,0 +1,16 @@
+package blockchain
+
+import "coins/pkg/model"
+
+// HeadersAfter returns the headers of up to max blocks following the height
+func (bc *BlockChain) HeadersAfter(height uint64, max int) []model.BlockHeader {
+	headers := []model.BlockHeader{}
+	for id := height + 1; id <= bc.Chainstate.LastBlock.ID && len(headers) < max; id++ {
+		block := bc.GetBlock(id)
+		if block == nil {
+			break
+		}
+		headers = append(headers, block.Header())
+	}
+	return headers
+}
@@ -0,0 +1,196 @@
+package blockchain
+
+import "coins/pkg/model"
+
+type TX_DIRECTION string
+
+const (
+	TX_IN  = TX_DIRECTION("IN")  // the wallet received the transaction
+	TX_OUT = TX_DIRECTION("OUT") // the wallet sent the transaction
+)
+
+type TxRef struct {
+	Block     uint64       // ID of the block that contains the transaction
+	Index     int          // Position of the transaction inside the block
+	Direction TX_DIRECTION // Whether the wallet sent or received the transaction
+}
+
+// AddressIndex maps wallet addresses to the transactions touching them, in chain order
+type AddressIndex struct {
+	refs map[string][]TxRef
+}
+
+func NewAddressIndex() *AddressIndex {
+	return &AddressIndex{refs: make(map[string][]TxRef)}
+}
+
+// Add indexes all transactions of the block, blocks must be added in chain order
+func (ai *AddressIndex) Add(b *model.Block) {
+	for i, tx := range b.Transactions {
+		ai.refs[tx.Sender] = append(ai.refs[tx.Sender], TxRef{Block: b.ID, Index: i, Direction: TX_OUT})
+		ai.refs[tx.Recipient] = append(ai.refs[tx.Recipient], TxRef{Block: b.ID, Index: i, Direction: TX_IN})
+	}
+}
+
+// Remove drops all references to the block, which must be the last block that was added
+func (ai *AddressIndex) Remove(b *model.Block) {
+	for _, tx := range b.Transactions {
+		for _, addr := range []string{tx.Sender, tx.Recipient} {
+			refs := ai.refs[addr]
+			// references of the block are always at the end of the list
+			for len(refs) > 0 && refs[len(refs)-1].Block == b.ID {
+				refs = refs[:len(refs)-1]
+			}
+			if len(refs) == 0 {
+				delete(ai.refs, addr)
+			} else {
+				ai.refs[addr] = refs
+			}
+		}
+	}
+}
+
+// RemoveOldest drops all references to the block, which must be the first block that is still indexed
+func (ai *AddressIndex) RemoveOldest(b *model.Block) {
+	for _, tx := range b.Transactions {
+		for _, addr := range []string{tx.Sender, tx.Recipient} {
+			refs := ai.refs[addr]
+			// references of the block are always at the start of the list
+			drop := 0
+			for drop < len(refs) && refs[drop].Block == b.ID {
+				drop++
+			}
+			if drop == 0 {
+				continue
+			}
+			if drop == len(refs) {
+				delete(ai.refs, addr)
+			} else {
+				// Copy the kept references, reslicing would keep the dropped ones in the backing array forever
+				ai.refs[addr] = append([]TxRef(nil), refs[drop:]...)
+			}
+		}
+	}
+}
+
+// Count returns the amount of indexed transactions touching the address
+func (ai *AddressIndex) Count(addr string) int {
+	return len(ai.refs[addr])
+}
+
+// Query returns a page of transactions touching the address, newest first.
+// An empty direction matches both incoming and outgoing transactions
+func (ai *AddressIndex) Query(addr string, direction TX_DIRECTION, page int, size int) []TxRef {
+	refs := ai.refs[addr]
+	res := []TxRef{}
+	skip := page * size
+	for i := len(refs) - 1; i >= 0 && len(res) < size; i-- {
+		if direction != "" && refs[i].Direction != direction {
+			continue
+		}
+		if skip > 0 {
+			skip--
+			continue
+		}
+		res = append(res, refs[i])
+	}
+	return res
+}
+
+// HashIndex maps block hashes to block ids and transaction hashes to their location in the chain
+type HashIndex struct {
+	blocks map[string]uint64
+	txs    map[string]TxRef
+}
+
+func NewHashIndex() *HashIndex {
+	return &HashIndex{blocks: make(map[string]uint64), txs: make(map[string]TxRef)}
+}
+
+// Add indexes the hash of the block and the hashes of its transactions
+func (hi *HashIndex) Add(b *model.Block) {
+	hi.blocks[b.Hash] = b.ID
+	for i, tx := range b.Transactions {
+		hi.txs[tx.Hash] = TxRef{Block: b.ID, Index: i}
+	}
+}
+
+// Remove drops the hashes of the block and its transactions
+func (hi *HashIndex) Remove(b *model.Block) {
+	delete(hi.blocks, b.Hash)
+	for _, tx := range b.Transactions {
+		delete(hi.txs, tx.Hash)
+	}
+}
+
+// Reindex rebuilds the indexes from the stored blocks
+func (bc *BlockChain) Reindex() {
+	bc.Addresses = NewAddressIndex()
+	bc.Hashes = NewHashIndex()
+	for _, block := range bc.Blocks {
+		bc.index(block)
+	}
+}
+
+// index adds a block that was appended to the chain to all indexes
+func (bc *BlockChain) index(b *model.Block) {
+	if bc.Addresses == nil || bc.Hashes == nil {
+		bc.Reindex()
+		return
+	}
+	bc.Addresses.Add(b)
+	bc.Hashes.Add(b)
+}
+
+// unindex removes the head block from all indexes
+func (bc *BlockChain) unindex(b *model.Block) {
+	if bc.Addresses == nil || bc.Hashes == nil {
+		return
+	}
+	bc.Addresses.Remove(b)
+	bc.Hashes.Remove(b)
+}
+
+// unindexOldest removes the first block from all indexes
+func (bc *BlockChain) unindexOldest(b *model.Block) {
+	if bc.Addresses == nil || bc.Hashes == nil {
+		return
+	}
+	bc.Addresses.RemoveOldest(b)
+	bc.Hashes.Remove(b)
+}
+
+// HeightOf returns the id of the block with the specified hash, if it is part of our chain
+func (bc *BlockChain) HeightOf(hash string) (uint64, bool) {
+	if bc.Hashes == nil {
+		return 0, false
+	}
+	id, ok := bc.Hashes.blocks[hash]
+	return id, ok
+}
+
+// FindTransaction returns the location of the transaction with the specified hash, if it is part of our chain
+func (bc *BlockChain) FindTransaction(hash string) (TxRef, bool) {
+	if bc.Hashes == nil {
+		return TxRef{}, false
+	}
+	ref, ok := bc.Hashes.txs[hash]
+	return ref, ok
+}
+
+// History returns a page of transactions touching the address in the direction, newest first
+func (bc *BlockChain) History(addr string, direction TX_DIRECTION, page int, size int) []TxRef {
+	if bc.Addresses == nil {
+		return []TxRef{}
+	}
+	return bc.Addresses.Query(addr, direction, page, size)
+}
+
+// GetTransaction resolves a transaction reference to the transaction it points to
+func (bc *BlockChain) GetTransaction(ref TxRef) *model.Transaction {
+	block := bc.GetBlock(ref.Block)
+	if block == nil || ref.Index >= len(block.Transactions) {
+		return nil
+	}
+	return &block.Transactions[ref.Index]
+}
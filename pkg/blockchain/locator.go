@@ -0,0 +1,36 @@
+package blockchain
+
+// Locator returns hashes of our chain from the head backwards, one per block for the last ten blocks and
+// exponentially sparser before, always ending with the oldest block we have. A peer uses the first hash it
+// knows to find where our chains fork
+func (bc *BlockChain) Locator() []string {
+	locator := []string{}
+	if len(bc.Blocks) == 0 {
+		return locator
+	}
+	lowest := bc.Blocks[0].ID
+	step := uint64(1)
+	for id := bc.Chainstate.LastBlock.ID; ; id -= step {
+		locator = append(locator, bc.GetBlock(id).Hash)
+		if len(locator) >= 10 {
+			step *= 2
+		}
+		if id < lowest+step {
+			break
+		}
+	}
+	if last := bc.Blocks[0].Hash; locator[len(locator)-1] != last {
+		locator = append(locator, last)
+	}
+	return locator
+}
+
+// FindFork returns the height of the first hash of the locator that is part of our chain
+func (bc *BlockChain) FindFork(locator []string) (uint64, bool) {
+	for _, hash := range locator {
+		if height, ok := bc.HeightOf(hash); ok {
+			return height, true
+		}
+	}
+	return 0, false
+}
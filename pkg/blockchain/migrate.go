@@ -0,0 +1,21 @@
+package blockchain
+
+import "fmt"
+
+// Migrate replays the blocks of a legacy chain on top of our genesis block. The legacy chainstate is not trusted,
+// it follows from the blocks. Chains written before the current block rules fail to validate and are refused
+func Migrate(legacy *BlockChain) (*BlockChain, error) {
+	genesis := Genesis()
+	if len(legacy.Blocks) == 0 || legacy.Blocks[0].Hash != genesis.Hash {
+		return nil, fmt.Errorf("incompatible legacy chain, it does not start at our genesis block")
+	}
+	bc := NewBlockChain()
+	for _, block := range legacy.Blocks[1:] {
+		res := bc.ValidateBlock(*block)
+		if res != B_ACCEPT {
+			return nil, fmt.Errorf("incompatible legacy chain, block %v rejected with reason=%v", block.ID, res)
+		}
+		bc.ProcessBlock(*block)
+	}
+	return bc, nil
+}
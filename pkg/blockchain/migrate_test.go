@@ -0,0 +1,105 @@
+package blockchain
+
+import (
+	"coins/pkg/model"
+	"context"
+	"strings"
+	"testing"
+)
+
+// legacyChain returns a chain from our genesis block in which alice paid bob
+func legacyChain(t *testing.T) *BlockChain {
+	t.Helper()
+	bc := NewBlockChain()
+	blocks := []struct {
+		miner string
+		rxs   []model.Registration
+		txs   []model.Transaction
+	}{
+		{miner: "alice", rxs: []model.Registration{testRegistration(t, "alice"), testRegistration(t, "bob")}},
+		{miner: "bob"},
+		{miner: "bob", txs: []model.Transaction{testTransaction(t, 1, "alice", "bob", 0.5)}},
+	}
+	for _, b := range blocks {
+		block := nextBlock(t, bc, b.miner, b.rxs, b.txs)
+		if res := bc.ValidateBlock(block); res != B_ACCEPT {
+			t.Fatalf("block %v rejected with reason=%v", block.ID, res)
+		}
+		bc.ProcessBlock(block)
+	}
+	return bc
+}
+
+func TestMigrate(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(bc *BlockChain)
+		err    string
+	}{
+		{
+			name:   "valid chain",
+			modify: func(bc *BlockChain) {},
+		},
+		{
+			name: "chainstate that does not follow from the blocks",
+			modify: func(bc *BlockChain) {
+				bc.Chainstate.Wallets["alice"].Amount = 1000
+			},
+		},
+		{
+			name: "no blocks",
+			modify: func(bc *BlockChain) {
+				bc.Blocks = nil
+			},
+			err: "does not start at our genesis block",
+		},
+		{
+			name: "foreign genesis block",
+			modify: func(bc *BlockChain) {
+				bc.Blocks[0] = &model.Block{Hash: "genesis"}
+			},
+			err: "does not start at our genesis block",
+		},
+		{
+			name: "tampered transaction",
+			modify: func(bc *BlockChain) {
+				bc.Blocks[3].Transactions[0].Amount = 2
+			},
+			err: "block 3 rejected",
+		},
+		{
+			name: "block without a state root",
+			modify: func(bc *BlockChain) {
+				block := *bc.Blocks[2]
+				block.StateRoot = ""
+				block.Hash = ""
+				block.Mine(context.Background(), 1, nil)
+				bc.Blocks[2] = &block
+			},
+			err: "block 2 rejected",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			legacy := legacyChain(t)
+			want := legacy.Chainstate.Wallets["alice"].Amount
+			test.modify(legacy)
+			bc, err := Migrate(legacy)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("migration failed with error %v instead of %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not migrate with error %v", err)
+			}
+			if bc.Chainstate.LastBlock.Hash != legacy.Blocks[3].Hash {
+				t.Fatalf("migrated chain ends at %v instead of %v", bc.Chainstate.LastBlock.ID, legacy.Blocks[3].ID)
+			}
+			if amount := bc.Chainstate.Wallets["alice"].Amount; amount != want {
+				t.Fatalf("alice owns %v instead of %v", amount, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package blockchain
+
+import "coins/pkg/model"
+
+// MinPruneDepth is the least amount of blocks a pruned chain keeps, so rollbacks within the undo window stay possible
+const MinPruneDepth = MaxUndoDepth
+
+// PruneBatch is how many blocks past the kept ones a chain grows before it is pruned, so pruning does not run on
+// every new block
+const PruneBatch = 64
+
+// Prune drops all but the last keep blocks once the chain holds PruneBatch blocks more than that. The chainstate is
+// unaffected, so new blocks are still fully validated
+func (bc *BlockChain) Prune(keep uint64) {
+	if uint64(len(bc.Blocks)) <= keep+PruneBatch {
+		return
+	}
+	drop := uint64(len(bc.Blocks)) - keep
+	for _, block := range bc.Blocks[:drop] {
+		bc.unindexOldest(block)
+	}
+	// Copy the kept blocks so the pruned ones can be garbage collected
+	kept := make([]*model.Block, keep)
+	copy(kept, bc.Blocks[drop:])
+	bc.Blocks = kept
+}
+
+// Pruned reports whether the chain lacks the history before its first block
+func (bc *BlockChain) Pruned() bool {
+	return len(bc.Blocks) > 0 && bc.Blocks[0].ID > 0
+}
@@ -0,0 +1,107 @@
+package blockchain
+
+import (
+	"coins/pkg/model"
+	"testing"
+)
+
+// growChain appends the amount of blocks to the chain, in each of them alice pays bob
+func growChain(t *testing.T, bc *BlockChain, count int) {
+	t.Helper()
+	for i := 0; i < count; i++ {
+		tx := testTransaction(t, bc.Chainstate.Wallets["alice"].TXC+1, "alice", "bob", 0.01)
+		block := nextBlock(t, bc, "alice", nil, []model.Transaction{tx})
+		if res := bc.ValidateBlock(block); res != B_ACCEPT {
+			t.Fatalf("block %v rejected with reason=%v", block.ID, res)
+		}
+		bc.ProcessBlock(block)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		name   string
+		blocks int    // amount of blocks the chain grows by before pruning
+		keep   uint64 // amount of blocks to keep
+		first  uint64 // id of the first block after pruning
+	}{
+		{name: "within the batch", blocks: 20, keep: 10},
+		{name: "exactly one batch past the kept blocks", blocks: PruneBatch + 8, keep: 10},
+		{name: "past the batch", blocks: PruneBatch + 20, keep: 10, first: PruneBatch + 12},
+		{name: "keep more than the chain holds", blocks: 20, keep: 100},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bc := testChain(t)
+			growChain(t, bc, test.blocks)
+			head := bc.Chainstate.LastBlock
+			state := bc.Chainstate.StateRoot()
+			history := bc.Addresses.Count("bob")
+			bc.Prune(test.keep)
+			if bc.Blocks[0].ID != test.first {
+				t.Fatalf("pruned chain starts at %v instead of %v", bc.Blocks[0].ID, test.first)
+			}
+			if bc.Pruned() != (test.first > 0) {
+				t.Fatalf("pruned chain reports pruned=%v", bc.Pruned())
+			}
+			// The chainstate does not depend on the dropped blocks
+			if bc.Chainstate.LastBlock.Hash != head.Hash || bc.Chainstate.StateRoot() != state {
+				t.Fatal("pruning changed the chainstate")
+			}
+			if bc.GetBlock(head.ID) == nil {
+				t.Fatal("head block was pruned")
+			}
+			if test.first > 0 && bc.GetBlock(test.first-1) != nil {
+				t.Fatalf("block %v is still stored", test.first-1)
+			}
+			// Only the kept blocks are indexed
+			kept := 0
+			for _, block := range bc.Blocks {
+				kept += len(block.Transactions)
+			}
+			if count := bc.Addresses.Count("bob"); count != kept || (test.first == 0 && count != history) {
+				t.Fatalf("history of bob holds %v instead of %v transactions", count, kept)
+			}
+			for _, block := range bc.Blocks {
+				for _, tx := range block.Transactions {
+					if _, ok := bc.FindTransaction(tx.Hash); !ok {
+						t.Fatalf("transaction of kept block %v is not indexed", block.ID)
+					}
+				}
+			}
+			if _, ok := bc.HeightOf(bc.Blocks[0].Hash); !ok {
+				t.Fatal("first kept block is not indexed")
+			}
+			// The pruned chain keeps accepting blocks
+			growChain(t, bc, 1)
+		})
+	}
+}
+
+func TestAddressIndexRemoveOldest(t *testing.T) {
+	ai := NewAddressIndex()
+	blocks := []*model.Block{}
+	for id := uint64(1); id <= 4; id++ {
+		block := &model.Block{ID: id, Transactions: []model.Transaction{{Sender: "alice", Recipient: "bob"}, {Sender: "alice", Recipient: "carol"}}}
+		blocks = append(blocks, block)
+		ai.Add(block)
+	}
+	before := ai.refs["alice"]
+	ai.RemoveOldest(blocks[0])
+	after := ai.refs["alice"]
+	if len(after) != 6 || after[0].Block != 2 || after[5].Block != 4 {
+		t.Fatalf("unexpected references %+v after removing the oldest block", after)
+	}
+	// The kept references live in their own array, so the dropped ones can be garbage collected
+	if &after[0] == &before[2] {
+		t.Fatal("kept references still share the array of the dropped ones")
+	}
+	for _, block := range blocks[1:] {
+		ai.RemoveOldest(block)
+	}
+	for _, addr := range []string{"alice", "bob", "carol"} {
+		if _, ok := ai.refs[addr]; ok {
+			t.Fatalf("references of %v are kept after removing every block", addr)
+		}
+	}
+}
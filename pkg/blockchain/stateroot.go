@@ -0,0 +1,89 @@
+package blockchain
+
+import (
+	"coins/pkg/crypto"
+	"coins/pkg/model"
+	"encoding/hex"
+	"fmt"
+	"sort"
+)
+
+// AccountProof proves the state of a single wallet against the state root of a block
+type AccountProof struct {
+	Address   string
+	Wallet    WalletInfo
+	Block     uint64              // ID of the block whose state root the proof is for
+	StateRoot string              // The state root the proof is for
+	Proof     []crypto.MerkleStep // Path of siblings from the wallet leaf to the root
+}
+
+func walletLeaf(addr string, info *WalletInfo) []byte {
+	return crypto.MerkleLeaf([]byte(fmt.Sprintf("%v|%v|%v|%v", addr, info.Amount, info.TXC, info.PublicKey)))
+}
+
+// stateLeaves returns the sorted wallet addresses and their leaves, wallets in overrides replace those in wallets
+func stateLeaves(wallets map[string]*WalletInfo, overrides map[string]*WalletInfo) ([]string, [][]byte) {
+	addrs := make([]string, 0, len(wallets)+len(overrides))
+	for addr := range wallets {
+		if _, ok := overrides[addr]; !ok {
+			addrs = append(addrs, addr)
+		}
+	}
+	for addr := range overrides {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+	leaves := make([][]byte, len(addrs))
+	for i, addr := range addrs {
+		info, ok := overrides[addr]
+		if !ok {
+			info = wallets[addr]
+		}
+		leaves[i] = walletLeaf(addr, info)
+	}
+	return addrs, leaves
+}
+
+func stateRoot(wallets map[string]*WalletInfo, overrides map[string]*WalletInfo) string {
+	_, leaves := stateLeaves(wallets, overrides)
+	return hex.EncodeToString(crypto.MerkleRoot(leaves))
+}
+
+// StateRoot computes the merkle root over all wallets, sorted by address
+func (cs *Chainstate) StateRoot() string {
+	return stateRoot(cs.Wallets, nil)
+}
+
+// StateRootAfter computes the state root the chain would have after processing the block
+func (bc *BlockChain) StateRootAfter(b model.Block) (string, BLOCK_VALIDATION_RESULT) {
+	wallets, res := bc.simulate(b)
+	if res != B_ACCEPT {
+		return "", res
+	}
+	return stateRoot(bc.Chainstate.Wallets, wallets), B_ACCEPT
+}
+
+// ProveAccount builds a proof for the wallet against the state root of the last block
+func (bc *BlockChain) ProveAccount(addr string) (*AccountProof, error) {
+	info := bc.Chainstate.Wallets[addr]
+	if info == nil {
+		return nil, fmt.Errorf("wallet %v is not registered", addr)
+	}
+	addrs, leaves := stateLeaves(bc.Chainstate.Wallets, nil)
+	idx := sort.SearchStrings(addrs, addr)
+	return &AccountProof{
+		Address:   addr,
+		Wallet:    *info,
+		Block:     bc.Chainstate.LastBlock.ID,
+		StateRoot: bc.Chainstate.LastBlock.StateRoot,
+		Proof:     crypto.MerkleProof(leaves, idx),
+	}, nil
+}
+
+// VerifyAccountProof checks the proof against a state root taken from a trusted block header
+func VerifyAccountProof(proof *AccountProof, stateRoot string) bool {
+	if proof.StateRoot != stateRoot {
+		return false
+	}
+	return crypto.VerifyMerkleProof(walletLeaf(proof.Address, &proof.Wallet), proof.Proof, crypto.ToBytes(stateRoot))
+}
@@ -0,0 +1,110 @@
+package blockchain
+
+import (
+	"coins/pkg/model"
+	"testing"
+)
+
+func TestStateRoot(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cs *Chainstate)
+		same   bool // whether the root stays the same
+	}{
+		{name: "nothing", change: func(cs *Chainstate) {}, same: true},
+		{name: "market volume", change: func(cs *Chainstate) { cs.MarketVolume++ }, same: true},
+		{name: "amount", change: func(cs *Chainstate) { cs.Wallets["bob"].Amount++ }},
+		{name: "transaction counter", change: func(cs *Chainstate) { cs.Wallets["bob"].TXC++ }},
+		{name: "public key", change: func(cs *Chainstate) { cs.Wallets["bob"].PublicKey = "key" }},
+		{name: "new wallet", change: func(cs *Chainstate) { cs.Wallets["dave"] = &WalletInfo{} }},
+		{name: "removed wallet", change: func(cs *Chainstate) { delete(cs.Wallets, "carol") }},
+		{
+			name: "wallets swapped between addresses",
+			change: func(cs *Chainstate) {
+				cs.Wallets["alice"], cs.Wallets["bob"] = cs.Wallets["bob"], cs.Wallets["alice"]
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bc := testChain(t)
+			root := bc.Chainstate.StateRoot()
+			test.change(&bc.Chainstate)
+			if same := bc.Chainstate.StateRoot() == root; same != test.same {
+				t.Fatalf("state root unchanged=%v instead of %v", same, test.same)
+			}
+		})
+	}
+}
+
+func TestStateRootAfter(t *testing.T) {
+	tests := []struct {
+		name  string
+		miner string
+		rxs   []model.Registration
+		txs   []model.Transaction
+		want  BLOCK_VALIDATION_RESULT
+	}{
+		{name: "reward only", miner: "bob", want: B_ACCEPT},
+		{name: "registration", miner: "bob", rxs: []model.Registration{testRegistration(t, "dave")}, want: B_ACCEPT},
+		{name: "transfers", miner: "carol", txs: []model.Transaction{testTransaction(t, 1, "alice", "bob", 1), testTransaction(t, 1, "bob", "carol", 0.5)}, want: B_ACCEPT},
+		{name: "invalid transfer", miner: "carol", txs: []model.Transaction{testTransaction(t, 2, "alice", "bob", 1)}, want: B_REJECT_TX_INVALID},
+		{name: "miner without a wallet", miner: "erin", want: B_REJECT_BLOCK_INVALID},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bc := testChain(t)
+			before := bc.Chainstate.StateRoot()
+			block := model.Block{ID: 2, Previous: bc.Chainstate.LastBlock.Hash, Miner: test.miner, Registrations: test.rxs, Transactions: test.txs}
+			root, res := bc.StateRootAfter(block)
+			if res != test.want {
+				t.Fatalf("state root computed with reason=%v instead of %v", res, test.want)
+			}
+			// Computing the root leaves the chainstate untouched
+			if bc.Chainstate.StateRoot() != before {
+				t.Fatal("computing the state root changed the chainstate")
+			}
+			if res != B_ACCEPT {
+				return
+			}
+			bc.ProcessBlock(block)
+			if processed := bc.Chainstate.StateRoot(); processed != root {
+				t.Fatalf("state root after processing is %v instead of %v", processed, root)
+			}
+		})
+	}
+}
+
+func TestProveAccount(t *testing.T) {
+	bc := testChain(t)
+	root := bc.Chainstate.LastBlock.StateRoot
+	tests := []struct {
+		name   string
+		addr   string
+		tamper func(proof *AccountProof)
+		root   string
+		valid  bool
+	}{
+		{name: "valid proof", addr: "bob", tamper: func(proof *AccountProof) {}, root: root, valid: true},
+		{name: "proof of another wallet", addr: "carol", tamper: func(proof *AccountProof) {}, root: root, valid: true},
+		{name: "forged amount", addr: "bob", tamper: func(proof *AccountProof) { proof.Wallet.Amount = 100 }, root: root},
+		{name: "other address", addr: "bob", tamper: func(proof *AccountProof) { proof.Address = "alice" }, root: root},
+		{name: "other state root", addr: "bob", tamper: func(proof *AccountProof) {}, root: Genesis().StateRoot},
+		{name: "root of the proof replaced", addr: "bob", tamper: func(proof *AccountProof) { proof.StateRoot = "" }, root: root},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			proof, err := bc.ProveAccount(test.addr)
+			if err != nil {
+				t.Fatalf("could not prove account with error %v", err)
+			}
+			test.tamper(proof)
+			if valid := VerifyAccountProof(proof, test.root); valid != test.valid {
+				t.Fatalf("proof verified=%v instead of %v", valid, test.valid)
+			}
+		})
+	}
+	if _, err := bc.ProveAccount("dave"); err == nil {
+		t.Fatal("proved the account of an unregistered wallet")
+	}
+}
@@ -0,0 +1,113 @@
+package blockchain
+
+import (
+	"coins/pkg/model"
+	"container/heap"
+	"encoding/json"
+	"sort"
+)
+
+// Template is the body of the next block, selected from floating transactions and registrations
+type Template struct {
+	Transactions  []model.Transaction
+	Registrations []model.Registration
+	StateRoot     string               // The state root after the block
+	StaleTx       []model.Transaction  // Transactions whose id was already used, they can never be included
+	StaleRx       []model.Registration // Registrations of wallets that are already registered
+}
+
+// BuildTemplate selects the floating entries that form a valid block on top of our head, without exceeding
+// maxBytes of serialized transactions and registrations. Registrations come first in the order they are given.
+// Transactions carry no fee, so the ones moving the most coins go first, while the transactions of each sender
+// stay in the order of their ids. Entries that do not apply yet are left out, entries that never will are
+// reported as stale. It fails if the miner has no wallet and does not register one
+func (bc *BlockChain) BuildTemplate(miner string, txs []model.Transaction, rxs []model.Registration, maxBytes int) (Template, BLOCK_VALIDATION_RESULT) {
+	template := Template{}
+	view := bc.newStateView()
+	size := 0
+	for _, rx := range rxs {
+		if bc.Chainstate.Wallets[rx.Wallet] != nil {
+			template.StaleRx = append(template.StaleRx, rx)
+			continue
+		}
+		// Duplicates and empty wallets fail to register
+		bytes := entrySize(rx)
+		if size+bytes > maxBytes || !view.register(rx) {
+			continue
+		}
+		template.Registrations = append(template.Registrations, rx)
+		size += bytes
+	}
+	if !view.reward(miner) {
+		return Template{}, B_REJECT_BLOCK_INVALID
+	}
+	// Queue the transactions of each sender by id, dropping the ids that were already used
+	queues := make(map[string][]model.Transaction)
+	for _, tx := range txs {
+		if sender := bc.Chainstate.Wallets[tx.Sender]; sender != nil && tx.TXID <= sender.TXC {
+			template.StaleTx = append(template.StaleTx, tx)
+			continue
+		}
+		queues[tx.Sender] = append(queues[tx.Sender], tx)
+	}
+	pending := &txQueue{}
+	for _, queue := range queues {
+		sort.SliceStable(queue, func(i, j int) bool { return queue[i].TXID < queue[j].TXID })
+		*pending = append(*pending, queue)
+	}
+	heap.Init(pending)
+	// Take the best next transaction of any sender until none applies anymore
+	for pending.Len() > 0 {
+		queue := heap.Pop(pending).([]model.Transaction)
+		tx := queue[0]
+		bytes := entrySize(tx)
+		// A sender whose next transaction does not apply cannot send the later ones either
+		if size+bytes > maxBytes || !view.transfer(tx) {
+			continue
+		}
+		template.Transactions = append(template.Transactions, tx)
+		size += bytes
+		if len(queue) > 1 {
+			heap.Push(pending, queue[1:])
+		}
+	}
+	template.StateRoot = stateRoot(bc.Chainstate.Wallets, view.wallets)
+	return template, B_ACCEPT
+}
+
+// entrySize returns how many bytes the entry adds to a serialized block
+func entrySize(entry interface{}) int {
+	bin, err := json.Marshal(entry)
+	if err != nil {
+		return 0
+	}
+	// Account for the separator in the list
+	return len(bin) + 1
+}
+
+// txQueue orders the transaction queues of the senders by their next transaction, the largest amount first
+type txQueue [][]model.Transaction
+
+func (q txQueue) Len() int { return len(q) }
+
+func (q txQueue) Less(i, j int) bool {
+	a, b := q[i][0], q[j][0]
+	if a.Amount != b.Amount {
+		return a.Amount > b.Amount
+	}
+	return a.Hash < b.Hash
+}
+
+func (q txQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *txQueue) Push(x interface{}) {
+	*q = append(*q, x.([]model.Transaction))
+}
+
+func (q *txQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	item := old[n-1]
+	*q = old[:n-1]
+	return item
+}
@@ -0,0 +1,165 @@
+package blockchain
+
+import (
+	"coins/pkg/model"
+	"math"
+	"testing"
+)
+
+// hashes returns the hashes of the transactions in their order
+func hashes(txs []model.Transaction) []string {
+	list := []string{}
+	for _, tx := range txs {
+		list = append(list, tx.Hash)
+	}
+	return list
+}
+
+// wallets returns the wallets of the registrations in their order
+func wallets(rxs []model.Registration) []string {
+	list := []string{}
+	for _, rx := range rxs {
+		list = append(list, rx.Wallet)
+	}
+	return list
+}
+
+func sameList(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestBuildTemplate(t *testing.T) {
+	// Alice already used her first id, bob owns a reward to spend
+	bc := testChain(t)
+	a1 := testTransaction(t, 1, "alice", "carol", 0.1)
+	block := nextBlock(t, bc, "bob", nil, []model.Transaction{a1})
+	if res := bc.ValidateBlock(block); res != B_ACCEPT {
+		t.Fatalf("block rejected with reason=%v", res)
+	}
+	bc.ProcessBlock(block)
+	a2 := testTransaction(t, 2, "alice", "bob", 0.2)
+	a3 := testTransaction(t, 3, "alice", "bob", 0.5)
+	a4 := testTransaction(t, 4, "alice", "bob", 0.1)
+	overdrawn := testTransaction(t, 2, "alice", "bob", 5)
+	b1 := testTransaction(t, 1, "bob", "carol", 0.3)
+	bob := testRegistration(t, "bob")
+	dave := testRegistration(t, "dave")
+	tests := []struct {
+		name     string
+		miner    string
+		rxs      []model.Registration
+		txs      []model.Transaction
+		maxBytes int
+		want     BLOCK_VALIDATION_RESULT // B_ACCEPT if empty
+		wantRx   []model.Registration
+		wantTx   []model.Transaction
+		staleRx  []model.Registration
+		staleTx  []model.Transaction
+	}{
+		{
+			name:   "transactions of a sender in the order of their ids",
+			txs:    []model.Transaction{a3, a4, a2},
+			wantTx: []model.Transaction{a2, a3, a4},
+		},
+		{
+			name:   "largest amount first among the senders",
+			txs:    []model.Transaction{a2, a3, b1},
+			wantTx: []model.Transaction{b1, a2, a3},
+		},
+		{
+			// The queue of alice does not move past the overdrawn transaction, even though a2 shares its id
+			name:   "sender skipped after a transaction that does not apply",
+			txs:    []model.Transaction{overdrawn, a2, a3, b1},
+			wantTx: []model.Transaction{b1},
+		},
+		{
+			name:   "missing id",
+			txs:    []model.Transaction{a3, a4, b1},
+			wantTx: []model.Transaction{b1},
+		},
+		{
+			name:    "stale entries",
+			rxs:     []model.Registration{bob, dave},
+			txs:     []model.Transaction{a1, a2},
+			wantRx:  []model.Registration{dave},
+			wantTx:  []model.Transaction{a2},
+			staleRx: []model.Registration{bob},
+			staleTx: []model.Transaction{a1},
+		},
+		{
+			name:     "transactions beyond the size limit",
+			txs:      []model.Transaction{a2, b1},
+			maxBytes: entrySize(b1),
+			wantTx:   []model.Transaction{b1},
+		},
+		{
+			name:     "registrations count towards the size limit",
+			rxs:      []model.Registration{dave},
+			txs:      []model.Transaction{b1},
+			maxBytes: entrySize(dave),
+			wantRx:   []model.Registration{dave},
+		},
+		{
+			name:   "miner registering its wallet",
+			miner:  "dave",
+			rxs:    []model.Registration{dave},
+			wantRx: []model.Registration{dave},
+		},
+		{
+			name:  "miner without a wallet",
+			miner: "dave",
+			want:  B_REJECT_BLOCK_INVALID,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			miner := test.miner
+			if miner == "" {
+				miner = "carol"
+			}
+			maxBytes := test.maxBytes
+			if maxBytes == 0 {
+				maxBytes = math.MaxInt32
+			}
+			want := test.want
+			if want == "" {
+				want = B_ACCEPT
+			}
+			template, res := bc.BuildTemplate(miner, test.txs, test.rxs, maxBytes)
+			if res != want {
+				t.Fatalf("template built with reason=%v instead of %v", res, want)
+			}
+			if res != B_ACCEPT {
+				return
+			}
+			if !sameList(wallets(template.Registrations), wallets(test.wantRx)) {
+				t.Fatalf("registrations %v instead of %v", wallets(template.Registrations), wallets(test.wantRx))
+			}
+			if !sameList(hashes(template.Transactions), hashes(test.wantTx)) {
+				t.Fatalf("transactions %v instead of %v", hashes(template.Transactions), hashes(test.wantTx))
+			}
+			if !sameList(wallets(template.StaleRx), wallets(test.staleRx)) {
+				t.Fatalf("stale registrations %v instead of %v", wallets(template.StaleRx), wallets(test.staleRx))
+			}
+			if !sameList(hashes(template.StaleTx), hashes(test.staleTx)) {
+				t.Fatalf("stale transactions %v instead of %v", hashes(template.StaleTx), hashes(test.staleTx))
+			}
+			// The template forms a valid block with the state root it reports
+			block := nextBlock(t, bc, miner, template.Registrations, template.Transactions)
+			if block.StateRoot != template.StateRoot {
+				t.Fatalf("template state root %v instead of %v", template.StateRoot, block.StateRoot)
+			}
+			if res := bc.ValidateBlock(block); res != B_ACCEPT {
+				t.Fatalf("block of the template rejected with reason=%v", res)
+			}
+		})
+	}
+}
@@ -0,0 +1,111 @@
+package blockchain
+
+import (
+	"coins/pkg/model"
+	"fmt"
+)
+
+// MaxUndoDepth is the amount of recent blocks we keep undo data for, which bounds how deep a cheap rollback can go
+const MaxUndoDepth = 100
+
+// BlockUndo holds everything needed to revert the chainstate changes of a single block
+type BlockUndo struct {
+	Wallets           map[string]*WalletInfo // The wallets touched by the block before processing, nil if they did not exist
+	MarketVolume      float64
+	TransactionVolume uint64
+}
+
+// newUndo captures the current state of every wallet the block is going to touch
+func (bc *BlockChain) newUndo(b model.Block) *BlockUndo {
+	undo := &BlockUndo{
+		Wallets:           make(map[string]*WalletInfo),
+		MarketVolume:      bc.Chainstate.MarketVolume,
+		TransactionVolume: bc.Chainstate.TransactionVolume,
+	}
+	capture := func(addr string) {
+		if _, ok := undo.Wallets[addr]; ok {
+			return
+		}
+		if info := bc.Chainstate.Wallets[addr]; info != nil {
+			alloc := *info
+			undo.Wallets[addr] = &alloc
+		} else {
+			undo.Wallets[addr] = nil
+		}
+	}
+	for _, reg := range b.Registrations {
+		capture(reg.Wallet)
+	}
+	capture(b.Miner)
+	for _, tx := range b.Transactions {
+		capture(tx.Sender)
+		capture(tx.Recipient)
+	}
+	return undo
+}
+
+// Rollback disconnects blocks from the head until the block with the specified id is the last block
+func (bc *BlockChain) Rollback(id uint64) error {
+	for bc.Chainstate.LastBlock.ID > id {
+		// Without undo data we have to replay the chain from the start
+		if bc.Undo[bc.Chainstate.LastBlock.ID] == nil {
+			return bc.rollbackByReplay(id)
+		}
+		err := bc.disconnectBlock()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CanUndo reports whether undo data exists for every block after the block with the specified id, so Rollback
+// to it never has to replay the chain
+func (bc *BlockChain) CanUndo(id uint64) bool {
+	for height := id + 1; height <= bc.Chainstate.LastBlock.ID; height++ {
+		if bc.Undo[height] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// disconnectBlock reverts the head block using its undo data
+func (bc *BlockChain) disconnectBlock() error {
+	if len(bc.Blocks) < 2 {
+		return fmt.Errorf("cannot disconnect the first stored block %v", bc.Chainstate.LastBlock.ID)
+	}
+	head := bc.Blocks[len(bc.Blocks)-1]
+	undo := bc.Undo[head.ID]
+	// Restore the touched wallets
+	for addr, info := range undo.Wallets {
+		if info == nil {
+			delete(bc.Chainstate.Wallets, addr)
+			continue
+		}
+		alloc := *info
+		bc.Chainstate.Wallets[addr] = &alloc
+	}
+	bc.Chainstate.MarketVolume = undo.MarketVolume
+	bc.Chainstate.TransactionVolume = undo.TransactionVolume
+	// Remove the block from the indexes
+	bc.unindex(head)
+	delete(bc.Undo, head.ID)
+	// Drop the block and move the head back
+	bc.Blocks = bc.Blocks[:len(bc.Blocks)-1]
+	bc.Chainstate.LastBlock = *bc.Blocks[len(bc.Blocks)-1]
+	return nil
+}
+
+// rollbackByReplay truncates the chain and rebuilds the chainstate from the first block
+func (bc *BlockChain) rollbackByReplay(id uint64) error {
+	if len(bc.Blocks) == 0 || bc.Blocks[0].ID != 0 {
+		return fmt.Errorf("cannot replay chain to block %v without full history", id)
+	}
+	if id >= uint64(len(bc.Blocks)) {
+		return fmt.Errorf("cannot roll back to unknown block %v", id)
+	}
+	bc.Blocks = bc.Blocks[:id+1]
+	bc.ProcessAll()
+	return nil
+}
@@ -2,6 +2,7 @@ package blockchain
 
 import (
 	"coins/pkg/crypto"
+	"coins/pkg/fsutil"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/base64"
@@ -22,7 +23,7 @@ func KeyToString(pub *rsa.PublicKey) (string, error) {
 
 func StringToKey(addr string) (*rsa.PublicKey, error) {
 	// Base64 decode the address
-	decoded, err := base64.StdEncoding.DecodeString(addr)
+	decoded, err := crypto.DecodeB64(addr)
 	if err != nil {
 		return nil, fmt.Errorf("could not decode public key with error %v", err)
 	}
@@ -35,7 +36,8 @@ func StringToKey(addr string) (*rsa.PublicKey, error) {
 	return &pub, nil
 }
 
-func GenerateWalletFile() (*Wallet, error) {
+// NewWallet generates a wallet without writing it anywhere
+func NewWallet() (*Wallet, error) {
 	// Declare a new wallet
 	wallet := Wallet{}
 	// Generate a 2048 Bit RSA Keypair
@@ -47,17 +49,25 @@ func GenerateWalletFile() (*Wallet, error) {
 	wallet.KP = privateKey
 	// Generate a wallet address
 	wallet.Address = crypto.RandomString(32)
+	return &wallet, nil
+}
+
+func GenerateWalletFile() (*Wallet, error) {
+	wallet, err := NewWallet()
+	if err != nil {
+		return nil, err
+	}
 	// Serialize the Wallet to json
 	bin, err := json.Marshal(wallet)
 	if err != nil {
 		return nil, fmt.Errorf("could not serialize wallet with error %v", err)
 	}
 	// Write the Wallet to a file
-	err = ioutil.WriteFile("wallet.json", bin, 0644)
+	err = fsutil.WriteFileAtomic("wallet.json", bin, 0600)
 	if err != nil {
 		return nil, fmt.Errorf("could not write wallet to file with error %v", err)
 	}
-	return &wallet, nil
+	return wallet, nil
 }
 
 func ReadWalletFile() (*Wallet, error) {
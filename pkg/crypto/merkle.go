@@ -0,0 +1,85 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+// Leaf and inner nodes are hashed with different prefixes, so an inner node can never be passed off as a leaf
+const merkleLeafPrefix = byte(0)
+const merkleNodePrefix = byte(1)
+
+type MerkleStep struct {
+	Hash []byte // Hash of the sibling node
+	Left bool   // Whether the sibling is the left child
+}
+
+func MerkleLeaf(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func merkleNode(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleNodePrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// nextLevel hashes the nodes of a level pairwise, an odd node at the end is promoted unchanged
+func nextLevel(level [][]byte) [][]byte {
+	next := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			next = append(next, level[i])
+			continue
+		}
+		next = append(next, merkleNode(level[i], level[i+1]))
+	}
+	return next
+}
+
+// MerkleRoot computes the root over the leaf hashes
+func MerkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		return MerkleLeaf(nil)
+	}
+	level := leaves
+	for len(level) > 1 {
+		level = nextLevel(level)
+	}
+	return level[0]
+}
+
+// MerkleProof returns the path of siblings from the leaf at the index up to the root
+func MerkleProof(leaves [][]byte, index int) []MerkleStep {
+	proof := []MerkleStep{}
+	level := leaves
+	for len(level) > 1 {
+		// Record the sibling, promoted nodes have none
+		if index%2 == 1 {
+			proof = append(proof, MerkleStep{Hash: level[index-1], Left: true})
+		} else if index+1 < len(level) {
+			proof = append(proof, MerkleStep{Hash: level[index+1], Left: false})
+		}
+		level = nextLevel(level)
+		index /= 2
+	}
+	return proof
+}
+
+// VerifyMerkleProof checks that the leaf hash is part of the tree with the root
+func VerifyMerkleProof(leaf []byte, proof []MerkleStep, root []byte) bool {
+	hash := leaf
+	for _, step := range proof {
+		if step.Left {
+			hash = merkleNode(step.Hash, hash)
+		} else {
+			hash = merkleNode(hash, step.Hash)
+		}
+	}
+	return bytes.Equal(hash, root)
+}
@@ -0,0 +1,72 @@
+package crypto
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+// testLeaves returns the amount of distinct leaf hashes
+func testLeaves(count int) [][]byte {
+	leaves := make([][]byte, count)
+	for i := range leaves {
+		leaves[i] = MerkleLeaf([]byte(fmt.Sprintf("leaf %v", i)))
+	}
+	return leaves
+}
+
+func TestMerkleRoot(t *testing.T) {
+	l := testLeaves(5)
+	tests := []struct {
+		name   string
+		leaves [][]byte
+		want   []byte
+	}{
+		{name: "no leaves", leaves: nil, want: MerkleLeaf(nil)},
+		{name: "one leaf", leaves: l[:1], want: l[0]},
+		{name: "two leaves", leaves: l[:2], want: merkleNode(l[0], l[1])},
+		{name: "odd leaf is promoted", leaves: l[:3], want: merkleNode(merkleNode(l[0], l[1]), l[2])},
+		{name: "four leaves", leaves: l[:4], want: merkleNode(merkleNode(l[0], l[1]), merkleNode(l[2], l[3]))},
+		{name: "odd node is promoted", leaves: l[:5], want: merkleNode(merkleNode(merkleNode(l[0], l[1]), merkleNode(l[2], l[3])), l[4])},
+		{name: "order matters", leaves: [][]byte{l[1], l[0]}, want: merkleNode(l[1], l[0])},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if root := MerkleRoot(test.leaves); !bytes.Equal(root, test.want) {
+				t.Fatalf("root is %x instead of %x", root, test.want)
+			}
+		})
+	}
+	// The prefixes keep a leaf over two hashes apart from the inner node over them
+	if bytes.Equal(MerkleLeaf(append(append([]byte{}, l[0]...), l[1]...)), merkleNode(l[0], l[1])) {
+		t.Fatal("leaf and inner node over the same hashes are equal")
+	}
+}
+
+func TestMerkleProof(t *testing.T) {
+	for count := 1; count <= 9; count++ {
+		leaves := testLeaves(count)
+		root := MerkleRoot(leaves)
+		for index := range leaves {
+			proof := MerkleProof(leaves, index)
+			if !VerifyMerkleProof(leaves[index], proof, root) {
+				t.Fatalf("proof of leaf %v of %v does not verify", index, count)
+			}
+			other := leaves[(index+1)%count]
+			if count > 1 && VerifyMerkleProof(other, proof, root) {
+				t.Fatalf("proof of leaf %v of %v verifies another leaf", index, count)
+			}
+			if VerifyMerkleProof(leaves[index], proof, MerkleLeaf([]byte("other root"))) {
+				t.Fatalf("proof of leaf %v of %v verifies against another root", index, count)
+			}
+			// Swapping the sides of a step changes the path
+			for i := range proof {
+				swapped := append([]MerkleStep{}, proof...)
+				swapped[i].Left = !swapped[i].Left
+				if VerifyMerkleProof(leaves[index], swapped, root) {
+					t.Fatalf("proof of leaf %v of %v verifies with step %v on the wrong side", index, count, i)
+				}
+			}
+		}
+	}
+}
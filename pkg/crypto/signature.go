@@ -24,6 +24,16 @@ func SignHashB64(hash []byte, kp *rsa.PrivateKey) (string, error) {
 	return base64.URLEncoding.EncodeToString(signature), nil
 }
 
+// DecodeB64 decodes a key or signature. Values are encoded url-safe, older clients used the standard alphabet.
+// A value containing '+' or '/' is not url-safe, so no value decodes differently under the two alphabets
+func DecodeB64(value string) ([]byte, error) {
+	decoded, err := base64.URLEncoding.DecodeString(value)
+	if err == nil {
+		return decoded, nil
+	}
+	return base64.StdEncoding.DecodeString(value)
+}
+
 func VerifySignature(signature []byte, hash []byte, publicKey *rsa.PublicKey) bool {
 	return rsa.VerifyPSS(publicKey, crypto.SHA256, hash, signature, nil) == nil
 }
@@ -0,0 +1,37 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestDecodeB64(t *testing.T) {
+	// 0xfb 0xff encodes to characters that differ between the two alphabets
+	value := []byte{0xfb, 0xff, 0x00, 0x01}
+	tests := []struct {
+		name    string
+		encoded string
+		want    []byte
+		fails   bool
+	}{
+		{name: "url-safe", encoded: base64.URLEncoding.EncodeToString(value), want: value},
+		{name: "standard", encoded: base64.StdEncoding.EncodeToString(value), want: value},
+		{name: "both alphabets", encoded: base64.URLEncoding.EncodeToString([]byte("abc")), want: []byte("abc")},
+		{name: "invalid", encoded: "not base64!", fails: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := DecodeB64(test.encoded)
+			if test.fails {
+				if err == nil {
+					t.Fatalf("decoding %q succeeded", test.encoded)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(got, test.want) {
+				t.Fatalf("decoding %q returned %v with error %v", test.encoded, got, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,58 @@
+package fsutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// WriteFileAtomic replaces the file with the data so that readers see either the old or the new content, even after a crash
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	// Write the data to a temporary file next to the target
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("could not create temporary file with error %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not write temporary file with error %v", err)
+	}
+	// Make sure the data is on disk before it becomes visible
+	err = tmp.Sync()
+	if err != nil {
+		tmp.Close()
+		return fmt.Errorf("could not sync temporary file with error %v", err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return fmt.Errorf("could not close temporary file with error %v", err)
+	}
+	err = os.Chmod(tmp.Name(), perm)
+	if err != nil {
+		return fmt.Errorf("could not set permissions with error %v", err)
+	}
+	// Swap the files
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return fmt.Errorf("could not replace file with error %v", err)
+	}
+	return SyncDir(dir)
+}
+
+// SyncDir flushes the directory entries, which makes renames and new files durable
+func SyncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("could not open directory with error %v", err)
+	}
+	defer d.Close()
+	err = d.Sync()
+	if err != nil {
+		return fmt.Errorf("could not sync directory with error %v", err)
+	}
+	return nil
+}
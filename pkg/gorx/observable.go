@@ -12,6 +12,10 @@ type Subscription struct {
 	cb         func(v interface{})
 }
 
+func NewObservable() *Observable {
+	return &Observable{mutex: &sync.Mutex{}, subscriptions: make([]*Subscription, 0)}
+}
+
 func (o *Observable) Subscribe(cb func(v interface{})) *Subscription {
 	// Make sure to acquire the observable lock
 	o.mutex.Lock()
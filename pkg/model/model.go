@@ -2,18 +2,23 @@ package model
 
 import (
 	"coins/pkg/crypto"
+	"context"
 	"crypto/rsa"
 	"crypto/sha256"
-	"encoding/base64"
 	"encoding/hex"
 	"fmt"
+	"math"
 	"math/rand"
+	"sync"
+	"sync/atomic"
 )
 
 const BlockReward = float64(1)
 const BlockDiff = byte(1)
 const EmptyBlockDiff = byte(2)
-const MinerThreads = 4
+
+// MINE_CHECK_INTERVAL is the amount of nonces a mining goroutine tries between looking whether it should stop
+const MINE_CHECK_INTERVAL = 1024
 
 type Block struct {
 	ID            uint64         // Autoincrement id of the block
@@ -21,45 +26,147 @@ type Block struct {
 	Hash          string         // Hash of this block
 	Previous      string         // The Hash of the Previous block
 	Miner         string         // The wallet address of the miner that received the block reward
+	TxRoot        string         // Merkle root over the transactions and registrations of this block
+	StateRoot     string         // Merkle root over all wallets after this block was processed
 	Transactions  []Transaction  // The Signed Transactions included in this block
 	Registrations []Registration // The Registrations that happened in this block
 }
 
-func (b *Block) Mine(stop *bool) {
-	var difficulty byte
-	if len(b.Registrations) > 0 || len(b.Transactions) > 0 {
-		difficulty = BlockDiff
-	} else {
-		difficulty = EmptyBlockDiff
+// BlockHeader holds the fields of a block covered by its hash, the body is committed through the TxRoot
+type BlockHeader struct {
+	ID        uint64
+	Nonce     uint64
+	Previous  string
+	Miner     string
+	TxRoot    string
+	StateRoot string
+}
+
+func (b *Block) Header() BlockHeader {
+	return BlockHeader{ID: b.ID, Nonce: b.Nonce, Previous: b.Previous, Miner: b.Miner, TxRoot: b.TxRoot, StateRoot: b.StateRoot}
+}
+
+// EmptyTxRoot is the TxRoot of a block without transactions and registrations
+var EmptyTxRoot = hex.EncodeToString(crypto.MerkleRoot(nil))
+
+// Hash computes the hash of the block the header belongs to
+func (h *BlockHeader) Hash() string {
+	return hex.EncodeToString(h.hash())
+}
+
+// HashAffixes returns the text hashed before and after the decimal nonce, so a miner can search nonces
+// without knowing how the header is formatted
+func (h *BlockHeader) HashAffixes() (string, string) {
+	prefix := fmt.Sprintf("{%v ", h.ID)
+	suffix := fmt.Sprintf(" %v %v %v %v}", h.Previous, h.Miner, h.TxRoot, h.StateRoot)
+	return prefix, suffix
+}
+
+func (h *BlockHeader) hash() []byte {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v", *h)))
+	return sum[:]
+}
+
+// Difficulty returns the difficulty the hash of the block has to meet, which can be told from the header alone
+func (h *BlockHeader) Difficulty() byte {
+	if h.TxRoot == EmptyTxRoot {
+		return EmptyBlockDiff
+	}
+	return BlockDiff
+}
+
+// ComputeTxRoot computes the merkle root over the body of the block
+func (b *Block) ComputeTxRoot() string {
+	leaves := make([][]byte, 0, len(b.Transactions)+len(b.Registrations))
+	for _, tx := range b.Transactions {
+		leaves = append(leaves, crypto.MerkleLeaf([]byte(fmt.Sprintf("tx%v", tx))))
 	}
-	signalChannel := make(chan uint64)
-	for i := 0; i < MinerThreads; i++ {
-		seed := uint64(rand.Uint32())<<32 + uint64(rand.Uint32())
-		go mine(difficulty, seed, *b, signalChannel, stop)
+	for _, rx := range b.Registrations {
+		leaves = append(leaves, crypto.MerkleLeaf([]byte(fmt.Sprintf("rx%v", rx))))
 	}
-	result := <-signalChannel
-	b.Nonce = result
-	b.Hash = b.GetHash()
-	*stop = true
+	return hex.EncodeToString(crypto.MerkleRoot(leaves))
 }
 
-func mine(difficulty byte, seed uint64, block Block, sigChan chan uint64, stop *bool) {
-	block.Nonce = seed
-	for {
-		if *stop || crypto.GetHashDiff(block.hashFast()) == difficulty {
-			break
+// Mine searches for a nonce meeting the difficulty of the block on the amount of goroutines until one is found
+// or the context is done. Each goroutine searches its own range of nonces, so no nonce is tried twice. The
+// hashes tried are added to the counter in batches if it is set. It returns whether the block was mined, all
+// search goroutines have returned by then
+func (b *Block) Mine(ctx context.Context, threads int, hashes *uint64) bool {
+	// Commit to the body before searching for a nonce
+	b.TxRoot = b.ComputeTxRoot()
+	header := b.Header()
+	difficulty := header.Difficulty()
+	if threads < 1 {
+		threads = 1
+	}
+	// The first nonce found stops the other goroutines
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan uint64, threads)
+	wg := &sync.WaitGroup{}
+	// Split the nonces into a range per goroutine, starting at a random offset so a block built again
+	// is not searched in the same order
+	span := math.MaxUint64 / uint64(threads)
+	base := rand.Uint64()
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func(start uint64) {
+			defer wg.Done()
+			mine(ctx, difficulty, *b, start, span, results, hashes)
+		}(base + uint64(i)*span)
+	}
+	exhausted := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(exhausted)
+	}()
+	select {
+	case nonce := <-results:
+		cancel()
+		<-exhausted
+		b.Nonce = nonce
+		b.Hash = b.GetHash()
+		return true
+	case <-exhausted:
+	case <-ctx.Done():
+		<-exhausted
+	}
+	// A goroutine may have found a nonce right before the search ended
+	select {
+	case nonce := <-results:
+		b.Nonce = nonce
+		b.Hash = b.GetHash()
+		return true
+	default:
+		return false
+	}
+}
+
+// mine tries the span of nonces starting at start
+func mine(ctx context.Context, difficulty byte, block Block, start uint64, span uint64, results chan uint64, hashes *uint64) {
+	block.Nonce = start
+	for tried := uint64(1); tried <= span; tried++ {
+		if crypto.GetHashDiff(block.hashFast()) == difficulty {
+			// The channel has room for every goroutine, so this never blocks
+			results <- block.Nonce
+			return
+		}
+		// Only count and look at the context now and then, both are slow compared to a hash
+		if tried%MINE_CHECK_INTERVAL == 0 {
+			if hashes != nil {
+				atomic.AddUint64(hashes, MINE_CHECK_INTERVAL)
+			}
+			if ctx.Err() != nil {
+				return
+			}
 		}
 		block.Nonce++
 	}
-	if !*stop {
-		sigChan <- block.Nonce
-	}
 }
 
 func (b *Block) hashFast() []byte {
-	h := sha256.New()
-	h.Write([]byte(fmt.Sprintf("%v", b)))
-	return h.Sum(nil)
+	header := b.Header()
+	return header.hash()
 }
 
 func (b *Block) GetHash() string {
@@ -71,6 +178,12 @@ type Registration struct {
 	PublicKey string // the Public key of the user registering
 }
 
+// GetHash identifies the registration by its wallet and key, the length prefix keeps the two fields apart
+func (rx *Registration) GetHash() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v:%v%v", len(rx.Wallet), rx.Wallet, rx.PublicKey)))
+	return hex.EncodeToString(sum[:])
+}
+
 type Transaction struct {
 	TXID      uint64  // Autoincrement id for transactions
 	Sender    string  // Wallet address of the sender
@@ -82,7 +195,7 @@ type Transaction struct {
 }
 
 func (tx *Transaction) Verify(publicKey *rsa.PublicKey) bool {
-	decodedSignature, err := base64.StdEncoding.DecodeString(tx.Signature)
+	decodedSignature, err := crypto.DecodeB64(tx.Signature)
 	if err != nil {
 		return false
 	}
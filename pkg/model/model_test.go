@@ -0,0 +1,88 @@
+package model
+
+import (
+	"coins/pkg/crypto"
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestMineFindsValidHash(t *testing.T) {
+	block := Block{ID: 1, Previous: "previous", Miner: "miner"}
+	if !block.Mine(context.Background(), 2, nil) {
+		t.Fatal("could not mine a block")
+	}
+	header := block.Header()
+	if block.Hash != block.GetHash() {
+		t.Fatal("mined block does not match its hash")
+	}
+	if crypto.GetHashDiff(crypto.ToBytes(block.Hash)) != header.Difficulty() {
+		t.Fatalf("mined hash %v does not meet difficulty %v", block.Hash, header.Difficulty())
+	}
+}
+
+// waitGoroutines waits until no more than the amount of goroutines are running
+func waitGoroutines(t *testing.T, count int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > count {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v goroutines are still running instead of %v", runtime.NumGoroutine(), count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMineCancelled(t *testing.T) {
+	tests := []struct {
+		name  string
+		delay time.Duration // how long the search runs before it is cancelled
+	}{
+		{name: "before searching"},
+		{name: "while searching", delay: time.Millisecond},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// A search may find a nonce before it notices the cancellation, some of the attempts have to stop
+			stopped := 0
+			for i := 0; i < 20; i++ {
+				goroutines := runtime.NumGoroutine()
+				ctx, cancel := context.WithCancel(context.Background())
+				if test.delay == 0 {
+					cancel()
+				} else {
+					time.AfterFunc(test.delay, cancel)
+				}
+				// Without a body the block needs the higher difficulty, which takes a while
+				block := Block{ID: 1, Previous: "previous", Miner: "miner"}
+				var hashes uint64
+				start := time.Now()
+				found := block.Mine(ctx, 4, &hashes)
+				cancel()
+				if elapsed := time.Since(start); elapsed > time.Second {
+					t.Fatalf("cancelled search returned after %v", elapsed)
+				}
+				// Every search goroutine returned with Mine
+				waitGoroutines(t, goroutines)
+				if found {
+					if block.Hash != block.GetHash() {
+						t.Fatal("block found before the cancellation does not match its hash")
+					}
+					continue
+				}
+				stopped++
+				if block.Hash != "" || block.Nonce != 0 {
+					t.Fatal("cancelled search changed the block")
+				}
+				// Each goroutine counts its hashes in batches, a search cancelled before it started stops after one
+				if test.delay == 0 && hashes > 4*MINE_CHECK_INTERVAL {
+					t.Fatalf("cancelled search counted %v hashes", hashes)
+				}
+			}
+			if stopped == 0 {
+				t.Fatal("every cancelled search found a block")
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package protocol
+
+import "fmt"
+
+// MAX_HEADERS is the most headers a single HEADERS message carries
+const MAX_HEADERS = 2000
+
+// MAX_LOCATOR is the most hashes a block locator may contain
+const MAX_LOCATOR = 100
+
+// MAX_ADDRS is the most addresses a single ADDR message carries
+const MAX_ADDRS = 1000
+
+// MAX_INV_ITEMS is the most items a single INV or GETDATA message carries
+const MAX_INV_ITEMS = 1000
+
+// MAX_BLOCK_SIZE is the largest serialized block a NEW_BLOCK message carries
+const MAX_BLOCK_SIZE = 256 << 10
+
+// maxPayloadSizes caps the payload of each message type, so a peer cannot make us buffer more than a message needs
+var maxPayloadSizes = map[MessageType]uint32{
+	NEW_BLOCK:   MAX_BLOCK_SIZE,
+	NEW_TX:      8 << 10,
+	INIT:        256,
+	INIT_BLOCKS: MAX_PAYLOAD_SIZE,
+	NEW_RX:      8 << 10,
+	VERSION:     1 << 10,
+	VERACK:      0,
+	GETADDR:     0,
+	ADDR:        64 << 10,
+	INV:         128 << 10,
+	GETDATA:     128 << 10,
+	GETHEADERS:  8 << 10,
+	HEADERS:     1 << 20,
+}
+
+// MaxPayloadSize returns the largest payload accepted for the message type, unknown types carry no payload
+func MaxPayloadSize(t MessageType) uint32 {
+	return maxPayloadSizes[t]
+}
+
+var messageTypeNames = map[MessageType]string{
+	NEW_BLOCK:   "NEW_BLOCK",
+	NEW_TX:      "NEW_TX",
+	INIT:        "INIT",
+	INIT_BLOCKS: "INIT_BLOCKS",
+	NEW_RX:      "NEW_RX",
+	VERSION:     "VERSION",
+	VERACK:      "VERACK",
+	GETADDR:     "GETADDR",
+	ADDR:        "ADDR",
+	INV:         "INV",
+	GETDATA:     "GETDATA",
+	GETHEADERS:  "GETHEADERS",
+	HEADERS:     "HEADERS",
+}
+
+func (t MessageType) String() string {
+	if name, ok := messageTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("UNKNOWN(%d)", byte(t))
+}
@@ -3,20 +3,31 @@ package protocol
 import (
 	"coins/pkg/blockchain"
 	"coins/pkg/model"
+	"fmt"
 )
 
-const MESSAGE_DELIMITER = byte(255)
-
 type MessageType byte
 
 const (
-	NEW_BLOCK        MessageType = 1
-	NEW_TX           MessageType = 2
-	SYNC             MessageType = 3
-	SYNC_NEXT_BLOCKS MessageType = 4
-	INIT             MessageType = 5
-	INIT_BLOCKS      MessageType = 6
-	NEW_RX           MessageType = 7
+	NEW_BLOCK   MessageType = 1
+	NEW_TX      MessageType = 2
+	INIT        MessageType = 5
+	INIT_BLOCKS MessageType = 6
+	NEW_RX      MessageType = 7
+	VERSION     MessageType = 8
+	VERACK      MessageType = 9
+	GETADDR     MessageType = 10
+	ADDR        MessageType = 11
+	INV         MessageType = 12
+	GETDATA     MessageType = 13
+	GETHEADERS  MessageType = 14
+	HEADERS     MessageType = 15
+)
+
+type ServiceFlag uint64
+
+const (
+	SERVICE_FULL_HISTORY ServiceFlag = 1 << 0 // the node stores and serves every block since genesis
 )
 
 type Message struct {
@@ -24,14 +35,37 @@ type Message struct {
 	Content string // JSON of the appropriate message
 }
 
-type SyncContent struct {
-	Head          uint64 // the head block of the remote chainstate
-	LastBlockHash string // the hash of the last block
+type GetHeadersContent struct {
+	Locator []string // hashes of the chain of the requesting relay, see BlockChain.Locator
+}
+
+type HeadersContent struct {
+	Headers []model.BlockHeader // the headers following the fork point, in order
+}
+
+type InvType byte
+
+const (
+	INV_BLOCK InvType = 1 // a block, identified by its hash
+	INV_TX    InvType = 2 // a transaction, identified by its hash
+	INV_RX    InvType = 3 // a registration, identified by the wallet it registers
+)
+
+type InvItem struct {
+	Type InvType
+	Hash string
+}
+
+func (item InvItem) String() string {
+	return fmt.Sprintf("%d:%v", item.Type, item.Hash)
+}
+
+type InvContent struct {
+	Items []InvItem // the announced items for INV, the requested ones for GETDATA
 }
 
-type SyncNextBlocksContent struct {
-	Head   uint64 // the head of the chainstate of the local relay
-	Blocks []*model.Block
+type AddrContent struct {
+	Addresses []string // addresses of relays the sending relay knows, as host:port
 }
 
 type InitContent struct {
@@ -0,0 +1,44 @@
+package protocol
+
+import (
+	"coins/pkg/model"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// PROTOCOL_VERSION is the version of the protocol spoken by this node
+const PROTOCOL_VERSION = uint32(3)
+
+// MIN_PROTOCOL_VERSION is the oldest version of the protocol we still talk to, version 3 replaced
+// the SYNC exchange with headers-first sync
+const MIN_PROTOCOL_VERSION = uint32(3)
+
+type VersionContent struct {
+	Version  uint32      // the protocol version of the sending relay
+	ChainID  string      // identifies the chain parameters the sending relay follows
+	Height   uint64      // the head of the chainstate of the sending relay
+	Services ServiceFlag // the services offered by the sending relay
+	Port     uint16      // the port the sending relay accepts connections on, 0 if it does not
+	Node     string      // the wallet address of the sending relay, used to detect connections to ourselves
+}
+
+// ChainParamsID identifies the chain by its genesis block and consensus parameters,
+// nodes that disagree on any of them cannot share a chain
+func ChainParamsID() string {
+	genesis := model.Block{}
+	h := sha256.New()
+	fmt.Fprintf(h, "%v|%v|%v|%v", genesis.GetHash(), model.BlockDiff, model.EmptyBlockDiff, model.BlockReward)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Compatible checks whether we can talk to a relay that sent this version
+func (v *VersionContent) Compatible() error {
+	if v.Version < MIN_PROTOCOL_VERSION {
+		return fmt.Errorf("protocol version %v is older than %v", v.Version, MIN_PROTOCOL_VERSION)
+	}
+	if v.ChainID != ChainParamsID() {
+		return fmt.Errorf("chain %v is not our chain %v", v.ChainID, ChainParamsID())
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MAGIC marks the start of every frame, peers of another network use different magic bytes
+var MAGIC = [4]byte{0xC0, 0x1E, 0xB1, 0x0C}
+
+// FRAME_HEADER_SIZE is the size of the header in front of every payload: magic(4) type(1) length(4) checksum(4)
+const FRAME_HEADER_SIZE = 13
+
+// MAX_PAYLOAD_SIZE is the largest payload a frame may carry
+const MAX_PAYLOAD_SIZE = 32 << 20
+
+var ErrBadMagic = errors.New("frame does not start with the network magic")
+var ErrChecksum = errors.New("frame payload does not match its checksum")
+var ErrTooLarge = errors.New("frame payload exceeds the maximum size of its message type")
+
+// checksum returns the first four bytes of the sha256 of the payload
+func checksum(payload []byte) uint32 {
+	sum := sha256.Sum256(payload)
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// EncodeMessage builds the frame for a message
+func EncodeMessage(msg Message) ([]byte, error) {
+	if len(msg.Content) > int(MaxPayloadSize(msg.Type)) {
+		return nil, fmt.Errorf("%v payload of %v bytes exceeds the maximum of %v", msg.Type, len(msg.Content), MaxPayloadSize(msg.Type))
+	}
+	frame := make([]byte, FRAME_HEADER_SIZE+len(msg.Content))
+	copy(frame[0:4], MAGIC[:])
+	frame[4] = byte(msg.Type)
+	binary.BigEndian.PutUint32(frame[5:9], uint32(len(msg.Content)))
+	binary.BigEndian.PutUint32(frame[9:13], checksum([]byte(msg.Content)))
+	copy(frame[FRAME_HEADER_SIZE:], msg.Content)
+	return frame, nil
+}
+
+// WriteMessage writes the message as a single frame, so concurrent writers never interleave
+func WriteMessage(w io.Writer, msg Message) error {
+	frame, err := EncodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(frame)
+	return err
+}
+
+// ReadMessage reads the next frame. After ErrChecksum the stream is still aligned on the next frame,
+// every other error leaves the stream in an unknown state. With ErrChecksum and ErrTooLarge the returned
+// message carries the type of the rejected frame
+func ReadMessage(r io.Reader) (Message, error) {
+	header := make([]byte, FRAME_HEADER_SIZE)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return Message{}, err
+	}
+	if !bytes.Equal(header[0:4], MAGIC[:]) {
+		return Message{}, ErrBadMagic
+	}
+	t := MessageType(header[4])
+	// Check the size before allocating anything for the payload
+	length := binary.BigEndian.Uint32(header[5:9])
+	if length > MaxPayloadSize(t) {
+		return Message{Type: t}, ErrTooLarge
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return Message{}, err
+	}
+	if checksum(payload) != binary.BigEndian.Uint32(header[9:13]) {
+		return Message{Type: t}, ErrChecksum
+	}
+	return Message{Type: t, Content: string(payload)}, nil
+}
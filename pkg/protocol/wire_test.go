@@ -0,0 +1,176 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// encode builds the frame for the message and fails the test if that is not possible
+func encode(t *testing.T, msg Message) []byte {
+	t.Helper()
+	frame, err := EncodeMessage(msg)
+	if err != nil {
+		t.Fatalf("could not encode message with error %v", err)
+	}
+	return frame
+}
+
+func TestReadMessage(t *testing.T) {
+	inv := Message{Type: INV, Content: `{"Items":[]}`}
+	verack := Message{Type: VERACK}
+	// oversized returns a header announcing a payload larger than the type allows, without the payload
+	oversized := func(typ MessageType) []byte {
+		frame := encode(t, Message{Type: typ})
+		binary.BigEndian.PutUint32(frame[5:9], MaxPayloadSize(typ)+1)
+		return frame
+	}
+	tests := []struct {
+		name   string
+		stream func() []byte
+		want   []Message // messages read before the error
+		err    error
+		typ    MessageType // type reported with the error
+	}{
+		{
+			name:   "messages in sequence",
+			stream: func() []byte { return append(encode(t, inv), encode(t, verack)...) },
+			want:   []Message{inv, verack},
+			err:    io.EOF,
+		},
+		{
+			name: "bad magic",
+			stream: func() []byte {
+				frame := encode(t, inv)
+				frame[0] ^= 0xff
+				return frame
+			},
+			err: ErrBadMagic,
+		},
+		{
+			name:   "oversized payload",
+			stream: func() []byte { return oversized(INV) },
+			err:    ErrTooLarge,
+			typ:    INV,
+		},
+		{
+			name:   "payload for a type without one",
+			stream: func() []byte { return oversized(VERACK) },
+			err:    ErrTooLarge,
+			typ:    VERACK,
+		},
+		{
+			name: "unknown type",
+			stream: func() []byte {
+				frame := encode(t, Message{Type: VERACK})
+				frame[4] = 0xee
+				binary.BigEndian.PutUint32(frame[5:9], 1)
+				return append(frame, 'x')
+			},
+			err: ErrTooLarge,
+			typ: MessageType(0xee),
+		},
+		{
+			name: "checksum mismatch is skipped",
+			stream: func() []byte {
+				frame := encode(t, inv)
+				frame[len(frame)-1] ^= 0xff
+				return append(frame, encode(t, verack)...)
+			},
+			err: ErrChecksum,
+			typ: INV,
+		},
+		{
+			name:   "torn header",
+			stream: func() []byte { return encode(t, inv)[:FRAME_HEADER_SIZE-1] },
+			err:    io.ErrUnexpectedEOF,
+		},
+		{
+			name: "torn payload",
+			stream: func() []byte {
+				frame := encode(t, inv)
+				return frame[:len(frame)-1]
+			},
+			err: io.ErrUnexpectedEOF,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := bytes.NewReader(test.stream())
+			for _, want := range test.want {
+				msg, err := ReadMessage(r)
+				if err != nil || msg != want {
+					t.Fatalf("read %+v with error %v instead of %+v", msg, err, want)
+				}
+			}
+			msg, err := ReadMessage(r)
+			if err != test.err || msg.Type != test.typ {
+				t.Fatalf("read type %v with error %v instead of type %v with error %v", msg.Type, err, test.typ, test.err)
+			}
+			// The frame with the bad checksum was consumed completely, the next one is read as usual
+			if err == ErrChecksum {
+				msg, err = ReadMessage(r)
+				if err != nil || msg != verack {
+					t.Fatalf("read %+v with error %v after a checksum mismatch", msg, err)
+				}
+			}
+		})
+	}
+}
+
+func TestEncodeMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		msg   Message
+		fails bool
+	}{
+		{name: "empty payload", msg: Message{Type: VERACK}},
+		{name: "largest payload", msg: Message{Type: VERSION, Content: strings.Repeat("x", int(MaxPayloadSize(VERSION)))}},
+		{name: "oversized payload", msg: Message{Type: VERSION, Content: strings.Repeat("x", int(MaxPayloadSize(VERSION))+1)}, fails: true},
+		{name: "unknown type", msg: Message{Type: MessageType(0xee), Content: "x"}, fails: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			err := WriteMessage(buf, test.msg)
+			if test.fails {
+				if err == nil || buf.Len() > 0 {
+					t.Fatal("wrote a message that exceeds its maximum size")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not write message with error %v", err)
+			}
+			if buf.Len() != FRAME_HEADER_SIZE+len(test.msg.Content) {
+				t.Fatalf("frame of %v bytes for a payload of %v", buf.Len(), len(test.msg.Content))
+			}
+			msg, err := ReadMessage(buf)
+			if err != nil || msg != test.msg {
+				t.Fatalf("message did not survive the round trip, read type %v with error %v", msg.Type, err)
+			}
+		})
+	}
+}
+
+func TestCompatible(t *testing.T) {
+	tests := []struct {
+		name    string
+		version VersionContent
+		fails   bool
+	}{
+		{name: "our version", version: VersionContent{Version: PROTOCOL_VERSION, ChainID: ChainParamsID()}},
+		{name: "newer version", version: VersionContent{Version: PROTOCOL_VERSION + 1, ChainID: ChainParamsID()}},
+		{name: "older version", version: VersionContent{Version: MIN_PROTOCOL_VERSION - 1, ChainID: ChainParamsID()}, fails: true},
+		{name: "other chain", version: VersionContent{Version: PROTOCOL_VERSION, ChainID: "other"}, fails: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.version.Compatible(); (err != nil) != test.fails {
+				t.Fatalf("compatibility check returned error %v", err)
+			}
+		})
+	}
+}
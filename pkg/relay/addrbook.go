@@ -0,0 +1,243 @@
+package relay
+
+import (
+	"coins/pkg/fsutil"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// MAX_NEW_ADDRS is the most addresses kept that we have not connected to yet
+const MAX_NEW_ADDRS = 1024
+
+// MAX_TRIED_ADDRS is the most addresses kept that we successfully connected to before
+const MAX_TRIED_ADDRS = 256
+
+// MAX_ATTEMPTS is the amount of failed attempts after which a new address is dropped
+const MAX_ATTEMPTS = 3
+
+// RETRY_INTERVAL is how long we wait before trying an address again
+const RETRY_INTERVAL = time.Minute
+
+// AddrInfo is what we know about a peer address
+type AddrInfo struct {
+	Addr        string
+	LastSeen    time.Time // When the address was last gossiped to us or connected to
+	LastTried   time.Time // When we last tried to connect to the address
+	LastSuccess time.Time // When we last completed a handshake with the address
+	Attempts    int       // Failed attempts since the last success
+}
+
+// AddrBook keeps the peer addresses we know in two buckets, new for gossiped addresses and tried for
+// addresses we connected to before. It survives restarts so a node does not depend on its peer file
+type AddrBook struct {
+	mutex *sync.Mutex
+	path  string
+	New   map[string]*AddrInfo
+	Tried map[string]*AddrInfo
+}
+
+// OpenAddrBook reads the address book at the path, a missing file is an empty address book
+func OpenAddrBook(path string) (*AddrBook, error) {
+	ab := &AddrBook{mutex: &sync.Mutex{}, path: path, New: make(map[string]*AddrInfo), Tried: make(map[string]*AddrInfo)}
+	bin, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ab, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read address book with error %v", err)
+	}
+	err = json.Unmarshal(bin, ab)
+	if err != nil {
+		return nil, fmt.Errorf("could not deserialize address book with error %v", err)
+	}
+	return ab, nil
+}
+
+// ValidAddr checks that the address is a host and a non zero port
+func ValidAddr(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	return err == nil && host != "" && port != "" && port != "0"
+}
+
+// Add puts addresses we did not know yet into the new bucket
+func (ab *AddrBook) Add(addrs ...string) {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+	now := time.Now()
+	for _, addr := range addrs {
+		if !ValidAddr(addr) {
+			continue
+		}
+		if info, ok := ab.Tried[addr]; ok {
+			info.LastSeen = now
+			continue
+		}
+		if info, ok := ab.New[addr]; ok {
+			info.LastSeen = now
+			continue
+		}
+		// Make room by evicting the address we heard about least recently
+		if len(ab.New) >= MAX_NEW_ADDRS {
+			evict(ab.New)
+		}
+		ab.New[addr] = &AddrInfo{Addr: addr, LastSeen: now}
+	}
+}
+
+// Attempt records that we are trying to connect to the address
+func (ab *AddrBook) Attempt(addr string) {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+	if info := ab.lookup(addr); info != nil {
+		info.LastTried = time.Now()
+	}
+}
+
+// Good records a completed handshake and moves the address into the tried bucket
+func (ab *AddrBook) Good(addr string) {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+	info := ab.lookup(addr)
+	if info == nil {
+		info = &AddrInfo{Addr: addr}
+	}
+	now := time.Now()
+	info.LastSeen = now
+	info.LastSuccess = now
+	info.Attempts = 0
+	delete(ab.New, addr)
+	if _, ok := ab.Tried[addr]; !ok && len(ab.Tried) >= MAX_TRIED_ADDRS {
+		evict(ab.Tried)
+	}
+	ab.Tried[addr] = info
+}
+
+// Failed records a failed connection. New addresses are dropped after MAX_ATTEMPTS, tried addresses
+// fall back into the new bucket so they get a few more chances
+func (ab *AddrBook) Failed(addr string) {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+	if info, ok := ab.Tried[addr]; ok {
+		info.Attempts++
+		if info.Attempts >= MAX_ATTEMPTS {
+			delete(ab.Tried, addr)
+			info.Attempts = 0
+			ab.New[addr] = info
+		}
+		return
+	}
+	if info, ok := ab.New[addr]; ok {
+		info.Attempts++
+		if info.Attempts >= MAX_ATTEMPTS {
+			delete(ab.New, addr)
+		}
+	}
+}
+
+// Remove forgets the address, for example because it turned out to be our own
+func (ab *AddrBook) Remove(addr string) {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+	delete(ab.New, addr)
+	delete(ab.Tried, addr)
+}
+
+// Select picks an address to connect to that is not excluded and was not tried recently.
+// Tried and new addresses are picked with the same chance, as long as both buckets have candidates
+func (ab *AddrBook) Select(exclude func(addr string) bool) (string, bool) {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+	tried := ab.candidates(ab.Tried, exclude)
+	fresh := ab.candidates(ab.New, exclude)
+	if len(tried) > 0 && (len(fresh) == 0 || rand.Intn(2) == 0) {
+		return tried[rand.Intn(len(tried))], true
+	}
+	if len(fresh) > 0 {
+		return fresh[rand.Intn(len(fresh))], true
+	}
+	return "", false
+}
+
+// Sample returns up to n random addresses for gossiping, tried addresses come first
+func (ab *AddrBook) Sample(n int) []string {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+	addrs := []string{}
+	for _, bucket := range []map[string]*AddrInfo{ab.Tried, ab.New} {
+		keys := make([]string, 0, len(bucket))
+		for addr := range bucket {
+			keys = append(keys, addr)
+		}
+		rand.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+		for _, addr := range keys {
+			if len(addrs) >= n {
+				return addrs
+			}
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// Size returns the amount of new and tried addresses
+func (ab *AddrBook) Size() (int, int) {
+	ab.mutex.Lock()
+	defer ab.mutex.Unlock()
+	return len(ab.New), len(ab.Tried)
+}
+
+// Save writes the address book to disk
+func (ab *AddrBook) Save() error {
+	// An address book without a path only lives in memory
+	if ab.path == "" {
+		return nil
+	}
+	ab.mutex.Lock()
+	bin, err := json.Marshal(ab)
+	ab.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("could not serialize address book with error %v", err)
+	}
+	err = fsutil.WriteFileAtomic(ab.path, bin, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write address book with error %v", err)
+	}
+	return nil
+}
+
+// lookup finds the address in either bucket, the caller must hold the mutex
+func (ab *AddrBook) lookup(addr string) *AddrInfo {
+	if info, ok := ab.Tried[addr]; ok {
+		return info
+	}
+	return ab.New[addr]
+}
+
+// candidates returns the addresses of the bucket we may connect to, the caller must hold the mutex
+func (ab *AddrBook) candidates(bucket map[string]*AddrInfo, exclude func(addr string) bool) []string {
+	addrs := []string{}
+	for addr, info := range bucket {
+		if exclude(addr) || time.Since(info.LastTried) < RETRY_INTERVAL {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// evict removes the address of the bucket that was seen least recently
+func evict(bucket map[string]*AddrInfo) {
+	oldest := ""
+	for addr, info := range bucket {
+		if oldest == "" || info.LastSeen.Before(bucket[oldest].LastSeen) {
+			oldest = addr
+		}
+	}
+	delete(bucket, oldest)
+}
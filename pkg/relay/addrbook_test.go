@@ -0,0 +1,213 @@
+package relay
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// bucketOf returns the bucket the address is in
+func bucketOf(ab *AddrBook, addr string) string {
+	if _, ok := ab.Tried[addr]; ok {
+		return "tried"
+	}
+	if _, ok := ab.New[addr]; ok {
+		return "new"
+	}
+	return ""
+}
+
+func TestAddrBookBuckets(t *testing.T) {
+	const addr = "10.0.0.1:10500"
+	add := func(ab *AddrBook) { ab.Add(addr) }
+	good := func(ab *AddrBook) { ab.Good(addr) }
+	failed := func(ab *AddrBook) { ab.Failed(addr) }
+	times := func(n int, step func(ab *AddrBook)) []func(ab *AddrBook) {
+		steps := []func(ab *AddrBook){}
+		for i := 0; i < n; i++ {
+			steps = append(steps, step)
+		}
+		return steps
+	}
+	tests := []struct {
+		name     string
+		steps    []func(ab *AddrBook)
+		bucket   string
+		attempts int
+	}{
+		{name: "gossiped address", steps: []func(ab *AddrBook){add}, bucket: "new"},
+		{name: "connected address", steps: []func(ab *AddrBook){add, good}, bucket: "tried"},
+		{name: "address we were connected to without gossip", steps: []func(ab *AddrBook){good}, bucket: "tried"},
+		{name: "tried address gossiped again", steps: []func(ab *AddrBook){good, add}, bucket: "tried"},
+		{name: "new address failing", steps: append([]func(ab *AddrBook){add}, times(MAX_ATTEMPTS-1, failed)...), bucket: "new", attempts: MAX_ATTEMPTS - 1},
+		{name: "new address failing too often", steps: append([]func(ab *AddrBook){add}, times(MAX_ATTEMPTS, failed)...)},
+		{name: "tried address failing", steps: append([]func(ab *AddrBook){good}, times(MAX_ATTEMPTS-1, failed)...), bucket: "tried", attempts: MAX_ATTEMPTS - 1},
+		{name: "tried address failing too often", steps: append([]func(ab *AddrBook){good}, times(MAX_ATTEMPTS, failed)...), bucket: "new"},
+		{name: "success resets the attempts", steps: []func(ab *AddrBook){add, failed, failed, good}, bucket: "tried"},
+		{name: "removed address", steps: []func(ab *AddrBook){good, func(ab *AddrBook) { ab.Remove(addr) }}},
+		{name: "unknown address failing", steps: []func(ab *AddrBook){failed}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ab, err := OpenAddrBook("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, step := range test.steps {
+				step(ab)
+			}
+			if bucket := bucketOf(ab, addr); bucket != test.bucket {
+				t.Fatalf("address is in bucket %q instead of %q", bucket, test.bucket)
+			}
+			if info := ab.lookup(addr); info != nil && info.Attempts != test.attempts {
+				t.Fatalf("address has %v attempts instead of %v", info.Attempts, test.attempts)
+			}
+		})
+	}
+}
+
+func TestAddrBookRejectsInvalidAddresses(t *testing.T) {
+	ab, err := OpenAddrBook("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalid := []string{"", "10.0.0.1", ":10500", "10.0.0.1:", "10.0.0.1:0", "[::1"}
+	ab.Add(invalid...)
+	ab.Add("[::1]:10500", "node.example:10500")
+	if fresh, tried := ab.Size(); fresh != 2 || tried != 0 {
+		t.Fatalf("address book holds %v new and %v tried addresses instead of 2 valid ones", fresh, tried)
+	}
+}
+
+func TestAddrBookEviction(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		fill   func(ab *AddrBook, addr string)
+		bucket func(ab *AddrBook) map[string]*AddrInfo
+	}{
+		{name: "new bucket", limit: MAX_NEW_ADDRS, fill: func(ab *AddrBook, addr string) { ab.Add(addr) }, bucket: func(ab *AddrBook) map[string]*AddrInfo { return ab.New }},
+		{name: "tried bucket", limit: MAX_TRIED_ADDRS, fill: func(ab *AddrBook, addr string) { ab.Good(addr) }, bucket: func(ab *AddrBook) map[string]*AddrInfo { return ab.Tried }},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ab, err := OpenAddrBook("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			for i := 0; i < test.limit; i++ {
+				addr := fmt.Sprintf("10.0.%v.%v:10500", i/250, i%250+1)
+				test.fill(ab, addr)
+				// The first address was seen least recently
+				test.bucket(ab)[addr].LastSeen = start.Add(time.Duration(i) * time.Second)
+			}
+			test.fill(ab, "10.1.0.1:10500")
+			bucket := test.bucket(ab)
+			if len(bucket) != test.limit {
+				t.Fatalf("bucket holds %v instead of %v addresses", len(bucket), test.limit)
+			}
+			if _, ok := bucket["10.0.0.1:10500"]; ok {
+				t.Fatal("address seen least recently was kept")
+			}
+			if _, ok := bucket["10.1.0.1:10500"]; !ok {
+				t.Fatal("new address was not added")
+			}
+		})
+	}
+}
+
+func TestAddrBookSelect(t *testing.T) {
+	ab, err := OpenAddrBook("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	none := func(addr string) bool { return false }
+	if _, ok := ab.Select(none); ok {
+		t.Fatal("selected an address from an empty address book")
+	}
+	ab.Add("10.0.0.1:10500", "10.0.0.2:10500", "10.0.0.3:10500")
+	ab.Good("10.0.0.4:10500")
+	ab.Attempt("10.0.0.3:10500")
+	exclude := func(addr string) bool { return addr == "10.0.0.2:10500" }
+	picked := map[string]int{}
+	for i := 0; i < 200; i++ {
+		addr, ok := ab.Select(exclude)
+		if !ok {
+			t.Fatal("no address selected")
+		}
+		picked[addr]++
+	}
+	// Excluded and recently tried addresses are skipped, the remaining ones of both buckets get picked
+	if len(picked) != 2 || picked["10.0.0.1:10500"] == 0 || picked["10.0.0.4:10500"] == 0 {
+		t.Fatalf("unexpected selection %v", picked)
+	}
+	ab.Attempt("10.0.0.1:10500")
+	ab.Attempt("10.0.0.4:10500")
+	if addr, ok := ab.Select(exclude); ok {
+		t.Fatalf("selected %v although every address was tried recently", addr)
+	}
+	ab.New["10.0.0.3:10500"].LastTried = time.Now().Add(-RETRY_INTERVAL)
+	if addr, ok := ab.Select(exclude); !ok || addr != "10.0.0.3:10500" {
+		t.Fatalf("selected %v instead of the address whose retry interval passed", addr)
+	}
+}
+
+func TestAddrBookSample(t *testing.T) {
+	ab, err := OpenAddrBook("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ab.Add("10.0.0.1:10500", "10.0.0.2:10500", "10.0.0.3:10500")
+	ab.Good("10.0.0.4:10500")
+	ab.Good("10.0.0.5:10500")
+	tests := []struct {
+		n    int
+		want int
+	}{
+		{n: 0, want: 0},
+		{n: 1, want: 1},
+		{n: 2, want: 2},
+		{n: 4, want: 4},
+		{n: 10, want: 5},
+	}
+	for _, test := range tests {
+		addrs := ab.Sample(test.n)
+		if len(addrs) != test.want {
+			t.Fatalf("sample of %v holds %v addresses instead of %v", test.n, len(addrs), test.want)
+		}
+		// Tried addresses come first
+		for i, addr := range addrs {
+			if (i < 2) != (bucketOf(ab, addr) == "tried") {
+				t.Fatalf("address %v of the sample is %v", i, bucketOf(ab, addr))
+			}
+		}
+	}
+}
+
+func TestAddrBookPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "addrs.json")
+	ab, err := OpenAddrBook(path)
+	if err != nil {
+		t.Fatalf("could not open missing address book with error %v", err)
+	}
+	ab.Add("10.0.0.1:10500", "10.0.0.2:10500")
+	ab.Failed("10.0.0.2:10500")
+	ab.Good("10.0.0.3:10500")
+	if err := ab.Save(); err != nil {
+		t.Fatalf("could not save address book with error %v", err)
+	}
+	reopened, err := OpenAddrBook(path)
+	if err != nil {
+		t.Fatalf("could not reopen address book with error %v", err)
+	}
+	for _, addr := range []string{"10.0.0.1:10500", "10.0.0.2:10500", "10.0.0.3:10500"} {
+		if bucketOf(reopened, addr) != bucketOf(ab, addr) {
+			t.Fatalf("%v moved from %v to %v", addr, bucketOf(ab, addr), bucketOf(reopened, addr))
+		}
+	}
+	if reopened.New["10.0.0.2:10500"].Attempts != 1 || !reopened.Tried["10.0.0.3:10500"].LastSuccess.Equal(ab.Tried["10.0.0.3:10500"].LastSuccess) {
+		t.Fatal("address details did not survive a restart")
+	}
+}
@@ -0,0 +1,193 @@
+package relay
+
+import (
+	"coins/pkg/fsutil"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BAN_THRESHOLD is the misbehavior score at which a peer gets banned
+const BAN_THRESHOLD = 100
+
+// DEFAULT_BAN_DURATION is how long a peer stays banned after reaching the threshold
+const DEFAULT_BAN_DURATION = time.Hour * 24
+
+// SCORE_HALF_LIFE is how long it takes for a misbehavior score to halve, so occasional mistakes never add up to a ban
+const SCORE_HALF_LIFE = time.Minute * 10
+
+// Ban is an entry of the ban list
+type Ban struct {
+	Host  string    // IP address of the banned peer
+	Until time.Time // When the ban expires
+}
+
+// score is the misbehavior score of a peer and when it last decayed
+type score struct {
+	value   int
+	updated time.Time
+}
+
+// decay halves the score for every SCORE_HALF_LIFE that passed since it last decayed
+func (s *score) decay(now time.Time) {
+	halvings := now.Sub(s.updated) / SCORE_HALF_LIFE
+	if halvings <= 0 {
+		return
+	}
+	if halvings >= 31 {
+		s.value = 0
+	} else {
+		s.value >>= uint(halvings)
+	}
+	s.updated = s.updated.Add(halvings * SCORE_HALF_LIFE)
+}
+
+// BanList tracks the misbehavior of peers and the peers banned for it, the bans survive restarts
+type BanList struct {
+	mutex  *sync.Mutex
+	path   string
+	bans   map[string]time.Time
+	scores map[string]*score
+}
+
+// OpenBanList reads the ban list at the path, a missing file is an empty ban list
+func OpenBanList(path string) (*BanList, error) {
+	bl := &BanList{mutex: &sync.Mutex{}, path: path, bans: make(map[string]time.Time), scores: make(map[string]*score)}
+	bin, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return bl, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read ban list with error %v", err)
+	}
+	var bans []Ban
+	err = json.Unmarshal(bin, &bans)
+	if err != nil {
+		return nil, fmt.Errorf("could not deserialize ban list with error %v", err)
+	}
+	for _, ban := range bans {
+		bl.bans[ban.Host] = ban.Until
+	}
+	return bl, nil
+}
+
+// Host returns the host of an address, peers are banned by host so they cannot evade a ban by changing ports
+func Host(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Banned checks whether the host is currently banned
+func (bl *BanList) Banned(host string) bool {
+	if bl == nil {
+		return false
+	}
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+	until, ok := bl.bans[host]
+	return ok && time.Now().Before(until)
+}
+
+// Ban bans the host for the duration, or DEFAULT_BAN_DURATION if the duration is not positive
+func (bl *BanList) Ban(host string, duration time.Duration) error {
+	if duration <= 0 {
+		duration = DEFAULT_BAN_DURATION
+	}
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+	bl.bans[host] = time.Now().Add(duration)
+	delete(bl.scores, host)
+	return bl.save()
+}
+
+// Unban lifts the ban of the host and forgets its misbehavior
+func (bl *BanList) Unban(host string) error {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+	if _, ok := bl.bans[host]; !ok {
+		return fmt.Errorf("%v is not banned", host)
+	}
+	delete(bl.bans, host)
+	delete(bl.scores, host)
+	return bl.save()
+}
+
+// List returns the active bans, the ones expiring first come first
+func (bl *BanList) List() []Ban {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+	bans := []Ban{}
+	now := time.Now()
+	for host, until := range bl.bans {
+		if now.Before(until) {
+			bans = append(bans, Ban{Host: host, Until: until})
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// Penalize adds to the decaying misbehavior score of the host and bans it once the score reaches BAN_THRESHOLD
+func (bl *BanList) Penalize(host string, penalty int) (bool, error) {
+	now := time.Now()
+	bl.mutex.Lock()
+	bl.forgetScores(now)
+	current, ok := bl.scores[host]
+	if !ok {
+		current = &score{updated: now}
+		bl.scores[host] = current
+	}
+	current.decay(now)
+	current.value += penalty
+	exceeded := current.value >= BAN_THRESHOLD
+	bl.mutex.Unlock()
+	if !exceeded {
+		return false, nil
+	}
+	return true, bl.Ban(host, DEFAULT_BAN_DURATION)
+}
+
+// forgetScores drops the scores that decayed away, the caller must hold the mutex
+func (bl *BanList) forgetScores(now time.Time) {
+	for host, current := range bl.scores {
+		current.decay(now)
+		if current.value == 0 {
+			delete(bl.scores, host)
+		}
+	}
+}
+
+// save writes the active bans to disk, the caller must hold the mutex
+func (bl *BanList) save() error {
+	// A ban list without a path only lives in memory
+	if bl.path == "" {
+		return nil
+	}
+	bans := []Ban{}
+	now := time.Now()
+	for host, until := range bl.bans {
+		// Expired bans are dropped the next time the list is written
+		if !now.Before(until) {
+			delete(bl.bans, host)
+			continue
+		}
+		bans = append(bans, Ban{Host: host, Until: until})
+	}
+	bin, err := json.Marshal(bans)
+	if err != nil {
+		return fmt.Errorf("could not serialize ban list with error %v", err)
+	}
+	err = fsutil.WriteFileAtomic(bl.path, bin, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write ban list with error %v", err)
+	}
+	return nil
+}
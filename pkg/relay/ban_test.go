@@ -0,0 +1,191 @@
+package relay
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestScoreDecay(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   int
+		elapsed time.Duration
+		want    int
+	}{
+		{name: "no time passed", value: 80, want: 80},
+		{name: "less than a half life", value: 80, elapsed: SCORE_HALF_LIFE - time.Second, want: 80},
+		{name: "one half life", value: 80, elapsed: SCORE_HALF_LIFE, want: 40},
+		{name: "partial half lives are kept for later", value: 80, elapsed: SCORE_HALF_LIFE * 5 / 2, want: 20},
+		{name: "decayed away", value: 80, elapsed: SCORE_HALF_LIFE * 7, want: 0},
+		{name: "long absence", value: 1 << 30, elapsed: SCORE_HALF_LIFE * 1000, want: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			start := time.Now()
+			s := &score{value: test.value, updated: start}
+			s.decay(start.Add(test.elapsed))
+			if s.value != test.want {
+				t.Fatalf("score decayed to %v instead of %v", s.value, test.want)
+			}
+			// The time that did not make up a whole half life still counts towards the next one
+			if rest := start.Add(test.elapsed).Sub(s.updated); rest < 0 || rest >= SCORE_HALF_LIFE {
+				t.Fatalf("score is %v past its last decay", rest)
+			}
+		})
+	}
+}
+
+func TestPenalize(t *testing.T) {
+	tests := []struct {
+		name      string
+		penalties []int
+		apart     time.Duration // time between two penalties
+		banned    bool
+	}{
+		{name: "single severe penalty", penalties: []int{SCORE_INVALID_BLOCK}, banned: true},
+		{name: "penalties adding up", penalties: []int{SCORE_MALFORMED, 40, 50}, banned: true},
+		{name: "penalties below the threshold", penalties: []int{40, 50}},
+		{name: "penalties far apart", penalties: []int{60, 60}, apart: SCORE_HALF_LIFE * 2},
+		{name: "penalties close together", penalties: []int{60, 60}, apart: SCORE_HALF_LIFE / 2, banned: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			bl, err := OpenBanList("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			banned := false
+			for i, penalty := range test.penalties {
+				// Pretend the time passed since the previous penalty
+				if i > 0 {
+					for _, s := range bl.scores {
+						s.updated = s.updated.Add(-test.apart)
+					}
+				}
+				banned, err = bl.Penalize("10.0.0.1", penalty)
+				if err != nil {
+					t.Fatalf("could not penalize with error %v", err)
+				}
+			}
+			if banned != test.banned || bl.Banned("10.0.0.1") != test.banned {
+				t.Fatalf("peer banned=%v instead of %v", banned, test.banned)
+			}
+			if bl.Banned("10.0.0.2") {
+				t.Fatal("another peer got banned")
+			}
+			// A ban starts over with a clean score
+			if _, ok := bl.scores["10.0.0.1"]; ok == test.banned {
+				t.Fatalf("score kept=%v after banned=%v", ok, test.banned)
+			}
+		})
+	}
+}
+
+func TestBanListPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	bl, err := OpenBanList(path)
+	if err != nil {
+		t.Fatalf("could not open missing ban list with error %v", err)
+	}
+	if len(bl.List()) != 0 {
+		t.Fatal("missing ban list is not empty")
+	}
+	bl.Ban("10.0.0.1", time.Hour)
+	bl.Ban("10.0.0.2", 0)
+	bl.Ban("10.0.0.3", time.Hour)
+	bl.Unban("10.0.0.3")
+	bl.Penalize("10.0.0.4", SCORE_MALFORMED)
+	// Bans that already expired are dropped when the list is written
+	bl.bans["10.0.0.5"] = time.Now().Add(-time.Second)
+	bl.Ban("10.0.0.6", time.Hour)
+	tests := []struct {
+		host   string
+		banned bool
+	}{
+		{host: "10.0.0.1", banned: true},
+		{host: "10.0.0.2", banned: true},
+		{host: "10.0.0.3"},
+		{host: "10.0.0.4"},
+		{host: "10.0.0.5"},
+		{host: "10.0.0.6", banned: true},
+	}
+	reopened, err := OpenBanList(path)
+	if err != nil {
+		t.Fatalf("could not reopen ban list with error %v", err)
+	}
+	for _, test := range tests {
+		if reopened.Banned(test.host) != test.banned {
+			t.Fatalf("%v banned=%v after reopening", test.host, !test.banned)
+		}
+		if _, ok := reopened.bans[test.host]; ok != test.banned {
+			t.Fatalf("%v stored=%v after reopening", test.host, ok)
+		}
+	}
+	// The default ban lasts the longest and comes last
+	bans := reopened.List()
+	if len(bans) != 3 || bans[2].Host != "10.0.0.2" || time.Until(bans[2].Until) < DEFAULT_BAN_DURATION-time.Minute {
+		t.Fatalf("unexpected bans %+v after reopening", bans)
+	}
+	if err := ioutil.WriteFile(path, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenBanList(path); err == nil {
+		t.Fatal("opened a corrupt ban list")
+	}
+	if _, err := OpenBanList(filepath.Join(t.TempDir(), "missing", "bans.json")); err != nil {
+		t.Fatalf("could not open ban list in a missing directory with error %v", err)
+	}
+}
+
+// hostConn is a connection that reports the remote address we tell it
+type hostConn struct {
+	net.Conn
+	remote string
+}
+
+func (c *hostConn) RemoteAddr() net.Addr {
+	addr, _ := net.ResolveTCPAddr("tcp", c.remote)
+	return addr
+}
+
+func TestMisbehaveClosesEveryConnection(t *testing.T) {
+	r := newTestRelay(t, nil)
+	bans, err := OpenBanList("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Bans = bans
+	peers := map[string]*Peer{}
+	for _, remote := range []string{"10.0.0.1:1000", "10.0.0.1:2000", "10.0.0.2:1000"} {
+		conn, other := net.Pipe()
+		defer other.Close()
+		p := NewPeer(&hostConn{Conn: conn, remote: remote}, remote, PEER_INBOUND)
+		p.activate(nil)
+		r.PeerManager.Add(p)
+		peers[remote] = p
+	}
+	// A misbehaving connection that is still in its handshake
+	conn, other := net.Pipe()
+	defer other.Close()
+	handshaking := &hostConn{Conn: conn, remote: "10.0.0.1:3000"}
+	r.misbehave(handshaking, SCORE_MALFORMED, "a malformed message")
+	if peers["10.0.0.1:1000"].State() != PEER_ACTIVE {
+		t.Fatal("peer was disconnected before it got banned")
+	}
+	r.misbehave(handshaking, SCORE_INVALID_BLOCK, "an invalid block")
+	if !r.Bans.Banned("10.0.0.1") {
+		t.Fatal("misbehaving host was not banned")
+	}
+	for remote, p := range peers {
+		closed := Host(remote) == "10.0.0.1"
+		if (p.State() == PEER_CLOSED) != closed || (r.PeerManager.Get(p.Conn) == nil) != closed {
+			t.Fatalf("peer %v has state %v after banning 10.0.0.1", remote, p.State())
+		}
+	}
+	if _, err := handshaking.Write([]byte{0}); err == nil {
+		t.Fatal("misbehaving connection is still open")
+	}
+}
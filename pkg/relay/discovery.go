@@ -0,0 +1,164 @@
+package relay
+
+import (
+	"coins/pkg/protocol"
+	"encoding/json"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// TARGET_OUTBOUND is the amount of outbound connections a relay keeps unless configured otherwise
+const TARGET_OUTBOUND = 8
+
+// DIAL_TIMEOUT is how long we wait for a peer to accept our connection
+const DIAL_TIMEOUT = time.Second * 10
+
+// MAINTAIN_INTERVAL is how often we check whether we need more outbound connections
+const MAINTAIN_INTERVAL = time.Second * 5
+
+// ADDR_SAVE_INTERVAL is how often the address book is written to disk
+const ADDR_SAVE_INTERVAL = time.Minute
+
+// ADDR_SAMPLE is the amount of addresses we answer a GETADDR with
+const ADDR_SAMPLE = 250
+
+// PeerSet is a set of peer addresses that is safe for concurrent use
+type PeerSet struct {
+	mutex *sync.Mutex
+	addrs map[string]bool
+}
+
+func NewPeerSet() *PeerSet {
+	return &PeerSet{mutex: &sync.Mutex{}, addrs: make(map[string]bool)}
+}
+
+func (ps *PeerSet) Add(addr string) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.addrs[addr] = true
+}
+
+func (ps *PeerSet) Remove(addr string) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	delete(ps.addrs, addr)
+}
+
+func (ps *PeerSet) Has(addr string) bool {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return ps.addrs[addr]
+}
+
+func (ps *PeerSet) Len() int {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	return len(ps.addrs)
+}
+
+// ConsumePeers seeds the address book with the peers and keeps our outbound connections at the target,
+// replacing every peer that disconnects or cannot be reached with another address from the book
+func (r *Relay) ConsumePeers(peers []string) {
+	r.Addrs.Add(peers...)
+	lastSave := time.Now()
+	for {
+		r.fillOutbound()
+		// Persist what we learned about our peers
+		if time.Since(lastSave) >= ADDR_SAVE_INTERVAL {
+			err := r.Addrs.Save()
+			if err != nil {
+				log.Printf("[NODE] could not save address book with error %v\n", err)
+			}
+			lastSave = time.Now()
+		}
+		time.Sleep(MAINTAIN_INTERVAL)
+	}
+}
+
+// fillOutbound dials addresses from the book until we reach our target of outbound connections
+func (r *Relay) fillOutbound() {
+	target := r.TargetOutbound
+	if target <= 0 {
+		target = TARGET_OUTBOUND
+	}
+	for r.Outbound.Len() < target {
+		addr, ok := r.Addrs.Select(func(addr string) bool {
+			return r.Outbound.Has(addr) || r.Bans.Banned(Host(addr))
+		})
+		if !ok {
+			return
+		}
+		r.Outbound.Add(addr)
+		r.Addrs.Attempt(addr)
+		go r.connectPeer(addr)
+	}
+}
+
+// connectPeer dials the address and handles the connection until it closes
+func (r *Relay) connectPeer(addr string) {
+	// Free the slot once we are done, so another peer can take it
+	defer r.Outbound.Remove(addr)
+	raw, err := r.transport().Dial(addr, DIAL_TIMEOUT)
+	if err != nil {
+		log.Printf("Could not initialize connection with error %v\n", err)
+		r.Addrs.Failed(addr)
+		return
+	}
+	// encrypt the connection before anything else is sent
+	conn, err := r.secure(raw, true)
+	if err != nil {
+		log.Printf("[NODE] Securing connection with peer %v failed with error %v\n", addr, err)
+		raw.Close()
+		r.Addrs.Failed(addr)
+		return
+	}
+	// introduce ourselves before anything else
+	remote, err := r.handshake(conn)
+	if err != nil {
+		log.Printf("[NODE] Handshake with peer %v failed with error %v\n", addr, err)
+		conn.Close()
+		if err == ErrSelfConnection {
+			r.Addrs.Remove(addr)
+			return
+		}
+		r.Addrs.Failed(addr)
+		return
+	}
+	r.Addrs.Good(addr)
+	log.Printf("[NODE] Connected to peer %v\n", addr)
+	r.servePeer(NewPeer(conn, addr, PEER_OUTBOUND), remote)
+	log.Printf("[NODE] Disconnected from peer %v\n", addr)
+}
+
+// learnAddr adds the address an inbound peer accepts connections on to our address book
+func (r *Relay) learnAddr(conn net.Conn, remote *protocol.VersionContent) {
+	if remote.Port == 0 {
+		return
+	}
+	r.Addrs.Add(net.JoinHostPort(Host(conn.RemoteAddr().String()), strconv.Itoa(int(remote.Port))))
+}
+
+// handleGetAddr responds with a sample of the addresses we know
+func (r *Relay) handleGetAddr(conn net.Conn) {
+	bin, err := json.Marshal(protocol.AddrContent{Addresses: r.Addrs.Sample(ADDR_SAMPLE)})
+	if err != nil {
+		log.Println("[NODE] Failed to marshall addresses")
+		return
+	}
+	r.send(protocol.Message{Type: protocol.ADDR, Content: string(bin)}, conn)
+}
+
+// handleAddr adds the gossiped addresses to our address book
+func (r *Relay) handleAddr(content string, conn net.Conn) {
+	var req protocol.AddrContent
+	err := json.Unmarshal([]byte(content), &req)
+	if err != nil || len(req.Addresses) > protocol.MAX_ADDRS {
+		log.Println("[NODE] Failed to unmarshall addresses")
+		r.misbehave(conn, SCORE_MALFORMED, "a malformed message")
+		return
+	}
+	r.Addrs.Add(req.Addresses...)
+}
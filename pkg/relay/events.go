@@ -0,0 +1,88 @@
+package relay
+
+import (
+	"coins/pkg/gorx"
+	"coins/pkg/model"
+)
+
+// Events holds the observable streams a relay pushes to while it follows the chain
+type Events struct {
+	NewBlock             *gorx.Observable // emits model.Block after it was processed
+	NewTransaction       *gorx.Observable // emits model.Transaction once it entered the floating pool
+	NewRegistration      *gorx.Observable // emits model.Registration once it entered the floating pool
+	Reorg                *gorx.Observable // emits ReorgEvent when the local head is replaced by a fork
+	WalletBalanceChanged *gorx.Observable // emits WalletEvent for every wallet touched by a block
+}
+
+type ReorgEvent struct {
+	ForkPoint uint64 // ID of the last block both chains have in common
+	OldHead   string // Hash of the head before the reorg
+	NewHead   string // Hash of the head after the reorg
+}
+
+type WalletEvent struct {
+	Address string  // The wallet address whose balance changed
+	Amount  float64 // The new balance of the wallet
+	TXC     uint64  // The new transaction counter of the wallet
+	Block   uint64  // ID of the block that caused the change
+}
+
+func NewEvents() *Events {
+	return &Events{
+		NewBlock:             gorx.NewObservable(),
+		NewTransaction:       gorx.NewObservable(),
+		NewRegistration:      gorx.NewObservable(),
+		Reorg:                gorx.NewObservable(),
+		WalletBalanceChanged: gorx.NewObservable(),
+	}
+}
+
+// touchedWallets returns the addresses whose wallet info is changed by processing the block
+func touchedWallets(block model.Block) []string {
+	seen := make(map[string]bool)
+	addrs := []string{}
+	add := func(addr string) {
+		if !seen[addr] {
+			seen[addr] = true
+			addrs = append(addrs, addr)
+		}
+	}
+	for _, rx := range block.Registrations {
+		add(rx.Wallet)
+	}
+	add(block.Miner)
+	for _, tx := range block.Transactions {
+		add(tx.Sender)
+		add(tx.Recipient)
+	}
+	return addrs
+}
+
+// walletEvents returns the balances of the wallets touched by the block. The caller holds the chain lock and has
+// just processed the block, so the balances are the ones the block left behind and not those of a later block
+func (r *Relay) walletEvents(block model.Block) []WalletEvent {
+	if r.Events == nil {
+		return nil
+	}
+	events := []WalletEvent{}
+	for _, addr := range touchedWallets(block) {
+		info := r.Blockchain.Chainstate.Wallets[addr]
+		if info == nil {
+			continue
+		}
+		events = append(events, WalletEvent{Address: addr, Amount: info.Amount, TXC: info.TXC, Block: block.ID})
+	}
+	return events
+}
+
+// emitBlock pushes the block and the wallet balances captured by walletEvents to the subscribers, without
+// holding the chain lock
+func (r *Relay) emitBlock(block model.Block, events []WalletEvent) {
+	if r.Events == nil {
+		return
+	}
+	r.Events.NewBlock.Push(block)
+	for _, event := range events {
+		r.Events.WalletBalanceChanged.Push(event)
+	}
+}
@@ -0,0 +1,82 @@
+package relay
+
+import (
+	"coins/pkg/blockchain"
+	"coins/pkg/model"
+	"context"
+	"testing"
+)
+
+// mineBlocks mines the amount of blocks on top of the head of the relay and returns them with the balance
+// of its wallet after each of them
+func mineBlocks(t *testing.T, r *Relay, count int) ([]model.Block, []float64) {
+	t.Helper()
+	blocks := []model.Block{}
+	amounts := []float64{}
+	for i := 0; i < count; i++ {
+		block, res := r.BlockTemplate(r.Wallet.Address)
+		if res != blockchain.B_ACCEPT {
+			t.Fatalf("could not build a block with reason=%v", res)
+		}
+		if !block.Mine(context.Background(), 1, nil) {
+			t.Fatal("could not mine a block")
+		}
+		if res := r.SubmitBlock(block); res != blockchain.B_ACCEPT {
+			t.Fatalf("submitted block rejected with reason=%v", res)
+		}
+		r.ChainMutex.RLock()
+		amounts = append(amounts, r.Blockchain.Chainstate.Wallets[r.Wallet.Address].Amount)
+		r.ChainMutex.RUnlock()
+		blocks = append(blocks, block)
+	}
+	return blocks, amounts
+}
+
+func TestEmitBlockBalances(t *testing.T) {
+	fork := newTestRelay(t, nil)
+	blocks, amounts := mineBlocks(t, fork, 3)
+	tests := []struct {
+		name  string
+		apply func(r *Relay)
+	}{
+		{
+			name: "new blocks",
+			apply: func(r *Relay) {
+				for _, block := range blocks {
+					if res := r.newBlock(block); res != blockchain.B_ACCEPT {
+						t.Fatalf("block rejected with reason=%v", res)
+					}
+				}
+			},
+		},
+		{
+			name: "reorganization",
+			apply: func(r *Relay) {
+				mineBlocks(t, r, 1)
+				if _, err := r.reorganize(0, blocks); err != nil {
+					t.Fatalf("could not switch to the fork with error %v", err)
+				}
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestRelay(t, nil)
+			r.Events = NewEvents()
+			// Every event reports the balance the block left behind, not the one of a later block
+			got := map[uint64]float64{}
+			r.Events.WalletBalanceChanged.Subscribe(func(v interface{}) {
+				event := v.(WalletEvent)
+				if event.Address == fork.Wallet.Address {
+					got[event.Block] = event.Amount
+				}
+			})
+			test.apply(r)
+			for i, block := range blocks {
+				if got[block.ID] != amounts[i] {
+					t.Fatalf("balance after block %v is %v instead of %v", block.ID, got[block.ID], amounts[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package relay
+
+import (
+	"coins/pkg/protocol"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+)
+
+// HandshakeTimeout is how long a peer has to complete the version handshake
+const HandshakeTimeout = time.Second * 30
+
+var ErrSelfConnection = errors.New("connected to ourselves")
+
+// Version returns the version message we introduce ourselves with
+func (r *Relay) Version() protocol.VersionContent {
+	r.ChainMutex.RLock()
+	height := r.Blockchain.Chainstate.LastBlock.ID
+	r.ChainMutex.RUnlock()
+	return protocol.VersionContent{
+		Version:  protocol.PROTOCOL_VERSION,
+		ChainID:  protocol.ChainParamsID(),
+		Height:   height,
+		Services: r.Services(),
+		Port:     r.ListenPort,
+		Node:     r.Wallet.Address,
+	}
+}
+
+// handshake exchanges VERSION and VERACK with the peer, no other message is accepted before both arrived
+func (r *Relay) handshake(conn net.Conn) (*protocol.VersionContent, error) {
+	conn.SetDeadline(time.Now().Add(HandshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	// Both sides introduce themselves first, so neither waits on the other
+	bin, err := json.Marshal(r.Version())
+	if err != nil {
+		return nil, fmt.Errorf("could not build version with error %v", err)
+	}
+	err = protocol.WriteMessage(conn, protocol.Message{Type: protocol.VERSION, Content: string(bin)})
+	if err != nil {
+		return nil, fmt.Errorf("could not send version with error %v", err)
+	}
+	var remote *protocol.VersionContent
+	acked := false
+	for remote == nil || !acked {
+		msg, err := protocol.ReadMessage(conn)
+		if err != nil {
+			return nil, fmt.Errorf("could not read handshake with error %v", err)
+		}
+		switch msg.Type {
+		case protocol.VERSION:
+			if remote != nil {
+				return nil, fmt.Errorf("peer sent its version twice")
+			}
+			var version protocol.VersionContent
+			err = json.Unmarshal([]byte(msg.Content), &version)
+			if err != nil {
+				return nil, fmt.Errorf("could not unmarshall version with error %v", err)
+			}
+			err = version.Compatible()
+			if err != nil {
+				return nil, err
+			}
+			if version.Node == r.Wallet.Address {
+				return nil, ErrSelfConnection
+			}
+			remote = &version
+			// Acknowledge the version so the peer knows we accept it
+			err = protocol.WriteMessage(conn, protocol.Message{Type: protocol.VERACK})
+			if err != nil {
+				return nil, fmt.Errorf("could not send verack with error %v", err)
+			}
+		case protocol.VERACK:
+			acked = true
+		default:
+			return nil, fmt.Errorf("peer sent message type %v before completing the handshake", msg.Type)
+		}
+	}
+	log.Printf("[NODE] handshake with %v complete, version=%v height=%v services=%v\n", conn.RemoteAddr(), remote.Version, remote.Height, remote.Services)
+	return remote, nil
+}
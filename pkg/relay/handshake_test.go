@@ -0,0 +1,139 @@
+package relay
+
+import (
+	"coins/pkg/protocol"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+// versionMessage returns the VERSION message of the version
+func versionMessage(t *testing.T, version protocol.VersionContent) protocol.Message {
+	t.Helper()
+	bin, err := json.Marshal(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return protocol.Message{Type: protocol.VERSION, Content: string(bin)}
+}
+
+func TestHandshake(t *testing.T) {
+	r := newTestRelay(t, nil)
+	peer := protocol.VersionContent{Version: protocol.PROTOCOL_VERSION, ChainID: protocol.ChainParamsID(), Height: 7, Node: "peer"}
+	old := peer
+	old.Version = protocol.MIN_PROTOCOL_VERSION - 1
+	other := peer
+	other.ChainID = "other"
+	self := peer
+	self.Node = r.Wallet.Address
+	verack := protocol.Message{Type: protocol.VERACK}
+	tests := []struct {
+		name  string
+		sent  []protocol.Message // messages the peer sends
+		close bool               // whether the peer hangs up after our version
+		err   string
+	}{
+		{name: "version then verack", sent: []protocol.Message{versionMessage(t, peer), verack}},
+		{name: "verack then version", sent: []protocol.Message{verack, versionMessage(t, peer)}},
+		{name: "older protocol version", sent: []protocol.Message{versionMessage(t, old)}, err: "is older than"},
+		{name: "other chain", sent: []protocol.Message{versionMessage(t, other)}, err: "is not our chain"},
+		{name: "connection to ourselves", sent: []protocol.Message{versionMessage(t, self)}, err: ErrSelfConnection.Error()},
+		{name: "version twice", sent: []protocol.Message{versionMessage(t, peer), versionMessage(t, peer)}, err: "version twice"},
+		{name: "malformed version", sent: []protocol.Message{{Type: protocol.VERSION, Content: "{"}}, err: "could not unmarshall version"},
+		{name: "message before the handshake", sent: []protocol.Message{{Type: protocol.GETADDR}}, err: "before completing the handshake"},
+		{name: "connection closed", close: true, err: "could not read handshake"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			local, remote := net.Pipe()
+			defer local.Close()
+			// The peer reads everything we send, pipes block writes until the other side reads them
+			received := make(chan []protocol.Message)
+			go func() {
+				msgs := []protocol.Message{}
+				for {
+					msg, err := protocol.ReadMessage(remote)
+					if err != nil {
+						received <- msgs
+						return
+					}
+					msgs = append(msgs, msg)
+					if test.close {
+						remote.Close()
+					}
+				}
+			}()
+			go func() {
+				for _, msg := range test.sent {
+					if protocol.WriteMessage(remote, msg) != nil {
+						return
+					}
+				}
+			}()
+			version, err := r.handshake(local)
+			local.Close()
+			msgs := <-received
+			remote.Close()
+			if len(msgs) == 0 || msgs[0].Type != protocol.VERSION {
+				t.Fatal("we did not introduce ourselves first")
+			}
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("handshake failed with error %v instead of %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("handshake failed with error %v", err)
+			}
+			if *version != peer {
+				t.Fatalf("handshake returned version %+v instead of %+v", *version, peer)
+			}
+			// The version of the peer was acknowledged
+			if len(msgs) != 2 || msgs[1].Type != protocol.VERACK {
+				t.Fatalf("sent %v messages instead of our version and a verack", len(msgs))
+			}
+		})
+	}
+}
+
+func TestHandshakeBetweenRelays(t *testing.T) {
+	a, b := newTestRelay(t, nil), newTestRelay(t, nil)
+	// Both sides send their version before reading, which needs the buffers of a real connection
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("could not listen with error %v", err)
+	}
+	defer listener.Close()
+	done := make(chan error)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			done <- err
+			return
+		}
+		defer conn.Close()
+		version, err := b.handshake(conn)
+		if err == nil && version.Node != a.Wallet.Address {
+			err = fmt.Errorf("handshake returned version %+v of another relay", *version)
+		}
+		done <- err
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("could not connect with error %v", err)
+	}
+	defer conn.Close()
+	version, err := a.handshake(conn)
+	if err != nil {
+		t.Fatalf("handshake failed with error %v", err)
+	}
+	if version.Node != b.Wallet.Address || version.Height != headHeight(b) {
+		t.Fatalf("handshake returned version %+v of another relay", *version)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("handshake of the other side failed with error %v", err)
+	}
+}
@@ -0,0 +1,558 @@
+package relay
+
+import (
+	"coins/pkg/blockchain"
+	"coins/pkg/crypto"
+	"coins/pkg/model"
+	"coins/pkg/protocol"
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// MAX_BLOCKS_PER_REQUEST is the amount of blocks requested from a peer in a single batch
+const MAX_BLOCKS_PER_REQUEST = 100
+
+// MAX_BATCHES_PER_PEER is the amount of batches a single peer may have in flight
+const MAX_BATCHES_PER_PEER = 2
+
+// DOWNLOAD_WINDOW is how far past the next block we need we download bodies, so a slow peer
+// cannot make us buffer the whole chain
+const DOWNLOAD_WINDOW = 1000
+
+// HEADERS_TIMEOUT is how long we wait for a peer to answer GETHEADERS
+const HEADERS_TIMEOUT = time.Second * 30
+
+// BLOCK_TIMEOUT is how long a peer may take to deliver a batch before we request it from another peer
+const BLOCK_TIMEOUT = time.Second * 20
+
+// SYNC_INTERVAL is how often we check for stalled requests and peers that are ahead of us
+const SYNC_INTERVAL = time.Second
+
+// batch is a GETDATA request for a range of blocks sent to a single peer
+type batch struct {
+	conn    net.Conn
+	sent    time.Time
+	pending int // amount of blocks of the batch we are still waiting for
+}
+
+// download is the body of a block we received before all blocks preceding it
+type download struct {
+	block model.Block
+	conn  net.Conn
+}
+
+// HeaderSync downloads the chain of a peer that is ahead of us. The headers are fetched and checked first,
+// the bodies are then requested in batches from every peer that has them and applied in order
+type HeaderSync struct {
+	mutex      *sync.Mutex
+	headers    []model.BlockHeader // validated headers following our head whose blocks we did not apply yet
+	hashes     map[string]uint64   // hashes of the pending headers and their ids
+	bodies     map[uint64]*download
+	inflight   map[uint64]*batch
+	batches    []*batch
+	heights    map[net.Conn]uint64 // the best height we know each peer has
+	headerPeer net.Conn            // the peer we requested headers from, nil if there is no request
+	headerSent time.Time
+	applying   bool   // whether a goroutine is applying downloaded blocks
+	generation uint64 // counts the resets, so an applier notices that the pending headers were replaced
+}
+
+func NewHeaderSync() *HeaderSync {
+	return &HeaderSync{
+		mutex:    &sync.Mutex{},
+		hashes:   make(map[string]uint64),
+		bodies:   make(map[uint64]*download),
+		inflight: make(map[uint64]*batch),
+		heights:  make(map[net.Conn]uint64),
+	}
+}
+
+// Pending returns the amount of headers whose blocks we did not apply yet
+func (hs *HeaderSync) Pending() int {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	return len(hs.headers)
+}
+
+// SetHeight records that the peer has at least the height
+func (hs *HeaderSync) SetHeight(conn net.Conn, height uint64) {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	if height > hs.heights[conn] {
+		hs.heights[conn] = height
+	}
+}
+
+// Drop forgets the peer, the blocks it did not deliver yet are requested from other peers
+func (hs *HeaderSync) Drop(conn net.Conn) {
+	hs.mutex.Lock()
+	defer hs.mutex.Unlock()
+	delete(hs.heights, conn)
+	if hs.headerPeer == conn {
+		hs.headerPeer = nil
+	}
+	hs.expire(func(b *batch) bool { return b.conn == conn })
+}
+
+// reset forgets all pending headers and downloads
+func (hs *HeaderSync) reset() {
+	hs.generation++
+	hs.headers = nil
+	hs.hashes = make(map[string]uint64)
+	hs.bodies = make(map[uint64]*download)
+	hs.inflight = make(map[uint64]*batch)
+	hs.batches = nil
+}
+
+// expire cancels the batches the filter matches, so their blocks get requested again
+func (hs *HeaderSync) expire(match func(b *batch) bool) {
+	kept := []*batch{}
+	for _, b := range hs.batches {
+		if !match(b) {
+			kept = append(kept, b)
+		}
+	}
+	hs.batches = kept
+	for id, b := range hs.inflight {
+		if match(b) {
+			delete(hs.inflight, id)
+		}
+	}
+}
+
+// syncTip returns the id and hash of the last pending header, or of our head if there is none.
+// The caller must hold the sync lock
+func (r *Relay) syncTip() (uint64, string) {
+	if n := len(r.Sync.headers); n > 0 {
+		return r.Sync.headers[n-1].ID, r.Sync.headers[n-1].Hash()
+	}
+	r.ChainMutex.RLock()
+	defer r.ChainMutex.RUnlock()
+	return r.Blockchain.Chainstate.LastBlock.ID, r.Blockchain.Chainstate.LastBlock.Hash
+}
+
+// syncActions collects what a sync step has to tell peers, they are carried out once the sync lock is released
+// so a slow connection or a ban cannot hold up the syncer
+type syncActions struct {
+	messages  []queuedMessage
+	penalties []penalty
+}
+
+type queuedMessage struct {
+	msg  protocol.Message
+	conn net.Conn
+}
+
+type penalty struct {
+	conn   net.Conn
+	score  int
+	reason string
+}
+
+func (a *syncActions) send(msg protocol.Message, conn net.Conn) {
+	a.messages = append(a.messages, queuedMessage{msg: msg, conn: conn})
+}
+
+func (a *syncActions) misbehave(conn net.Conn, score int, reason string) {
+	a.penalties = append(a.penalties, penalty{conn: conn, score: score, reason: reason})
+}
+
+// run carries out the actions, the caller must not hold the sync lock
+func (r *Relay) run(a *syncActions) {
+	for _, p := range a.penalties {
+		r.misbehave(p.conn, p.score, p.reason)
+	}
+	for _, m := range a.messages {
+		r.send(m.msg, m.conn)
+	}
+}
+
+// TrySyncOrNop asks the peer for the headers following our chain, unless we are already waiting for headers
+func (r *Relay) TrySyncOrNop(conn net.Conn) {
+	actions := &syncActions{}
+	r.Sync.mutex.Lock()
+	if r.Sync.headerPeer == nil || time.Since(r.Sync.headerSent) >= HEADERS_TIMEOUT {
+		r.requestHeaders(conn, actions)
+	}
+	r.Sync.mutex.Unlock()
+	r.run(actions)
+}
+
+// requestHeaders queues GETHEADERS with a locator of our chain, preceded by our last pending header so the
+// peer continues where its last response ended. The caller must hold the sync lock
+func (r *Relay) requestHeaders(conn net.Conn, actions *syncActions) {
+	r.ChainMutex.RLock()
+	locator := r.Blockchain.Locator()
+	r.ChainMutex.RUnlock()
+	// Without a chain we have to bootstrap first
+	if len(locator) == 0 {
+		return
+	}
+	if n := len(r.Sync.headers); n > 0 {
+		locator = append([]string{r.Sync.headers[n-1].Hash()}, locator...)
+	}
+	if len(locator) > protocol.MAX_LOCATOR {
+		locator = append(locator[:protocol.MAX_LOCATOR-1], locator[len(locator)-1])
+	}
+	bin, err := json.Marshal(protocol.GetHeadersContent{Locator: locator})
+	if err != nil {
+		log.Println("[NODE] Failed to marshall header request")
+		return
+	}
+	r.Sync.headerPeer = conn
+	r.Sync.headerSent = time.Now()
+	log.Printf("[NODE] requesting headers from %v\n", conn.RemoteAddr())
+	actions.send(protocol.Message{Type: protocol.GETHEADERS, Content: string(bin)}, conn)
+}
+
+// handleGetHeaders responds with the headers following the first block of the locator we know
+func (r *Relay) handleGetHeaders(content string, conn net.Conn) {
+	var req protocol.GetHeadersContent
+	err := json.Unmarshal([]byte(content), &req)
+	if err != nil || len(req.Locator) > protocol.MAX_LOCATOR {
+		log.Println("[NODE] Failed to unmarshall header request")
+		r.misbehave(conn, SCORE_MALFORMED, "a malformed message")
+		return
+	}
+	r.ChainMutex.RLock()
+	fork, ok := r.Blockchain.FindFork(req.Locator)
+	headers := []model.BlockHeader{}
+	if ok {
+		headers = r.Blockchain.HeadersAfter(fork, protocol.MAX_HEADERS)
+	} else {
+		// The peer either forked off before our oldest block or follows another chain entirely
+		log.Printf("[NODE] no common block with %v, sending no headers\n", conn.RemoteAddr())
+	}
+	r.ChainMutex.RUnlock()
+	bin, err := json.Marshal(protocol.HeadersContent{Headers: headers})
+	if err != nil {
+		log.Println("[NODE] Failed to marshall headers")
+		return
+	}
+	r.send(protocol.Message{Type: protocol.HEADERS, Content: string(bin)}, conn)
+}
+
+// handleHeaders checks the headers and schedules the download of their blocks
+func (r *Relay) handleHeaders(content string, conn net.Conn) {
+	var req protocol.HeadersContent
+	err := json.Unmarshal([]byte(content), &req)
+	if err != nil || len(req.Headers) > protocol.MAX_HEADERS {
+		log.Println("[NODE] Failed to unmarshall headers")
+		r.misbehave(conn, SCORE_MALFORMED, "a malformed message")
+		return
+	}
+	actions := &syncActions{}
+	r.Sync.mutex.Lock()
+	r.addHeaders(req.Headers, conn, actions)
+	r.Sync.mutex.Unlock()
+	r.run(actions)
+}
+
+// addHeaders adds the headers the peer sent to the pending ones. The caller must hold the sync lock
+func (r *Relay) addHeaders(headers []model.BlockHeader, conn net.Conn, actions *syncActions) {
+	if r.Sync.headerPeer == conn {
+		r.Sync.headerPeer = nil
+	}
+	if len(headers) == 0 {
+		return
+	}
+	// The headers have to link to each other and carry the work their hash claims
+	for i := range headers {
+		header := &headers[i]
+		if i > 0 && (header.ID != headers[i-1].ID+1 || header.Previous != headers[i-1].Hash()) {
+			actions.misbehave(conn, SCORE_INVALID_HEADERS, "headers that do not link")
+			return
+		}
+		if crypto.GetHashDiff(crypto.ToBytes(header.Hash())) != header.Difficulty() {
+			actions.misbehave(conn, SCORE_INVALID_HEADERS, "a header without the required work")
+			return
+		}
+	}
+	last := headers[len(headers)-1]
+	if last.ID > r.Sync.heights[conn] {
+		r.Sync.heights[conn] = last.ID
+	}
+	// Headers extending the pending headers or our head are added to them, otherwise they start a fork
+	first := headers[0]
+	tipID, tipHash := r.syncTip()
+	if first.ID != tipID+1 || first.Previous != tipHash {
+		r.ChainMutex.RLock()
+		fork, ok := r.Blockchain.HeightOf(first.Previous)
+		r.ChainMutex.RUnlock()
+		if !ok || first.ID != fork+1 {
+			log.Printf("[NODE] headers from %v starting at %v do not connect to our chain\n", conn.RemoteAddr(), first.ID)
+			return
+		}
+		// We follow the longest chain, a full response may still become longer with the next one
+		if last.ID <= tipID && len(headers) < protocol.MAX_HEADERS {
+			log.Printf("[NODE] fork of %v at %v ending at %v is not longer than our chain at %v\n", conn.RemoteAddr(), fork, last.ID, tipID)
+			return
+		}
+		log.Printf("[NODE] following fork of %v at block %v\n", conn.RemoteAddr(), fork)
+		r.Sync.reset()
+	}
+	for _, header := range headers {
+		r.Sync.headers = append(r.Sync.headers, header)
+		r.Sync.hashes[header.Hash()] = header.ID
+	}
+	log.Printf("[NODE] received %v headers from %v, %v blocks to download\n", len(headers), conn.RemoteAddr(), len(r.Sync.headers))
+	// A full response means the peer has more headers for us
+	if len(headers) == protocol.MAX_HEADERS {
+		r.requestHeaders(conn, actions)
+	}
+	r.scheduleBlocks(actions)
+}
+
+// scheduleBlocks requests the blocks within the download window that are neither downloaded nor requested,
+// spreading the batches over the peers that have them. The caller must hold the sync lock
+func (r *Relay) scheduleBlocks(actions *syncActions) {
+	peers := r.PeerManager.Peers()
+	load := make(map[net.Conn]int)
+	for _, b := range r.Sync.batches {
+		load[b.conn]++
+	}
+	headers := r.Sync.headers
+	window := DOWNLOAD_WINDOW
+	// A fork can only be applied once we have every block up to one past our head
+	if len(headers) > 0 {
+		r.ChainMutex.RLock()
+		head := r.Blockchain.Chainstate.LastBlock.ID
+		r.ChainMutex.RUnlock()
+		if head >= headers[0].ID && int(head-headers[0].ID+2) > window {
+			window = int(head - headers[0].ID + 2)
+		}
+	}
+	if len(headers) > window {
+		headers = headers[:window]
+	}
+	items := []protocol.InvItem{}
+	lastID := uint64(0)
+	flush := func() bool {
+		if len(items) == 0 {
+			return true
+		}
+		// Pick the least loaded peer that has the whole batch
+		var conn net.Conn
+		for _, p := range peers {
+			if r.Sync.heights[p.Conn] < lastID || load[p.Conn] >= MAX_BATCHES_PER_PEER {
+				continue
+			}
+			if conn == nil || load[p.Conn] < load[conn] {
+				conn = p.Conn
+			}
+		}
+		if conn == nil {
+			return false
+		}
+		bin, err := json.Marshal(protocol.InvContent{Items: items})
+		if err != nil {
+			log.Println("[NODE] Failed to marshall block request")
+			return false
+		}
+		b := &batch{conn: conn, sent: time.Now(), pending: len(items)}
+		for i := range items {
+			r.Sync.inflight[lastID-uint64(len(items)-1-i)] = b
+		}
+		r.Sync.batches = append(r.Sync.batches, b)
+		load[conn]++
+		actions.send(protocol.Message{Type: protocol.GETDATA, Content: string(bin)}, conn)
+		items = items[:0]
+		return true
+	}
+	for _, header := range headers {
+		if r.Sync.bodies[header.ID] != nil || r.Sync.inflight[header.ID] != nil {
+			// Batches only cover consecutive blocks
+			if !flush() {
+				return
+			}
+			continue
+		}
+		items = append(items, protocol.InvItem{Type: protocol.INV_BLOCK, Hash: header.Hash()})
+		lastID = header.ID
+		if len(items) == MAX_BLOCKS_PER_REQUEST && !flush() {
+			return
+		}
+	}
+	flush()
+}
+
+// deliverBlock hands a block we requested during sync to the syncer and reports whether it was one
+func (r *Relay) deliverBlock(block model.Block, conn net.Conn) bool {
+	r.Sync.mutex.Lock()
+	hash := block.GetHash()
+	id, ok := r.Sync.hashes[hash]
+	if !ok {
+		r.Sync.mutex.Unlock()
+		return false
+	}
+	// The header committed to the body through the TxRoot
+	if block.Hash != hash || block.ID != id || block.ComputeTxRoot() != block.TxRoot {
+		r.Sync.mutex.Unlock()
+		r.misbehave(conn, SCORE_INVALID_BLOCK, "a block that does not match its header")
+		return true
+	}
+	if b := r.Sync.inflight[id]; b != nil {
+		delete(r.Sync.inflight, id)
+		b.pending--
+		if b.pending == 0 {
+			r.Sync.expire(func(other *batch) bool { return other == b })
+		}
+	}
+	r.Sync.bodies[id] = &download{block: block, conn: conn}
+	r.Sync.mutex.Unlock()
+	r.applyBlocks()
+	return true
+}
+
+// applyBlocks processes the downloaded blocks that follow our head and requests the next ones. A single
+// goroutine applies blocks at a time, the sync lock is released while it processes them
+func (r *Relay) applyBlocks() {
+	actions := &syncActions{}
+	defer r.run(actions)
+	r.Sync.mutex.Lock()
+	defer r.Sync.mutex.Unlock()
+	if r.Sync.applying {
+		// The running loop picks up our blocks, it checks for more under the lock before it stops
+		return
+	}
+	r.Sync.applying = true
+	defer func() { r.Sync.applying = false }()
+	applied := 0
+	for len(r.Sync.headers) > 0 {
+		blocks, conn, fork := r.nextBlocks()
+		if len(blocks) == 0 {
+			break
+		}
+		generation := r.Sync.generation
+		r.Sync.mutex.Unlock()
+		accepted, invalid := r.applyDownloaded(blocks, fork)
+		r.Sync.mutex.Lock()
+		// The pending headers were replaced while we processed the blocks, the new ones decide what follows
+		if r.Sync.generation != generation {
+			continue
+		}
+		if !accepted {
+			if invalid {
+				actions.misbehave(conn, SCORE_INVALID_BLOCK, "an invalid block")
+			}
+			r.Sync.reset()
+			break
+		}
+		for _, block := range blocks {
+			delete(r.Sync.bodies, block.ID)
+			delete(r.Sync.hashes, block.Hash)
+		}
+		r.Sync.headers = r.Sync.headers[len(blocks):]
+		applied += len(blocks)
+	}
+	r.scheduleBlocks(actions)
+	if applied == 0 {
+		return
+	}
+	log.Printf("[NODE] applied %v synced blocks, %v left\n", applied, len(r.Sync.headers))
+	// Let our peers know about our new head once we caught up
+	if len(r.Sync.headers) == 0 && !r.Local {
+		r.ChainMutex.RLock()
+		head := r.Blockchain.Chainstate.LastBlock
+		r.ChainMutex.RUnlock()
+		go r.BroadcastBlock(head)
+	}
+}
+
+// nextBlocks returns the downloaded blocks to apply next, the peer that sent the last of them and whether they
+// fork off our chain. A fork is only returned once we have the bodies of all blocks up to one past our head,
+// so switching makes our chain longer. The caller must hold the sync lock
+func (r *Relay) nextBlocks() ([]model.Block, net.Conn, bool) {
+	header := r.Sync.headers[0]
+	r.ChainMutex.RLock()
+	head := r.Blockchain.Chainstate.LastBlock
+	r.ChainMutex.RUnlock()
+	if header.Previous == head.Hash || header.ID > head.ID {
+		body := r.Sync.bodies[header.ID]
+		if body == nil {
+			return nil, nil, false
+		}
+		return []model.Block{body.block}, body.conn, false
+	}
+	blocks := []model.Block{}
+	var conn net.Conn
+	for _, header := range r.Sync.headers {
+		body := r.Sync.bodies[header.ID]
+		if body == nil {
+			return nil, nil, false
+		}
+		blocks = append(blocks, body.block)
+		conn = body.conn
+		if header.ID > head.ID {
+			break
+		}
+	}
+	if blocks[len(blocks)-1].ID <= head.ID {
+		// Our chain grew past the fork while we were downloading it
+		log.Println("[NODE] fork is no longer longer than our chain, dropping it")
+		r.Sync.reset()
+		return nil, nil, false
+	}
+	return blocks, conn, true
+}
+
+// applyDownloaded processes blocks following our head or switches to the fork they form. It reports whether
+// the blocks were accepted and, if not, whether they break the rules rather than being stale. The caller must
+// not hold the sync lock
+func (r *Relay) applyDownloaded(blocks []model.Block, fork bool) (bool, bool) {
+	if !fork {
+		res := r.newBlock(blocks[0])
+		if res == blockchain.B_ACCEPT {
+			return true, false
+		}
+		log.Printf("[NODE] synced block id=%v rejected with reason=%v\n", blocks[0].ID, res)
+		// If our head moved in the meantime the headers are stale, otherwise the block breaks the rules
+		return false, res != blockchain.B_REJECT_HASH_INTEG && res != blockchain.B_REJECT_ID_INTEG
+	}
+	forkPoint := blocks[0].ID - 1
+	res, err := r.reorganize(forkPoint, blocks)
+	if err != nil {
+		log.Printf("[NODE] could not switch to fork at %v with error %v\n", forkPoint, err)
+		return false, false
+	}
+	return res == blockchain.B_ACCEPT, res != blockchain.B_ACCEPT
+}
+
+// SyncBlocks regularly requests stalled batches from other peers and asks peers that are ahead of us for headers
+func (r *Relay) SyncBlocks() {
+	for {
+		time.Sleep(SYNC_INTERVAL)
+		actions := &syncActions{}
+		r.Sync.mutex.Lock()
+		now := time.Now()
+		r.Sync.expire(func(b *batch) bool {
+			if now.Sub(b.sent) < BLOCK_TIMEOUT {
+				return false
+			}
+			log.Printf("[NODE] peer %v did not deliver %v blocks in time\n", b.conn.RemoteAddr(), b.pending)
+			return true
+		})
+		if r.Sync.headerPeer != nil && now.Sub(r.Sync.headerSent) >= HEADERS_TIMEOUT {
+			r.Sync.headerPeer = nil
+		}
+		// Ask the peer with the best chain for headers if it is ahead of what we know
+		if r.Sync.headerPeer == nil {
+			tipID, _ := r.syncTip()
+			var best net.Conn
+			for conn, height := range r.Sync.heights {
+				if height > tipID && (best == nil || height > r.Sync.heights[best]) {
+					best = conn
+				}
+			}
+			if best != nil {
+				r.requestHeaders(best, actions)
+			}
+		}
+		r.scheduleBlocks(actions)
+		r.Sync.mutex.Unlock()
+		r.run(actions)
+	}
+}
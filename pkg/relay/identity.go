@@ -0,0 +1,101 @@
+package relay
+
+import (
+	"coins/pkg/fsutil"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// IDENTITY_FILE is where a node keeps its identity key, next to its wallet.json
+const IDENTITY_FILE = "identity.json"
+
+// Identity is the key a node authenticates its peer connections with, it is independent of the wallet
+type Identity struct {
+	Key ed25519.PrivateKey
+}
+
+// ID returns the identity the peers of the node see, the hex encoded public key
+func (id *Identity) ID() string {
+	return IdentityID(id.Key.Public().(ed25519.PublicKey))
+}
+
+func IdentityID(pub ed25519.PublicKey) string {
+	return hex.EncodeToString(pub)
+}
+
+// OpenIdentity reads the identity at the path, a new identity is generated and written there if there is none
+func OpenIdentity(path string) (*Identity, error) {
+	bin, err := ioutil.ReadFile(path)
+	if err == nil {
+		var id Identity
+		err = json.Unmarshal(bin, &id)
+		if err != nil {
+			return nil, fmt.Errorf("could not deserialize identity with error %v", err)
+		}
+		if len(id.Key) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("identity key has an invalid size of %v bytes", len(id.Key))
+		}
+		return &id, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read identity with error %v", err)
+	}
+	// Generate a new key
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate identity key with error %v", err)
+	}
+	id := Identity{Key: key}
+	bin, err = json.Marshal(id)
+	if err != nil {
+		return nil, fmt.Errorf("could not serialize identity with error %v", err)
+	}
+	err = fsutil.WriteFileAtomic(path, bin, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("could not write identity to file with error %v", err)
+	}
+	return &id, nil
+}
+
+// Allowlist holds the node identities that may connect to us, a nil allowlist allows every node
+type Allowlist struct {
+	ids map[string]bool
+}
+
+// ReadAllowlist reads a file containing a json array of node identities
+func ReadAllowlist(path string) (*Allowlist, error) {
+	bin, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read allowlist with error %v", err)
+	}
+	var ids []string
+	err = json.Unmarshal(bin, &ids)
+	if err != nil {
+		return nil, fmt.Errorf("could not deserialize allowlist with error %v", err)
+	}
+	al := &Allowlist{ids: make(map[string]bool)}
+	for _, id := range ids {
+		al.ids[id] = true
+	}
+	return al, nil
+}
+
+func (al *Allowlist) Allowed(id string) bool {
+	if al == nil {
+		return true
+	}
+	return al.ids[id]
+}
+
+// Len returns the amount of identities on the allowlist
+func (al *Allowlist) Len() int {
+	if al == nil {
+		return 0
+	}
+	return len(al.ids)
+}
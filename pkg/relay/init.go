@@ -0,0 +1,94 @@
+package relay
+
+import (
+	"coins/pkg/blockchain"
+	"coins/pkg/protocol"
+	"encoding/json"
+	"log"
+	"net"
+)
+
+// DefaultSafetyValue is the amount of blocks we request with the chainstate when bootstrapping
+const DefaultSafetyValue = byte(blockchain.MinPruneDepth)
+
+// RequestInitOrNop asks the peer for its chainstate and most recent blocks if we have no chain yet
+func (r *Relay) RequestInitOrNop(conn net.Conn) {
+	r.ChainMutex.RLock()
+	empty := len(r.Blockchain.Blocks) == 0
+	r.ChainMutex.RUnlock()
+	if !empty {
+		return
+	}
+	// Request as many blocks as we would keep, within what the protocol can express
+	safety := DefaultSafetyValue
+	if r.PruneDepth > uint64(safety) && r.PruneDepth <= 255 {
+		safety = byte(r.PruneDepth)
+	}
+	bin, err := json.Marshal(protocol.InitContent{SafetyValue: safety})
+	if err != nil {
+		log.Println("[NODE] failed to build init request")
+		return
+	}
+	log.Printf("[NODE] bootstrapping from peer %v\n", conn.RemoteAddr())
+	r.send(protocol.Message{Type: protocol.INIT, Content: string(bin)}, conn)
+}
+
+// handleInit responds with our chainstate and the last SafetyValue blocks leading up to it
+func (r *Relay) handleInit(content string, conn net.Conn) {
+	var req protocol.InitContent
+	err := json.Unmarshal([]byte(content), &req)
+	if err != nil {
+		log.Println("[NODE] Failed to unmarshall init request")
+		r.misbehave(conn, SCORE_MALFORMED, "a malformed message")
+		return
+	}
+	// Serialize while we hold the lock, the chainstate shares its wallets with our chain
+	r.ChainMutex.RLock()
+	blocks := r.Blockchain.Blocks
+	if len(blocks) > int(req.SafetyValue) {
+		blocks = blocks[len(blocks)-int(req.SafetyValue):]
+	}
+	bin, err := json.Marshal(protocol.InitBlocksContent{Chainstate: &r.Blockchain.Chainstate, Blocks: blocks})
+	r.ChainMutex.RUnlock()
+	if err != nil {
+		log.Println("[NODE] Failed to marshall init response")
+		return
+	}
+	if len(blocks) == 0 {
+		log.Printf("[NODE] cannot bootstrap %v from an empty chain\n", conn.RemoteAddr())
+		return
+	}
+	log.Printf("[NODE] sending chainstate and %v blocks to %v\n", len(blocks), conn.RemoteAddr())
+	r.send(protocol.Message{Type: protocol.INIT_BLOCKS, Content: string(bin)}, conn)
+}
+
+// handleInitBlocks verifies a bootstrap response and adopts it if we still have no chain
+func (r *Relay) handleInitBlocks(content string, conn net.Conn) {
+	var res protocol.InitBlocksContent
+	err := json.Unmarshal([]byte(content), &res)
+	if err != nil || res.Chainstate == nil {
+		log.Println("[NODE] Failed to unmarshall init response")
+		r.misbehave(conn, SCORE_MALFORMED, "a malformed message")
+		return
+	}
+	chain, err := blockchain.Bootstrap(*res.Chainstate, res.Blocks)
+	if err != nil {
+		log.Printf("[NODE] rejecting bootstrap from %v with error %v\n", conn.RemoteAddr(), err)
+		r.misbehave(conn, SCORE_BAD_BOOTSTRAP, "an invalid bootstrap")
+		return
+	}
+	r.ChainMutex.Lock()
+	// Another peer may have been faster
+	if len(r.Blockchain.Blocks) > 0 {
+		r.ChainMutex.Unlock()
+		return
+	}
+	r.Blockchain = *chain
+	head := r.Blockchain.Chainstate.LastBlock
+	events := r.walletEvents(head)
+	r.ChainMutex.Unlock()
+	log.Printf("[NODE] bootstrapped from %v at block id=%v\n", conn.RemoteAddr(), head.ID)
+	// Notify our subscribers and restart our miner on top of the new head
+	r.emitBlock(head, events)
+	r.RestartMining()
+}
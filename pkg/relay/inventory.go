@@ -0,0 +1,222 @@
+package relay
+
+import (
+	"coins/pkg/model"
+	"coins/pkg/protocol"
+	"encoding/json"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// SEEN_CACHE_SIZE is the amount of items a relay remembers having received
+const SEEN_CACHE_SIZE = 20000
+
+// KNOWN_CACHE_SIZE is the amount of items a relay remembers a single peer knowing about
+const KNOWN_CACHE_SIZE = 5000
+
+// GETDATA_TIMEOUT is how long we wait for a requested item before asking another peer for it
+const GETDATA_TIMEOUT = time.Second * 30
+
+// InvCache is a bounded set of inventory items, once full the oldest items are forgotten first
+type InvCache struct {
+	mutex *sync.Mutex
+	size  int
+	items map[string]bool
+	order []string
+	next  int
+}
+
+func NewInvCache(size int) *InvCache {
+	return &InvCache{mutex: &sync.Mutex{}, size: size, items: make(map[string]bool), order: make([]string, 0, size)}
+}
+
+// Add inserts the item and reports whether it was new
+func (ic *InvCache) Add(item protocol.InvItem) bool {
+	key := item.String()
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	if ic.items[key] {
+		return false
+	}
+	// Overwrite the oldest item once the cache is full
+	if len(ic.order) < ic.size {
+		ic.order = append(ic.order, key)
+	} else {
+		delete(ic.items, ic.order[ic.next])
+		ic.order[ic.next] = key
+		ic.next = (ic.next + 1) % ic.size
+	}
+	ic.items[key] = true
+	return true
+}
+
+func (ic *InvCache) Has(item protocol.InvItem) bool {
+	ic.mutex.Lock()
+	defer ic.mutex.Unlock()
+	return ic.items[item.String()]
+}
+
+// Requests tracks the items we asked peers for, so each item is only downloaded once
+type Requests struct {
+	mutex    *sync.Mutex
+	requests map[string]time.Time
+}
+
+func NewRequests() *Requests {
+	return &Requests{mutex: &sync.Mutex{}, requests: make(map[string]time.Time)}
+}
+
+// Request reports whether the item should be requested, which it should unless a request is already pending
+func (rq *Requests) Request(item protocol.InvItem) bool {
+	key := item.String()
+	rq.mutex.Lock()
+	defer rq.mutex.Unlock()
+	now := time.Now()
+	if requested, ok := rq.requests[key]; ok && now.Sub(requested) < GETDATA_TIMEOUT {
+		return false
+	}
+	// Forget requests that timed out while we are at it
+	for k, requested := range rq.requests {
+		if now.Sub(requested) >= GETDATA_TIMEOUT {
+			delete(rq.requests, k)
+		}
+	}
+	rq.requests[key] = now
+	return true
+}
+
+// Done marks the request for the item as answered
+func (rq *Requests) Done(item protocol.InvItem) {
+	rq.mutex.Lock()
+	defer rq.mutex.Unlock()
+	delete(rq.requests, item.String())
+}
+
+func blockInv(block model.Block) protocol.InvItem {
+	return protocol.InvItem{Type: protocol.INV_BLOCK, Hash: block.Hash}
+}
+
+func txInv(tx model.Transaction) protocol.InvItem {
+	return protocol.InvItem{Type: protocol.INV_TX, Hash: tx.Hash}
+}
+
+func rxInv(rx model.Registration) protocol.InvItem {
+	return protocol.InvItem{Type: protocol.INV_RX, Hash: rx.GetHash()}
+}
+
+// announce sends an INV for the item to every peer that does not know it yet
+func (r *Relay) announce(item protocol.InvItem) {
+	r.Seen.Add(item)
+	bin, err := json.Marshal(protocol.InvContent{Items: []protocol.InvItem{item}})
+	if err != nil {
+		log.Println("[NODE] Could not announce item because serialization of the inventory failed")
+		return
+	}
+	frame, err := protocol.EncodeMessage(protocol.Message{Type: protocol.INV, Content: string(bin)})
+	if err != nil {
+		log.Println("[NODE] Could not announce item because serialization of the message failed")
+		return
+	}
+	// Peers we got the item from or announced it to already know it
+	sent := r.PeerManager.Broadcast(frame, func(p *Peer) bool { return p.MarkKnown(item) })
+	log.Printf("[NODE] INV %v sent to %v peers\n", item, sent)
+}
+
+// delivered records that the peer sent us the item, without marking it as seen so an invalid copy does not keep
+// us from taking a valid one
+func (r *Relay) delivered(conn net.Conn, item protocol.InvItem) {
+	if p := r.PeerManager.Get(conn); p != nil {
+		p.MarkKnown(item)
+	}
+	r.Requests.Done(item)
+}
+
+// received records that the peer sent us the item and reports whether we saw it for the first time
+func (r *Relay) received(conn net.Conn, item protocol.InvItem) bool {
+	r.delivered(conn, item)
+	return r.Seen.Add(item)
+}
+
+// handleInv requests the announced items we have not seen yet
+func (r *Relay) handleInv(content string, conn net.Conn) {
+	var req protocol.InvContent
+	err := json.Unmarshal([]byte(content), &req)
+	if err != nil || len(req.Items) > protocol.MAX_INV_ITEMS {
+		log.Println("[NODE] Failed to unmarshall inventory")
+		r.misbehave(conn, SCORE_MALFORMED, "a malformed message")
+		return
+	}
+	p := r.PeerManager.Get(conn)
+	wanted := []protocol.InvItem{}
+	for _, item := range req.Items {
+		if p != nil {
+			p.MarkKnown(item)
+		}
+		if r.Seen.Has(item) || !r.Requests.Request(item) {
+			continue
+		}
+		wanted = append(wanted, item)
+	}
+	if len(wanted) == 0 {
+		return
+	}
+	bin, err := json.Marshal(protocol.InvContent{Items: wanted})
+	if err != nil {
+		log.Println("[NODE] Failed to marshall data request")
+		return
+	}
+	r.send(protocol.Message{Type: protocol.GETDATA, Content: string(bin)}, conn)
+}
+
+// handleGetData sends the requested items we have, items we dont have are skipped
+func (r *Relay) handleGetData(content string, conn net.Conn) {
+	var req protocol.InvContent
+	err := json.Unmarshal([]byte(content), &req)
+	if err != nil || len(req.Items) > protocol.MAX_INV_ITEMS {
+		log.Println("[NODE] Failed to unmarshall data request")
+		r.misbehave(conn, SCORE_MALFORMED, "a malformed message")
+		return
+	}
+	for _, item := range req.Items {
+		var payload interface{}
+		var t protocol.MessageType
+		switch item.Type {
+		case protocol.INV_BLOCK:
+			r.ChainMutex.RLock()
+			block := r.Blockchain.GetBlockByHash(item.Hash)
+			r.ChainMutex.RUnlock()
+			if block != nil {
+				payload, t = block, protocol.NEW_BLOCK
+			}
+		case protocol.INV_TX:
+			r.ChainMutex.RLock()
+			for _, tx := range r.FloatingTx {
+				if tx.Hash == item.Hash {
+					payload, t = tx, protocol.NEW_TX
+					break
+				}
+			}
+			r.ChainMutex.RUnlock()
+		case protocol.INV_RX:
+			r.ChainMutex.RLock()
+			for _, rx := range r.FloatingRx {
+				if rx.GetHash() == item.Hash {
+					payload, t = rx, protocol.NEW_RX
+					break
+				}
+			}
+			r.ChainMutex.RUnlock()
+		}
+		if payload == nil {
+			continue
+		}
+		bin, err := json.Marshal(payload)
+		if err != nil {
+			log.Println("[NODE] Failed to marshall requested item")
+			continue
+		}
+		r.send(protocol.Message{Type: t, Content: string(bin)}, conn)
+	}
+}
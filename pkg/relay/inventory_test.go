@@ -0,0 +1,81 @@
+package relay
+
+import (
+	"coins/pkg/blockchain"
+	"coins/pkg/model"
+	"encoding/json"
+	"net"
+	"testing"
+)
+
+func TestHandleNewRx(t *testing.T) {
+	wallet, err := blockchain.NewWallet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := blockchain.KeyToString(&wallet.KP.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := model.Registration{Wallet: wallet.Address, PublicKey: key}
+	tests := []struct {
+		name     string
+		rx       model.Registration
+		accepted bool
+	}{
+		{name: "valid registration", rx: valid, accepted: true},
+		{name: "missing wallet", rx: model.Registration{PublicKey: key}},
+		{name: "invalid public key", rx: model.Registration{Wallet: wallet.Address, PublicKey: "key"}},
+		{name: "registered wallet", rx: model.Registration{Wallet: "registered", PublicKey: key}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := newTestRelay(t, nil)
+			r.Blockchain.Chainstate.Wallets["registered"] = &blockchain.WalletInfo{PublicKey: key}
+			floating := len(r.FloatingRx)
+			local, remote := net.Pipe()
+			defer local.Close()
+			defer remote.Close()
+			bin, err := json.Marshal(test.rx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r.handleNewRx(string(bin), local)
+			if r.Seen.Has(rxInv(test.rx)) != test.accepted {
+				t.Fatalf("registration seen=%v, expected %v", r.Seen.Has(rxInv(test.rx)), test.accepted)
+			}
+			if added := len(r.FloatingRx) > floating; added != test.accepted {
+				t.Fatalf("registration added=%v, expected %v", added, test.accepted)
+			}
+			// A rejected registration does not keep the valid one for the same wallet from spreading
+			if !test.accepted && test.rx.Wallet == valid.Wallet {
+				bin, _ := json.Marshal(valid)
+				r.handleNewRx(string(bin), local)
+				if !r.Seen.Has(rxInv(valid)) || len(r.FloatingRx) != floating+1 {
+					t.Fatal("valid registration ignored after a rejected one for the same wallet")
+				}
+			}
+		})
+	}
+}
+
+func TestRxInv(t *testing.T) {
+	a := model.Registration{Wallet: "wallet", PublicKey: "key"}
+	tests := []struct {
+		name string
+		b    model.Registration
+		same bool
+	}{
+		{name: "same registration", b: a, same: true},
+		{name: "other key", b: model.Registration{Wallet: "wallet", PublicKey: "other"}},
+		{name: "other wallet", b: model.Registration{Wallet: "other", PublicKey: "key"}},
+		{name: "shifted fields", b: model.Registration{Wallet: "walletk", PublicKey: "ey"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if (rxInv(a) == rxInv(test.b)) != test.same {
+				t.Fatalf("inventory of %v and %v is the same=%v", a, test.b, !test.same)
+			}
+		})
+	}
+}
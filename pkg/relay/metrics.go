@@ -0,0 +1,49 @@
+package relay
+
+import (
+	"coins/pkg/protocol"
+	"fmt"
+	"sync"
+)
+
+// Reasons a message can be dropped for
+const (
+	DROP_OVERSIZE   = "oversize"   // the payload exceeded the maximum size of its type
+	DROP_CHECKSUM   = "checksum"   // the payload did not match its checksum
+	DROP_RATE_LIMIT = "rate_limit" // the peer exceeded its rate limit for the type
+	DROP_QUEUE_FULL = "queue_full" // all workers were busy and the queue was full
+)
+
+// Metrics counts the messages a relay dropped, keyed by reason and message type
+type Metrics struct {
+	mutex   *sync.Mutex
+	dropped map[string]uint64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{mutex: &sync.Mutex{}, dropped: make(map[string]uint64)}
+}
+
+// Drop records a dropped message
+func (m *Metrics) Drop(reason string, t protocol.MessageType) {
+	if m == nil {
+		return
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.dropped[fmt.Sprintf("%v/%v", reason, t)]++
+}
+
+// Dropped returns a copy of the dropped message counters
+func (m *Metrics) Dropped() map[string]uint64 {
+	dropped := make(map[string]uint64)
+	if m == nil {
+		return dropped
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for key, count := range m.dropped {
+		dropped[key] = count
+	}
+	return dropped
+}
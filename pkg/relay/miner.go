@@ -0,0 +1,328 @@
+package relay
+
+import (
+	"coins/pkg/blockchain"
+	"coins/pkg/model"
+	"coins/pkg/protocol"
+	"context"
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TEMPLATE_RETRY is how long the miner waits before building another block when the last one could not be built
+const TEMPLATE_RETRY = time.Second * 10
+
+// HASHRATE_INTERVAL is how often the miner measures its hashrate
+const HASHRATE_INTERVAL = time.Second * 5
+
+// TEMPLATE_REFRESH is how old a block has to be before new floating entries make the miner build a new one,
+// so a burst of transactions costs a single rebuild
+const TEMPLATE_REFRESH = time.Second
+
+// MAX_TEMPLATE_BYTES is the most bytes of transactions and registrations a mined block carries, it leaves
+// room for the header within the largest block message
+const MAX_TEMPLATE_BYTES = protocol.MAX_BLOCK_SIZE - 4<<10
+
+// Miner controls the mining loop of a relay. A relay without one does not mine
+type Miner struct {
+	Threads      int                // Amount of goroutines searching for a nonce
+	control      *sync.Mutex        // guards starting and stopping the loop
+	cancel       context.CancelFunc // stops the running loop, nil while stopped
+	done         chan struct{}      // closed once the running loop returned
+	restart      chan struct{}      // tells the running loop to mine on top of a changed chain
+	refresh      chan struct{}      // tells the running loop that the floating entries changed
+	hashes       *uint64            // hashes tried since the miner was created, updated atomically
+	mutex        *sync.Mutex        // guards the stats below, the loop updates them
+	hashrate     float64            // hashes per second during the last interval
+	found        uint64             // blocks we mined that extended our chain
+	lastTemplate time.Time          // when the block being mined was built
+	height       uint64             // id of the block being mined
+	difficulty   byte               // difficulty of the block being mined
+}
+
+// MinerStats describes what the miner is doing
+type MinerStats struct {
+	Mining       bool
+	Threads      int       // Amount of goroutines searching for a nonce
+	Hashrate     float64   // Hashes per second, measured every HASHRATE_INTERVAL
+	Hashes       uint64    // Hashes tried since the node started
+	BlocksFound  uint64    // Blocks we mined that extended our chain
+	LastTemplate time.Time // When the block being mined was built
+	Height       uint64    // ID of the block being mined
+	Difficulty   byte      // Leading zero bytes the hash of the block being mined has to have
+}
+
+// NewMiner creates a miner searching on the amount of goroutines, 0 uses one per cpu
+func NewMiner(threads int) *Miner {
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+	return &Miner{Threads: threads, control: &sync.Mutex{}, mutex: &sync.Mutex{}, restart: make(chan struct{}, 1), refresh: make(chan struct{}, 1), hashes: new(uint64)}
+}
+
+// mined is the outcome of mining a single block
+type mined struct {
+	block model.Block
+	found bool
+}
+
+// StartMining starts the mining loop, it returns false if the relay has no miner or it is already running
+func (r *Relay) StartMining() bool {
+	m := r.Miner
+	if m == nil {
+		return false
+	}
+	m.control.Lock()
+	defer m.control.Unlock()
+	if m.cancel != nil {
+		return false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	m.cancel = cancel
+	m.done = done
+	go func() {
+		defer close(done)
+		wg := &sync.WaitGroup{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.measure(ctx)
+		}()
+		r.mineBlocks(ctx, m)
+		wg.Wait()
+	}()
+	log.Println("[MINER] started")
+	return true
+}
+
+// StopMining stops the mining loop and waits until it returned, it returns false if it was not running
+func (r *Relay) StopMining() bool {
+	m := r.Miner
+	if m == nil {
+		return false
+	}
+	m.control.Lock()
+	defer m.control.Unlock()
+	if m.cancel == nil {
+		return false
+	}
+	m.cancel()
+	<-m.done
+	m.cancel = nil
+	m.done = nil
+	log.Println("[MINER] stopped")
+	return true
+}
+
+// RestartMining makes the mining loop drop its block and build a new one on top of the current head. It never
+// blocks and does nothing if the loop is not running
+func (r *Relay) RestartMining() {
+	if r.Miner == nil {
+		return
+	}
+	select {
+	case r.Miner.restart <- struct{}{}:
+	default:
+		// A restart is already pending
+	}
+}
+
+// RefreshTemplate tells the mining loop that the floating entries changed, it builds a new block once the
+// current one is TEMPLATE_REFRESH old. It never blocks and does nothing if the loop is not running
+func (r *Relay) RefreshTemplate() {
+	if r.Miner == nil {
+		return
+	}
+	select {
+	case r.Miner.refresh <- struct{}{}:
+	default:
+		// A refresh is already pending
+	}
+}
+
+// Mining returns whether the mining loop is running
+func (r *Relay) Mining() bool {
+	if r.Miner == nil {
+		return false
+	}
+	r.Miner.control.Lock()
+	defer r.Miner.control.Unlock()
+	return r.Miner.cancel != nil
+}
+
+// MinerStats returns what the miner is doing, a relay without a miner reports that it is not mining
+func (r *Relay) MinerStats() MinerStats {
+	m := r.Miner
+	if m == nil {
+		return MinerStats{}
+	}
+	mining := r.Mining()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return MinerStats{
+		Mining:       mining,
+		Threads:      m.Threads,
+		Hashrate:     m.hashrate,
+		Hashes:       atomic.LoadUint64(m.hashes),
+		BlocksFound:  m.found,
+		LastTemplate: m.lastTemplate,
+		Height:       m.height,
+		Difficulty:   m.difficulty,
+	}
+}
+
+// measure updates the hashrate every HASHRATE_INTERVAL until the context is done
+func (m *Miner) measure(ctx context.Context) {
+	ticker := time.NewTicker(HASHRATE_INTERVAL)
+	defer ticker.Stop()
+	last := atomic.LoadUint64(m.hashes)
+	lastTime := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			m.mutex.Lock()
+			m.hashrate = 0
+			m.mutex.Unlock()
+			return
+		case now := <-ticker.C:
+			hashes := atomic.LoadUint64(m.hashes)
+			m.mutex.Lock()
+			m.hashrate = float64(hashes-last) / now.Sub(lastTime).Seconds()
+			m.mutex.Unlock()
+			last, lastTime = hashes, now
+		}
+	}
+}
+
+// setTemplate records the block the miner started on
+func (m *Miner) setTemplate(block model.Block) {
+	header := block.Header()
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.lastTemplate = time.Now()
+	m.height = block.ID
+	m.difficulty = header.Difficulty()
+}
+
+// addFound counts a block we mined that extended our chain
+func (m *Miner) addFound() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.found++
+}
+
+// mineBlocks mines blocks on top of our head until the context is done
+func (r *Relay) mineBlocks(ctx context.Context, m *Miner) {
+	for {
+		// Changes up to now are part of the block we are about to build
+		select {
+		case <-m.restart:
+		default:
+		}
+		select {
+		case <-m.refresh:
+		default:
+		}
+		newBlock, res := r.BlockTemplate(r.Wallet.Address)
+		if res != blockchain.B_ACCEPT {
+			log.Printf("[MINER] cannot build a block with reason=%v, waiting\n", res)
+			select {
+			case <-ctx.Done():
+				return
+			case <-m.restart:
+			case <-time.After(TEMPLATE_RETRY):
+			}
+			continue
+		}
+		m.setTemplate(newBlock)
+		started := time.Now()
+		// Launch the search, it reports back even when it is stopped
+		blockCtx, cancel := context.WithCancel(ctx)
+		results := make(chan mined, 1)
+		go func() {
+			found := newBlock.Mine(blockCtx, m.Threads, m.hashes)
+			results <- mined{block: newBlock, found: found}
+		}()
+		var result mined
+		var refresh <-chan time.Time
+	wait:
+		for {
+			select {
+			case result = <-results:
+				break wait
+			case <-m.restart:
+				cancel()
+				result = <-results
+				break wait
+			case <-m.refresh:
+				// Rebuild once the block is old enough, later refreshes until then are covered
+				if refresh == nil {
+					refresh = time.After(TEMPLATE_REFRESH - time.Since(started))
+				}
+			case <-refresh:
+				cancel()
+				result = <-results
+				break wait
+			case <-ctx.Done():
+				cancel()
+				<-results
+				return
+			}
+		}
+		cancel()
+		// A block found just before the restart may still extend our head, newBlock decides
+		if result.found && r.SubmitBlock(result.block) == blockchain.B_ACCEPT {
+			log.Printf("[MINER] new block mined id=%v hash=%v\n", result.block.ID, result.block.Hash)
+			m.addFound()
+		}
+	}
+}
+
+// BlockTemplate creates the next block on top of our head from a template of the floating entries, paying the
+// reward to the miner. Only the nonce and the hash are left to find. It fails if the miner has no wallet
+func (r *Relay) BlockTemplate(miner string) (model.Block, blockchain.BLOCK_VALIDATION_RESULT) {
+	r.ChainMutex.RLock()
+	head := r.Blockchain.Chainstate.LastBlock
+	template, res := r.Blockchain.BuildTemplate(miner, r.FloatingTx, r.FloatingRx, MAX_TEMPLATE_BYTES)
+	r.ChainMutex.RUnlock()
+	if res != blockchain.B_ACCEPT {
+		return model.Block{}, res
+	}
+	r.dropStale(template.StaleTx, template.StaleRx)
+	newBlock := model.Block{
+		ID:            head.ID + 1,
+		Nonce:         0,
+		Previous:      head.Hash,
+		Miner:         miner,
+		StateRoot:     template.StateRoot,
+		Transactions:  template.Transactions,
+		Registrations: template.Registrations,
+	}
+	newBlock.TxRoot = newBlock.ComputeTxRoot()
+	return newBlock, blockchain.B_ACCEPT
+}
+
+// SubmitBlock processes a block mined on top of our head and announces it to our peers if it was accepted
+func (r *Relay) SubmitBlock(block model.Block) blockchain.BLOCK_VALIDATION_RESULT {
+	res := r.newBlock(block)
+	if res == blockchain.B_ACCEPT {
+		go r.BroadcastBlock(block)
+	}
+	return res
+}
+
+// dropStale removes the floating entries that can never be included in a block
+func (r *Relay) dropStale(txs []model.Transaction, rxs []model.Registration) {
+	if len(txs) == 0 && len(rxs) == 0 {
+		return
+	}
+	r.ChainMutex.Lock()
+	r.FloatingTx = withoutIncludedTx(r.FloatingTx, txs)
+	r.FloatingRx = withoutIncludedRx(r.FloatingRx, rxs)
+	r.ChainMutex.Unlock()
+	log.Printf("[MINER] dropped %v stale transactions and %v stale registrations\n", len(txs), len(rxs))
+}
@@ -0,0 +1,132 @@
+package relay
+
+import (
+	"coins/pkg/blockchain"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// The relay logs every block it handles
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestRelay creates a relay without peers on a fresh chain, its wallet registers with the first block
+func newTestRelay(t *testing.T, miner *Miner) *Relay {
+	t.Helper()
+	wallet, err := blockchain.NewWallet()
+	if err != nil {
+		t.Fatalf("could not create wallet with error %v", err)
+	}
+	r := &Relay{
+		Blockchain:  *blockchain.NewBlockChain(),
+		Wallet:      *wallet,
+		ChainMutex:  &sync.RWMutex{},
+		PeerManager: NewPeerManager(),
+		Seen:        NewInvCache(SEEN_CACHE_SIZE),
+		Requests:    NewRequests(),
+		Sync:        NewHeaderSync(),
+		Miner:       miner,
+		Local:       true,
+	}
+	r.RegisterOrNop()
+	return r
+}
+
+// headHeight returns the id of the head block of the relay
+func headHeight(r *Relay) uint64 {
+	r.ChainMutex.RLock()
+	defer r.ChainMutex.RUnlock()
+	return r.Blockchain.Chainstate.LastBlock.ID
+}
+
+// waitHeight waits until the chain of the relay reached the height
+func waitHeight(t *testing.T, r *Relay, height uint64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Minute)
+	for headHeight(r) < height {
+		if time.Now().After(deadline) {
+			t.Fatalf("chain is at %v instead of %v", headHeight(r), height)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestStartStopRestartMining(t *testing.T) {
+	r := newTestRelay(t, NewMiner(2))
+	if !r.StartMining() {
+		t.Fatal("could not start the miner")
+	}
+	if r.StartMining() {
+		t.Fatal("started a miner that is already running")
+	}
+	waitHeight(t, r, 2)
+	if !r.StopMining() {
+		t.Fatal("could not stop the running miner")
+	}
+	if r.StopMining() || r.Mining() {
+		t.Fatal("miner still runs after stopping it")
+	}
+	// Nothing is mined once StopMining returned
+	height := headHeight(r)
+	time.Sleep(time.Millisecond * 200)
+	if headHeight(r) != height {
+		t.Fatalf("chain grew from %v to %v after stopping the miner", height, headHeight(r))
+	}
+	stats := r.MinerStats()
+	if stats.Mining || stats.Hashrate != 0 || stats.BlocksFound != height || stats.Threads != 2 {
+		t.Fatalf("unexpected stats of a stopped miner %+v at height %v", stats, height)
+	}
+	// A stopped miner does not block on restarts and refreshes
+	for i := 0; i < 3; i++ {
+		r.RestartMining()
+		r.RefreshTemplate()
+	}
+	if !r.StartMining() {
+		t.Fatal("could not start the miner again")
+	}
+	waitHeight(t, r, height+2)
+	r.StopMining()
+}
+
+func TestRestartMiningOnNewHead(t *testing.T) {
+	r := newTestRelay(t, NewMiner(1))
+	r.StartMining()
+	defer r.StopMining()
+	waitHeight(t, r, 1)
+	// Blocks from elsewhere move our head while the miner runs, it has to continue on top of them
+	for i := 0; i < 3; i++ {
+		block, res := r.BlockTemplate(r.Wallet.Address)
+		if res != blockchain.B_ACCEPT {
+			t.Fatalf("could not build a block with reason=%v", res)
+		}
+		if !block.Mine(context.Background(), 1, nil) {
+			t.Fatal("could not mine a block")
+		}
+		// The miner may have extended the head in the meantime
+		res = r.SubmitBlock(block)
+		if res != blockchain.B_ACCEPT && res != blockchain.B_REJECT_HASH_INTEG && res != blockchain.B_REJECT_ID_INTEG {
+			t.Fatalf("submitted block rejected with reason=%v", res)
+		}
+		r.RestartMining()
+	}
+	waitHeight(t, r, headHeight(r)+2)
+}
+
+func TestRelayWithoutMiner(t *testing.T) {
+	r := newTestRelay(t, nil)
+	if r.StartMining() || r.StopMining() || r.Mining() {
+		t.Fatal("relay without a miner reports a running miner")
+	}
+	r.RestartMining()
+	r.RefreshTemplate()
+	if stats := r.MinerStats(); stats != (MinerStats{}) {
+		t.Fatalf("relay without a miner reports stats %+v", stats)
+	}
+}
@@ -0,0 +1,47 @@
+package relay
+
+import (
+	"log"
+	"net"
+)
+
+// Misbehavior scores, a peer is banned once its score reaches BAN_THRESHOLD
+const (
+	SCORE_MALFORMED       = 10  // a message that could not be decoded
+	SCORE_RATE_LIMIT      = 1   // a message beyond the rate limit of the peer
+	SCORE_BAD_SIGNATURE   = 20  // a transaction with an invalid signature
+	SCORE_INVALID_BLOCK   = 100 // a block extending our head that breaks the consensus rules
+	SCORE_INVALID_HEADERS = 100 // headers that do not link or lack the work their hash claims
+	SCORE_OVERSIZE        = 100 // a message exceeding the maximum size of its type
+	SCORE_BAD_BOOTSTRAP   = 100 // a chainstate that does not match the blocks sent with it
+)
+
+// misbehave penalizes the peer behind the connection and disconnects it when it gets banned
+func (r *Relay) misbehave(conn net.Conn, score int, reason string) {
+	if r.Bans == nil {
+		return
+	}
+	host := Host(conn.RemoteAddr().String())
+	banned, err := r.Bans.Penalize(host, score)
+	if err != nil {
+		log.Printf("[NODE] could not persist ban of %v with error %v\n", host, err)
+	}
+	if banned {
+		log.Printf("[NODE] banned peer %v for %v\n", host, reason)
+		// The connection may still be in its handshake, so it is not necessarily one of our peers
+		conn.Close()
+		r.DisconnectHost(host)
+	}
+}
+
+// DisconnectHost closes every connection to the host, a banned peer keeps no connection open in either direction
+func (r *Relay) DisconnectHost(host string) int {
+	closed := 0
+	for _, p := range r.PeerManager.Peers() {
+		if Host(p.Conn.RemoteAddr().String()) == host {
+			r.PeerManager.Remove(p)
+			closed++
+		}
+	}
+	return closed
+}
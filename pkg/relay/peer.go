@@ -0,0 +1,146 @@
+package relay
+
+import (
+	"coins/pkg/protocol"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+type PEER_DIRECTION string
+
+const (
+	PEER_INBOUND  = PEER_DIRECTION("inbound")  // the peer connected to us
+	PEER_OUTBOUND = PEER_DIRECTION("outbound") // we connected to the peer
+)
+
+type PEER_STATE string
+
+const (
+	PEER_HANDSHAKE = PEER_STATE("handshake") // the connection is open but the peer did not introduce itself yet
+	PEER_ACTIVE    = PEER_STATE("active")    // the handshake completed, the peer receives our broadcasts
+	PEER_CLOSED    = PEER_STATE("closed")    // the connection is closed
+)
+
+// SEND_QUEUE is the amount of frames that may wait to be written to a peer
+const SEND_QUEUE = 256
+
+// WRITE_TIMEOUT is how long writing a single frame to a peer may take
+const WRITE_TIMEOUT = time.Second * 30
+
+// Peer is a connection to another relay, no matter which side opened it
+type Peer struct {
+	Conn      net.Conn
+	Addr      string // The address we dialed for outbound peers, the remote address for inbound ones
+	Direction PEER_DIRECTION
+	Identity  string                   // The identity the peer authenticated with, empty on plaintext connections
+	Version   *protocol.VersionContent // What the peer told us about itself in the handshake
+	Connected time.Time
+	mutex     *sync.Mutex
+	state     PEER_STATE
+	queue     chan []byte
+	done      chan struct{}
+	known     *InvCache
+}
+
+func NewPeer(conn net.Conn, addr string, direction PEER_DIRECTION) *Peer {
+	return &Peer{
+		Conn:      conn,
+		Addr:      addr,
+		Direction: direction,
+		Identity:  PeerIdentity(conn),
+		Connected: time.Now(),
+		mutex:     &sync.Mutex{},
+		state:     PEER_HANDSHAKE,
+		queue:     make(chan []byte, SEND_QUEUE),
+		done:      make(chan struct{}),
+		known:     NewInvCache(KNOWN_CACHE_SIZE),
+	}
+}
+
+// MarkKnown records that the peer knows the item and reports whether it did not know it before
+func (p *Peer) MarkKnown(item protocol.InvItem) bool {
+	return p.known.Add(item)
+}
+
+func (p *Peer) State() PEER_STATE {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.state
+}
+
+// activate marks the handshake as complete and starts writing queued frames to the peer
+func (p *Peer) activate(version *protocol.VersionContent) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.state != PEER_HANDSHAKE {
+		return
+	}
+	p.Version = version
+	p.state = PEER_ACTIVE
+	go p.write()
+}
+
+// Send queues the frame for the peer. A peer that cannot keep up with its queue is disconnected
+func (p *Peer) Send(frame []byte) {
+	if p.State() != PEER_ACTIVE {
+		return
+	}
+	select {
+	case p.queue <- frame:
+	default:
+		log.Printf("[NODE] disconnecting peer %v because it does not keep up with our messages\n", p.Addr)
+		p.Close()
+	}
+}
+
+// Reply queues a response for the peer. Unlike a broadcast a response cannot be dropped, so it waits up to
+// WRITE_TIMEOUT for room in the queue and disconnects a peer that does not read its responses
+func (p *Peer) Reply(frame []byte) bool {
+	if p.State() != PEER_ACTIVE {
+		return false
+	}
+	timer := time.NewTimer(WRITE_TIMEOUT)
+	defer timer.Stop()
+	select {
+	case p.queue <- frame:
+		return true
+	case <-p.done:
+		return false
+	case <-timer.C:
+		log.Printf("[NODE] disconnecting peer %v because it does not read our responses\n", p.Addr)
+		p.Close()
+		return false
+	}
+}
+
+// Close closes the connection, it is safe to call more than once
+func (p *Peer) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.state == PEER_CLOSED {
+		return
+	}
+	p.state = PEER_CLOSED
+	close(p.done)
+	p.Conn.Close()
+}
+
+// write sends the queued frames until the peer is closed
+func (p *Peer) write() {
+	for {
+		select {
+		case frame := <-p.queue:
+			p.Conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+			_, err := p.Conn.Write(frame)
+			if err != nil {
+				log.Printf("[NODE] could not write to peer %v with error %v\n", p.Addr, err)
+				p.Close()
+				return
+			}
+		case <-p.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package relay
+
+import (
+	"coins/pkg/protocol"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSend(t *testing.T) {
+	msgs := []protocol.Message{
+		{Type: protocol.GETADDR},
+		{Type: protocol.GETHEADERS, Content: "abc"},
+		{Type: protocol.ADDR, Content: "[]"},
+	}
+	r := newTestRelay(t, nil)
+	local, remote := net.Pipe()
+	defer remote.Close()
+	p := NewPeer(local, "peer", PEER_OUTBOUND)
+	// Messages for a connection that is not a peer are dropped instead of written
+	r.send(msgs[0], local)
+	p.activate(&protocol.VersionContent{})
+	r.PeerManager.Add(p)
+	defer p.Close()
+	for _, msg := range msgs {
+		r.send(msg, local)
+	}
+	for _, want := range msgs {
+		got, err := protocol.ReadMessage(remote)
+		if err != nil {
+			t.Fatalf("could not read message with error %v", err)
+		}
+		if got.Type != want.Type || got.Content != want.Content {
+			t.Fatalf("got %v instead of %v", got, want)
+		}
+	}
+}
+
+func TestReply(t *testing.T) {
+	t.Run("inactive peer", func(t *testing.T) {
+		local, remote := net.Pipe()
+		defer remote.Close()
+		p := NewPeer(local, "peer", PEER_INBOUND)
+		if p.Reply([]byte("frame")) {
+			t.Fatal("queued a reply before the handshake")
+		}
+		p.Close()
+		if p.Reply([]byte("frame")) {
+			t.Fatal("queued a reply for a closed peer")
+		}
+	})
+	t.Run("closed while waiting", func(t *testing.T) {
+		local, remote := net.Pipe()
+		defer remote.Close()
+		p := NewPeer(local, "peer", PEER_INBOUND)
+		// Without a writer nothing drains the queue
+		p.state = PEER_ACTIVE
+		for i := 0; i < SEND_QUEUE; i++ {
+			p.Send([]byte("frame"))
+		}
+		if p.State() != PEER_ACTIVE {
+			t.Fatal("peer closed before its queue was full")
+		}
+		done := make(chan bool)
+		go func() {
+			done <- p.Reply([]byte("reply"))
+		}()
+		select {
+		case <-done:
+			t.Fatal("reply returned while the queue was full")
+		case <-time.After(time.Millisecond * 50):
+		}
+		p.Close()
+		select {
+		case ok := <-done:
+			if ok {
+				t.Fatal("queued a reply for a closed peer")
+			}
+		case <-time.After(time.Second):
+			t.Fatal("reply still waits after the peer closed")
+		}
+	})
+}
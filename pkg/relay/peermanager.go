@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"net"
+	"sync"
+)
+
+// PeerManager keeps track of the active peers in both directions, every broadcast goes through it
+type PeerManager struct {
+	mutex *sync.Mutex
+	peers map[net.Conn]*Peer
+}
+
+func NewPeerManager() *PeerManager {
+	return &PeerManager{mutex: &sync.Mutex{}, peers: make(map[net.Conn]*Peer)}
+}
+
+// Add registers a peer that completed its handshake
+func (pm *PeerManager) Add(p *Peer) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	pm.peers[p.Conn] = p
+}
+
+// Remove unregisters the peer and closes its connection
+func (pm *PeerManager) Remove(p *Peer) {
+	pm.mutex.Lock()
+	delete(pm.peers, p.Conn)
+	pm.mutex.Unlock()
+	p.Close()
+}
+
+// Get returns the peer behind the connection
+func (pm *PeerManager) Get(conn net.Conn) *Peer {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	return pm.peers[conn]
+}
+
+// Peers returns the active peers
+func (pm *PeerManager) Peers() []*Peer {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	peers := make([]*Peer, 0, len(pm.peers))
+	for _, p := range pm.peers {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// Count returns the amount of active peers in the direction
+func (pm *PeerManager) Count(direction PEER_DIRECTION) int {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	count := 0
+	for _, p := range pm.peers {
+		if p.Direction == direction {
+			count++
+		}
+	}
+	return count
+}
+
+// Broadcast queues the frame for every active peer the filter includes, a nil filter includes every peer
+func (pm *PeerManager) Broadcast(frame []byte, include func(p *Peer) bool) int {
+	sent := 0
+	for _, p := range pm.Peers() {
+		if include != nil && !include(p) {
+			continue
+		}
+		p.Send(frame)
+		sent++
+	}
+	return sent
+}
@@ -0,0 +1,72 @@
+package relay
+
+import (
+	"coins/pkg/protocol"
+	"sync"
+	"time"
+)
+
+// TokenBucket allows bursts of up to Capacity events and refills at Rate tokens per second
+type TokenBucket struct {
+	mutex    *sync.Mutex
+	capacity float64
+	rate     float64
+	tokens   float64
+	last     time.Time
+}
+
+func NewTokenBucket(rate float64, capacity float64) *TokenBucket {
+	return &TokenBucket{mutex: &sync.Mutex{}, capacity: capacity, rate: rate, tokens: capacity, last: time.Now()}
+}
+
+// Allow takes a token from the bucket if there is one
+func (tb *TokenBucket) Allow() bool {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+	// Refill for the time that passed since the last call
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.capacity {
+		tb.tokens = tb.capacity
+	}
+	tb.last = now
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// rateLimits are the rate and burst each peer gets for the message types that are cheap to send but expensive to handle
+var rateLimits = map[protocol.MessageType][2]float64{
+	protocol.NEW_TX:     {50, 200},
+	protocol.NEW_RX:     {10, 50},
+	protocol.GETHEADERS: {1, 10},
+	protocol.GETADDR:    {0.1, 2},
+	protocol.ADDR:       {0.1, 5},
+	protocol.INV:        {100, 500},
+	protocol.GETDATA:    {50, 200},
+	protocol.INIT:       {0.01, 2},
+}
+
+// PeerLimiter holds the token buckets of a single peer
+type PeerLimiter struct {
+	buckets map[protocol.MessageType]*TokenBucket
+}
+
+func NewPeerLimiter() *PeerLimiter {
+	buckets := make(map[protocol.MessageType]*TokenBucket)
+	for t, limit := range rateLimits {
+		buckets[t] = NewTokenBucket(limit[0], limit[1])
+	}
+	return &PeerLimiter{buckets: buckets}
+}
+
+// Allow checks whether the peer may send another message of the type, types without a limit are always allowed
+func (pl *PeerLimiter) Allow(t protocol.MessageType) bool {
+	bucket, ok := pl.buckets[t]
+	if !ok {
+		return true
+	}
+	return bucket.Allow()
+}
@@ -0,0 +1,83 @@
+package relay
+
+import (
+	"coins/pkg/protocol"
+	"testing"
+	"time"
+)
+
+// allowed takes up to count tokens from the bucket and returns how many it got
+func allowed(tb *TokenBucket, count int) int {
+	n := 0
+	for i := 0; i < count; i++ {
+		if tb.Allow() {
+			n++
+		}
+	}
+	return n
+}
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     float64
+		capacity float64
+		drain    bool          // whether the burst is used up first
+		elapsed  time.Duration // time that passes before taking tokens
+		want     int           // tokens available afterwards
+	}{
+		{name: "full burst", rate: 10, capacity: 5, want: 5},
+		{name: "drained", rate: 10, capacity: 5, drain: true, want: 0},
+		{name: "partial refill", rate: 10, capacity: 5, drain: true, elapsed: time.Millisecond * 350, want: 3},
+		{name: "refill is capped at the capacity", rate: 10, capacity: 5, drain: true, elapsed: time.Hour, want: 5},
+		{name: "slow rate before a token", rate: 0.1, capacity: 2, drain: true, elapsed: time.Second * 9, want: 0},
+		{name: "slow rate after a token", rate: 0.1, capacity: 2, drain: true, elapsed: time.Second * 11, want: 1},
+		{name: "fractional capacity", rate: 1, capacity: 0.5, want: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tb := NewTokenBucket(test.rate, test.capacity)
+			if test.drain {
+				allowed(tb, int(test.capacity))
+			}
+			// Pretend the time passed since the bucket was last used
+			tb.last = tb.last.Add(-test.elapsed)
+			if got := allowed(tb, int(test.capacity)+10); got != test.want {
+				t.Fatalf("bucket allowed %v instead of %v events", got, test.want)
+			}
+		})
+	}
+}
+
+func TestPeerLimiter(t *testing.T) {
+	tests := []struct {
+		name  string
+		typ   protocol.MessageType
+		count int
+		want  int
+	}{
+		{name: "unlimited type", typ: protocol.NEW_BLOCK, count: 1000, want: 1000},
+		{name: "burst of transactions", typ: protocol.NEW_TX, count: 1000, want: int(rateLimits[protocol.NEW_TX][1])},
+		{name: "burst of address requests", typ: protocol.GETADDR, count: 10, want: int(rateLimits[protocol.GETADDR][1])},
+		{name: "burst of bootstrap requests", typ: protocol.INIT, count: 10, want: int(rateLimits[protocol.INIT][1])},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pl := NewPeerLimiter()
+			got := 0
+			for i := 0; i < test.count; i++ {
+				if pl.Allow(test.typ) {
+					got++
+				}
+			}
+			// The bursts may refill by a token while the loop runs
+			if got < test.want || got > test.want+1 {
+				t.Fatalf("limiter allowed %v instead of %v messages", got, test.want)
+			}
+			// Other types and other peers have their own buckets
+			if !pl.Allow(protocol.GETHEADERS) || !NewPeerLimiter().Allow(test.typ) {
+				t.Fatal("exhausting one bucket limited another one")
+			}
+		})
+	}
+}
@@ -2,12 +2,15 @@ package relay
 
 import (
 	"coins/pkg/blockchain"
-	"coins/pkg/gorx"
 	"coins/pkg/model"
 	"coins/pkg/protocol"
+	"coins/pkg/storage"
+	"coins/pkg/transport"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net"
 	"sync"
@@ -15,71 +18,50 @@ import (
 )
 
 type Relay struct {
-	Mine          bool
-	RestartMiner  *bool
-	Local         bool
-	Connections   []net.Conn
-	Blockchain    blockchain.BlockChain
-	FloatingTx    []model.Transaction
-	FloatingRx    []model.Registration
-	Peers         []string
-	Wallet        blockchain.Wallet
-	PeerSyncMutex *sync.Mutex
-	SyncPromise   *gorx.Promise
-	InSyncTx      bool
-}
-
-func (r *Relay) MineBlocks(stop *bool) {
-	for {
-		// Create our new block
-		newBlock := model.Block{
-			ID:            r.Blockchain.Chainstate.LastBlock.ID + 1,
-			Nonce:         0,
-			Previous:      r.Blockchain.Chainstate.LastBlock.Hash,
-			Miner:         r.Wallet.Address,
-			Transactions:  r.FloatingTx,
-			Registrations: r.FloatingRx,
-		}
-		// restart
-		*stop = false
-		// Launch miner
-		go func() {
-			newBlock.Mine(stop)
-			// if the miner stops, check if its result is a valid block
-			res := r.Blockchain.ValidateBlock(newBlock)
-			if res == blockchain.B_ACCEPT {
-				log.Printf("[MINER] new block mined id=%v hash=%v\n", newBlock.ID, newBlock.Hash)
-				// if we found a block, process and broadcast it
-				r.newBlock(newBlock)
-			}
-		}()
-		for {
-			time.Sleep(time.Millisecond * 100)
-			if *stop {
-				break
-			}
-		}
-	}
+	Local          bool
+	Blockchain     blockchain.BlockChain
+	FloatingTx     []model.Transaction  // Transactions waiting to be mined, guarded by the ChainMutex
+	FloatingRx     []model.Registration // Registrations waiting to be mined, guarded by the ChainMutex
+	Peers          []string
+	Wallet         blockchain.Wallet
+	Events         *Events
+	ChainMutex     *sync.RWMutex
+	Store          storage.Store
+	WAL            *storage.WAL
+	PruneDepth     uint64 // Amount of blocks we keep, 0 keeps the full history
+	Workers        *WorkerPool
+	Metrics        *Metrics
+	Bans           *BanList
+	PeerManager    *PeerManager
+	Seen           *InvCache // Items we received or announced
+	Requests       *Requests // Items we requested from our peers
+	Sync           *HeaderSync
+	Addrs          *AddrBook
+	Outbound       *PeerSet            // Addresses we are connected or connecting to
+	TargetOutbound int                 // Amount of outbound connections to keep, 0 uses TARGET_OUTBOUND
+	ListenPort     uint16              // Port we accept connections on, 0 if we dont
+	TLS            *tls.Config         // Encrypts and authenticates peer connections if set, see TLSConfig
+	Transport      transport.Transport // How we reach our peers, nil uses tcp
+	Miner          *Miner              // Mines blocks on top of our head, nil if we dont mine
 }
 
 func (r *Relay) CommitBlockchain() {
 	for {
-		// copy the blockchain
-		state := r.Blockchain
-		// marhsall the copy
-		bin, err := json.Marshal(state)
-		if err != nil {
-			fmt.Printf("[NODE] failed to marshall blockchain with error %v\n", err)
+		// Write the blocks we are missing on disk and the chainstate
+		r.ChainMutex.RLock()
+		err := storage.Commit(r.Store, &r.Blockchain)
+		// Once the blocks are committed the log is no longer needed
+		if err == nil {
+			err = r.WAL.Reset()
 		}
-		// Write the content to file
-		err = ioutil.WriteFile("blockchain.json", bin, 0644)
+		r.ChainMutex.RUnlock()
 		if err != nil {
 			fmt.Printf("[NODE] failed to commit blockchain to disk with error %v\n", err)
+		} else {
+			fmt.Println("[NODE] blockchain committed to disk successfully")
 		}
-		fmt.Println("[NODE] blockchain committed to disk successfully")
 		time.Sleep(time.Second * 10)
 	}
-
 }
 
 func (r *Relay) RegisterOrNop() {
@@ -102,65 +84,13 @@ func (r *Relay) RegisterOrNop() {
 	// Broadcast onto the network
 	go r.BroadcastRx(rx)
 	// Add it to our own floating rx
-	r.FloatingRx = append(r.FloatingRx, rx)
-}
-
-func (r *Relay) ConsumePeers(peers []string) {
-	// Iterate over the specified peers
-	for _, peer := range peers {
-		alloc := peer
-		go func() {
-			for {
-				// Connect to the peer
-				conn, err := net.Dial("tcp", alloc)
-				if err != nil {
-					log.Printf("Could not initialize connection with error %v\n", err)
-					time.Sleep(time.Minute)
-					continue
-				}
-				log.Printf("[NODE] Connected to peer %v\n", alloc)
-				// handle the connection async
-				r.handleConnection(conn)
-				return
-			}
-		}()
-	}
-}
-
-func (r *Relay) TrySyncOrNop(conn net.Conn) {
-	// Check if we are currently in a sync transaction
-	if r.InSyncTx {
-		// if a sync transaction is currently active, just nop
-		return
-	}
-	// If we are not in a sync transaction, try to acquire the sync lock
-	r.PeerSyncMutex.Lock()
-	// Now we can begin syncing with a peer, we will use the peer specified
-	// Build a message content string
-	cont := protocol.SyncContent{LastBlockHash: r.Blockchain.Chainstate.LastBlock.Hash, Head: r.Blockchain.Chainstate.LastBlock.ID}
-	// Marshall the content to json
-	bin, err := json.Marshal(cont)
-	if err != nil {
-		fmt.Println("[RELAY] failed to build sync request")
-	}
-	// Build a message
-	msg := protocol.Message{Type: protocol.SYNC, Content: string(bin)}
-	// Setup our sync promise
-	r.SyncPromise = gorx.NewPromiseWithTimeout(time.Minute).Then(func(v interface{}) {
-		r.SyncPromise = nil
-		r.PeerSyncMutex.Unlock()
-		r.InSyncTx = false
-	})
-	// Log
-	fmt.Println("[RELAY] syncing with peer ", conn.RemoteAddr())
-	// Send the sync request to the node
-	sendMessage(msg, conn)
+	r.AddFloatingRx(rx)
 }
 
 func (r *Relay) Listen(addr string) {
 	log.Printf("now listening for consumers on %v\n", addr)
 	// Initialize a socket to accept tcp connections
-	soc, err := net.Listen("tcp", addr)
+	soc, err := r.transport().Listen(addr)
 	if err != nil {
 		log.Fatalf("Could not initialize socket with error %v\n", err)
 	}
@@ -168,38 +98,127 @@ func (r *Relay) Listen(addr string) {
 	for {
 		// Wait for the next connection and accept it
 		connection, err := soc.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			log.Printf("stopped listening on %v\n", addr)
+			return
+		}
 		if err != nil {
 			log.Fatalf("Could not accept connection with error %v\n", err)
 		}
+		// Turn away consumers we banned
+		if r.Bans.Banned(Host(connection.RemoteAddr().String())) {
+			log.Printf("[NODE] Rejected banned consumer %v\n", connection.RemoteAddr())
+			connection.Close()
+			continue
+		}
 		log.Printf("[NODE] Accepted Consumer %v\n", connection.RemoteAddr())
-		// add the consumer to the broadcast pool
-		r.Connections = append(r.Connections, connection)
 		// handle the connection async
-		go r.handleConnection(connection)
+		go func() {
+			// encrypt the connection before anything else is sent
+			conn, err := r.secure(connection, false)
+			if err != nil {
+				log.Printf("[NODE] Securing connection with consumer %v failed with error %v\n", connection.RemoteAddr(), err)
+				connection.Close()
+				return
+			}
+			// the consumer has to introduce itself before we relay anything to it
+			remote, err := r.handshake(conn)
+			if err != nil {
+				log.Printf("[NODE] Handshake with consumer %v failed with error %v\n", conn.RemoteAddr(), err)
+				conn.Close()
+				return
+			}
+			r.learnAddr(conn, remote)
+			r.servePeer(NewPeer(conn, conn.RemoteAddr().String(), PEER_INBOUND), remote)
+		}()
 	}
 }
 
+// transport returns how we reach our peers
+func (r *Relay) transport() transport.Transport {
+	if r.Transport == nil {
+		return transport.TCP{}
+	}
+	return r.Transport
+}
+
+// servePeer adds the peer to our broadcast pool and handles its messages until the connection closes
+func (r *Relay) servePeer(p *Peer, remote *protocol.VersionContent) {
+	p.activate(remote)
+	r.PeerManager.Add(p)
+	defer r.PeerManager.Remove(p)
+	defer r.Sync.Drop(p.Conn)
+	if p.Direction == PEER_OUTBOUND {
+		// learn about the peers of our peer
+		r.send(protocol.Message{Type: protocol.GETADDR}, p.Conn)
+		// bootstrap from the peer if we have no chain yet
+		r.RequestInitOrNop(p.Conn)
+	}
+	// catch up if the peer is ahead of us, no matter who opened the connection
+	r.Sync.SetHeight(p.Conn, remote.Height)
+	r.ChainMutex.RLock()
+	behind := len(r.Blockchain.Blocks) > 0 && remote.Height > r.Blockchain.Chainstate.LastBlock.ID
+	r.ChainMutex.RUnlock()
+	if behind {
+		go r.TrySyncOrNop(p.Conn)
+	}
+	r.handleConnection(p.Conn)
+}
+
 // handleConnection handles the communication with a connection
 func (r *Relay) handleConnection(conn net.Conn) {
-	// Begin Reading the connection
-	decoder := json.NewDecoder(conn)
+	defer conn.Close()
+	limiter := NewPeerLimiter()
 	for {
-		// Read until a full message is received
-		var msg protocol.Message
-		err := decoder.Decode(&msg)
+		// Read until a full frame is received
+		msg, err := protocol.ReadMessage(conn)
+		if err == protocol.ErrChecksum {
+			// The frame was read completely, so we can skip it and continue with the next one
+			log.Println("[NODE] Invalid Message Received")
+			r.Metrics.Drop(DROP_CHECKSUM, msg.Type)
+			r.misbehave(conn, SCORE_MALFORMED, "a corrupt message")
+			continue
+		}
+		if err == protocol.ErrTooLarge {
+			r.Metrics.Drop(DROP_OVERSIZE, msg.Type)
+			r.misbehave(conn, SCORE_OVERSIZE, "an oversized message")
+		}
 		if err != nil {
-			if &msg == nil {
-				return
+			if err != io.EOF {
+				log.Printf("[NODE] Closing connection to %v with error %v\n", conn.RemoteAddr(), err)
 			}
-			log.Println("[NODE] Invalid Message Received")
+			return
+		}
+		// Drop messages of peers that exceed their rate limit
+		if !limiter.Allow(msg.Type) {
+			r.Metrics.Drop(DROP_RATE_LIMIT, msg.Type)
+			r.misbehave(conn, SCORE_RATE_LIMIT, "exceeding its rate limit")
 			continue
 		}
 		// Process the message and respond to it
-		go r.processAndRespond(msg, conn)
+		r.dispatch(msg, conn)
 	}
 
 }
 
+// dispatch hands the message to our workers. Gossip is dropped when all of them are busy, everything else
+// waits for a worker, which stops us from reading the connection until the peer is handled
+func (r *Relay) dispatch(msg protocol.Message, conn net.Conn) {
+	if r.Workers == nil {
+		r.processAndRespond(msg, conn)
+		return
+	}
+	job := func() { r.processAndRespond(msg, conn) }
+	switch msg.Type {
+	case protocol.NEW_TX, protocol.NEW_RX, protocol.GETADDR, protocol.ADDR, protocol.INV, protocol.GETDATA:
+		if !r.Workers.TrySubmit(job) {
+			r.Metrics.Drop(DROP_QUEUE_FULL, msg.Type)
+		}
+	default:
+		r.Workers.Submit(job)
+	}
+}
+
 // processAndRespond calls the appropriate message handler depending on the message type
 func (r *Relay) processAndRespond(msg protocol.Message, conn net.Conn) {
 	switch msg.Type {
@@ -207,16 +226,27 @@ func (r *Relay) processAndRespond(msg protocol.Message, conn net.Conn) {
 		r.handleNewBlock(msg.Content, conn)
 	case protocol.NEW_TX:
 		r.handleNewTX(msg.Content, conn)
-	case protocol.SYNC:
-		r.handleSync(msg.Content, conn)
 	case protocol.INIT:
 		r.handleInit(msg.Content, conn)
-	case protocol.SYNC_NEXT_BLOCKS:
-		r.handleSyncNextBlocks(msg.Content, conn)
+	case protocol.INIT_BLOCKS:
+		r.handleInitBlocks(msg.Content, conn)
 	case protocol.NEW_RX:
 		r.handleNewRx(msg.Content, conn)
+	case protocol.GETADDR:
+		r.handleGetAddr(conn)
+	case protocol.ADDR:
+		r.handleAddr(msg.Content, conn)
+	case protocol.INV:
+		r.handleInv(msg.Content, conn)
+	case protocol.GETDATA:
+		r.handleGetData(msg.Content, conn)
+	case protocol.GETHEADERS:
+		r.handleGetHeaders(msg.Content, conn)
+	case protocol.HEADERS:
+		r.handleHeaders(msg.Content, conn)
 	default:
 		log.Println("[NODE] Message with invalid type received")
+		r.misbehave(conn, SCORE_MALFORMED, "a message with an invalid type")
 	}
 }
 
@@ -226,98 +256,129 @@ func (r *Relay) handleNewRx(content string, conn net.Conn) {
 	err := json.Unmarshal([]byte(content), &req)
 	if err != nil {
 		log.Println("[NODE] failed to unmarshall blocks")
+		r.misbehave(conn, SCORE_MALFORMED, "a malformed message")
+		return
+	}
+	r.delivered(conn, rxInv(req))
+	// Ignore registrations we already received from another peer
+	if r.Seen.Has(rxInv(req)) {
+		return
+	}
+	if len(req.Wallet) == 0 {
+		log.Println("[NODE] registration without a wallet, ignoring")
+		r.misbehave(conn, SCORE_MALFORMED, "a registration without a wallet")
+		return
+	}
+	if _, err := blockchain.StringToKey(req.PublicKey); err != nil {
+		log.Println("[NODE] registration with an invalid public key, ignoring")
+		r.misbehave(conn, SCORE_MALFORMED, "a registration with an invalid public key")
+		return
+	}
+	// Wallets cannot be registered twice, a peer may not have seen the block registering it yet
+	r.ChainMutex.RLock()
+	registered := r.Blockchain.Chainstate.Wallets[req.Wallet] != nil
+	r.ChainMutex.RUnlock()
+	if registered {
+		log.Println("[NODE] registration of an existing wallet, ignoring")
+		return
+	}
+	// Only a valid registration is marked seen, another peer may have sent it in between
+	if !r.received(conn, rxInv(req)) {
 		return
 	}
 	// Log that we received a new rx
 	fmt.Printf("[NODE] Received new Registration for %v\n", req.Wallet)
 	// Add the registration to the pool of floating rx
-	r.FloatingRx = append(r.FloatingRx, req)
+	r.AddFloatingRx(req)
+	// Notify our subscribers
+	if r.Events != nil {
+		r.Events.NewRegistration.Push(req)
+	}
+	// if we are an open relay, broadcast the registration
+	if !r.Local {
+		go r.BroadcastRx(req)
+	}
 }
 
-func (r *Relay) handleSyncNextBlocks(content string, conn net.Conn) {
-	// Unmarshall the content
-	var req protocol.SyncNextBlocksContent
-	err := json.Unmarshal([]byte(content), &req)
+// Services returns the services this relay offers to its peers
+func (r *Relay) Services() protocol.ServiceFlag {
+	services := protocol.ServiceFlag(0)
+	r.ChainMutex.RLock()
+	defer r.ChainMutex.RUnlock()
+	if !r.Blockchain.Pruned() {
+		services |= protocol.SERVICE_FULL_HISTORY
+	}
+	return services
+}
+
+// send queues the message for the peer behind the connection, so it is written with the write timeout of the
+// peer and never interleaves with our broadcasts. Connections that are not one of our peers get nothing
+func (r *Relay) send(msg protocol.Message, conn net.Conn) {
+	frame, err := protocol.EncodeMessage(msg)
 	if err != nil {
-		log.Println("[NODE] failed to unmarshall blocks")
+		log.Printf("[NODE] Could not encode message for %v with error %v\n", conn.RemoteAddr(), err)
 		return
 	}
-	// check if the remote state has more work than ours
-	if req.Head <= r.Blockchain.Chainstate.LastBlock.ID {
-		fmt.Printf("[NODE] Sync from peer %v rejected. remote head %v <= local head %v", conn.RemoteAddr(), req.Head, r.Blockchain.Chainstate.LastBlock.ID)
+	p := r.PeerManager.Get(conn)
+	if p == nil {
+		log.Printf("[NODE] dropping %v for %v, it is not one of our peers\n", msg.Type, conn.RemoteAddr())
 		return
 	}
-	// Write to log
-	fmt.Printf("[NODE] Received %v blocks from peer %v\n", len(req.Blocks), conn.RemoteAddr())
-	// Process the blocks in reverse order
-	for i := len(req.Blocks) - 1; i >= 0; i-- {
-		fmt.Printf("BEGIN_PROCESS_BLOCK %v\n", req.Blocks[i].ID)
-		r.newBlockFromPeer(*req.Blocks[i], conn)
-	}
-	// Complete our sync promise
-	r.SyncPromise.Resolve(nil)
-}
-
-func sendMessage(msg protocol.Message, conn net.Conn) {
-	bin, _ := json.Marshal(msg)
-	fmt.Fprint(conn, string(bin))
+	p.Reply(frame)
 }
 
-func (r *Relay) newBlock(block model.Block) {
+// newBlock validates the block against our head and processes it. Both happen under the chain lock,
+// so no other block can be processed in between
+func (r *Relay) newBlock(block model.Block) blockchain.BLOCK_VALIDATION_RESULT {
+	r.ChainMutex.Lock()
+	res := r.Blockchain.ValidateBlock(block)
+	if res != blockchain.B_ACCEPT {
+		r.ChainMutex.Unlock()
+		return res
+	}
 	// Process the Block into our blockchain
 	log.Printf("[NODE] new block id=%v accepted\n", block.ID)
-	go r.Blockchain.ProcessBlock(block)
-	// Remove its transactions from the floating ones
-	actionTaken := false
-	for {
-		for i := 0; i < len(block.Transactions); i++ {
-			for j := 0; j < len(r.FloatingTx); j++ {
-				r.FloatingTx = remove(r.FloatingTx, j)
-				actionTaken = true
-				break
-			}
-			if actionTaken {
-				break
-			}
-		}
-		if !actionTaken {
-			break
-		}
-	}
-	actionTaken = false
-	for {
-		for i := 0; i < len(block.Registrations); i++ {
-			for j := 0; j < len(r.FloatingRx); j++ {
-				r.FloatingRx = removeRX(r.FloatingRx, j)
-				actionTaken = true
-				break
-			}
-			if actionTaken {
-				break
-			}
-		}
-		if !actionTaken {
-			break
-		}
-	}
+	r.Blockchain.ProcessBlock(block)
+	events := r.walletEvents(block)
+	// Drop the blocks we no longer keep
+	if r.PruneDepth > 0 {
+		r.Blockchain.Prune(r.PruneDepth)
+	}
+	// Log the block so it survives a crash before the next commit
+	err := r.WAL.Append(&block)
+	if err != nil {
+		log.Printf("[NODE] failed to log block id=%v with error %v\n", block.ID, err)
+	}
+	// Remove its transactions and registrations from the floating ones
+	r.FloatingTx = withoutIncludedTx(r.FloatingTx, block.Transactions)
+	r.FloatingRx = withoutIncludedRx(r.FloatingRx, block.Registrations)
+	r.ChainMutex.Unlock()
+	r.Seen.Add(blockInv(block))
+	// Notify our subscribers
+	r.emitBlock(block, events)
 	// Restart our miner
-	*r.RestartMiner = true
-	// if we are an open relay, broadcast the block
-	if !r.Local {
-		// Broadcast the block to our peers
-		go r.BroadcastBlock(block)
-	}
+	r.RestartMining()
+	return blockchain.B_ACCEPT
 }
 
 func (r *Relay) newBlockFromPeer(block model.Block, conn net.Conn) {
-	// Validate the Block using our current blockchain
-	res := r.Blockchain.ValidateBlock(block)
+	// Validate the Block using our current blockchain and process it
+	res := r.newBlock(block)
 	if res != blockchain.B_ACCEPT {
 		log.Printf("[NODE] block with id=%v rejected with reason=%v\n", block.ID, res)
+		// A block that does not extend our head may be on a fork we dont know yet, anything else is invalid
+		if res != blockchain.B_REJECT_HASH_INTEG && res != blockchain.B_REJECT_ID_INTEG {
+			r.misbehave(conn, SCORE_INVALID_BLOCK, "an invalid block")
+			return
+		}
 		go r.TrySyncOrNop(conn)
 		return
 	}
-	r.newBlock(block)
+	// if we are an open relay, broadcast the block
+	if !r.Local {
+		// Broadcast the block to our peers
+		go r.BroadcastBlock(block)
+	}
 }
 
 func (r *Relay) handleNewBlock(content string, conn net.Conn) {
@@ -327,19 +388,75 @@ func (r *Relay) handleNewBlock(content string, conn net.Conn) {
 	err := json.Unmarshal([]byte(content), &block)
 	if err != nil {
 		log.Println("[NODE] Failed to unmarshall new block, ignoring")
+		r.misbehave(conn, SCORE_MALFORMED, "a malformed message")
+		return
+	}
+	r.Sync.SetHeight(conn, block.ID)
+	item := protocol.InvItem{Type: protocol.INV_BLOCK, Hash: block.GetHash()}
+	r.delivered(conn, item)
+	// Blocks we requested while syncing are applied in order by the syncer, which marks them seen once accepted
+	if r.deliverBlock(block, conn) {
+		return
+	}
+	// Ignore blocks we already accepted from another peer
+	if r.Seen.Has(item) {
+		return
+	}
+	// The header commits to the body, a mismatch would make us reject the valid block under the same hash
+	if block.ComputeTxRoot() != block.TxRoot {
+		log.Println("[NODE] block does not match its transaction root, ignoring")
+		r.misbehave(conn, SCORE_INVALID_BLOCK, "a block that does not match its transaction root")
 		return
 	}
+	// newBlock marks the block seen once it is accepted
 	r.newBlockFromPeer(block, conn)
 }
 
-func remove(s []model.Transaction, i int) []model.Transaction {
-	s[len(s)-1], s[i] = s[i], s[len(s)-1]
-	return s[:len(s)-1]
+// AddFloatingTx adds the transaction to the ones waiting to be mined and lets our miner pick it up
+func (r *Relay) AddFloatingTx(tx model.Transaction) {
+	r.ChainMutex.Lock()
+	r.FloatingTx = append(r.FloatingTx, tx)
+	r.ChainMutex.Unlock()
+	r.RefreshTemplate()
 }
 
-func removeRX(s []model.Registration, i int) []model.Registration {
-	s[len(s)-1], s[i] = s[i], s[len(s)-1]
-	return s[:len(s)-1]
+// AddFloatingRx adds the registration to the ones waiting to be mined and lets our miner pick it up
+func (r *Relay) AddFloatingRx(rx model.Registration) {
+	r.ChainMutex.Lock()
+	r.FloatingRx = append(r.FloatingRx, rx)
+	r.ChainMutex.Unlock()
+	r.RefreshTemplate()
+}
+
+// withoutIncludedTx returns the floating transactions that are not part of the included ones. It builds
+// a new slice, since blocks being mined may share the array of the floating transactions
+func withoutIncludedTx(floating []model.Transaction, included []model.Transaction) []model.Transaction {
+	hashes := make(map[string]bool)
+	for _, tx := range included {
+		hashes[tx.Hash] = true
+	}
+	kept := []model.Transaction{}
+	for _, tx := range floating {
+		if !hashes[tx.Hash] {
+			kept = append(kept, tx)
+		}
+	}
+	return kept
+}
+
+// withoutIncludedRx returns the floating registrations whose wallet is not registered by the included ones
+func withoutIncludedRx(floating []model.Registration, included []model.Registration) []model.Registration {
+	wallets := make(map[string]bool)
+	for _, rx := range included {
+		wallets[rx.Wallet] = true
+	}
+	kept := []model.Registration{}
+	for _, rx := range floating {
+		if !wallets[rx.Wallet] {
+			kept = append(kept, rx)
+		}
+	}
+	return kept
 }
 
 func (r *Relay) handleNewTX(content string, conn net.Conn) {
@@ -349,10 +466,30 @@ func (r *Relay) handleNewTX(content string, conn net.Conn) {
 	err := json.Unmarshal([]byte(content), &tx)
 	if err != nil {
 		log.Println("[NODE] Failed to unmarshall new transaction, ignoring")
+		r.misbehave(conn, SCORE_MALFORMED, "a malformed message")
+		return
+	}
+	// The hash identifies the transaction in our inventory, so it has to match the content
+	hash, err := tx.GetHash()
+	if err != nil || hash != tx.Hash {
+		log.Println("[NODE] transaction does not match its hash, ignoring")
+		r.misbehave(conn, SCORE_MALFORMED, "a transaction that does not match its hash")
+		return
+	}
+	r.delivered(conn, txInv(tx))
+	// Ignore transactions we already received from another peer
+	if r.Seen.Has(txInv(tx)) {
 		return
 	}
 	// Get the Public key of the supposed sender of the transaction
-	key, err := blockchain.StringToKey(r.Blockchain.Chainstate.Wallets[tx.Sender].PublicKey)
+	r.ChainMutex.RLock()
+	sender := r.Blockchain.Chainstate.Wallets[tx.Sender]
+	r.ChainMutex.RUnlock()
+	if sender == nil {
+		log.Println("[NODE] unknown transaction sender, ignoring")
+		return
+	}
+	key, err := blockchain.StringToKey(sender.PublicKey)
 	if err != nil {
 		log.Println("[NODE] unknown transaction sender, ignoring")
 		return
@@ -360,10 +497,19 @@ func (r *Relay) handleNewTX(content string, conn net.Conn) {
 	// Validate the Transaction signature
 	if !tx.Verify(key) {
 		log.Println("[NODE] transaction signature is not valid, ignoring")
+		r.misbehave(conn, SCORE_BAD_SIGNATURE, "a transaction with an invalid signature")
+		return
+	}
+	// Only a valid transaction is marked seen, another peer may have sent it in between
+	if !r.received(conn, txInv(tx)) {
 		return
 	}
 	// Add the transaction to the floating transactions
-	r.FloatingTx = append(r.FloatingTx, tx)
+	r.AddFloatingTx(tx)
+	// Notify our subscribers
+	if r.Events != nil {
+		r.Events.NewTransaction.Push(tx)
+	}
 	// if we are an open relay, broadcast the transaction
 	if !r.Local {
 		// Broadcast the block to our peers
@@ -371,114 +517,17 @@ func (r *Relay) handleNewTX(content string, conn net.Conn) {
 	}
 }
 
-func (r *Relay) handleSync(content string, conn net.Conn) {
-	log.Printf("[%v->%v] Sync request", conn.RemoteAddr(), conn.LocalAddr())
-	// Unmarshall the message content
-	var syncHeader protocol.SyncContent
-	err := json.Unmarshal([]byte(content), &syncHeader)
-	if err != nil {
-		log.Println("[NODE] Failed to unmarshall sync header")
-		return
-	}
-	// dont sync if remote has more blocks than we do
-	if syncHeader.Head > r.Blockchain.Chainstate.LastBlock.ID {
-		fmt.Printf("[NODE] reject sync request from remote relay with head %v while local head is %v", syncHeader.Head, r.Blockchain.Chainstate.LastBlock.ID)
-		return
-	}
-	// Find the blocks that the other node is missing
-	missingBlocks := []*model.Block{}
-	for i := len(r.Blockchain.Blocks) - 1; i >= 0; i-- {
-		if r.Blockchain.Blocks[i].Hash == syncHeader.LastBlockHash {
-			break
-		}
-		missingBlocks = append(missingBlocks, r.Blockchain.Blocks[i])
-	}
-	response := protocol.SyncNextBlocksContent{Blocks: missingBlocks, Head: r.Blockchain.Chainstate.LastBlock.ID}
-	// Marshall the response
-	bin, err := json.Marshal(response)
-	if err != nil {
-		log.Println("[NODE] Failed to marshall sync response content")
-		return
-	}
-	// Create the Message
-	msg := protocol.Message{
-		Type:    protocol.SYNC_NEXT_BLOCKS,
-		Content: string(bin),
-	}
-	// Marshall the message
-	msgBin, err := json.Marshal(msg)
-	if err != nil {
-		log.Println("[NODE] Failed to marshall message")
-		return
-	}
-	// Respond with the message
-	fmt.Fprint(conn, string(msgBin))
-}
-
-func (r *Relay) handleInit(content string, conn net.Conn) {}
-
 func (r *Relay) BroadcastBlock(block model.Block) {
-	// Marhsall the block
-	bin, err := json.Marshal(block)
-	if err != nil {
-		log.Println("[NODE] Could not broadcast block because serialization of the block failed")
-		return
-	}
-	// Create our broadcast message
-	msg := protocol.Message{Type: protocol.NEW_BLOCK, Content: string(bin)}
-	// Marshall the message
-	msgBuffer, err := json.Marshal(msg)
-	if err != nil {
-		log.Println("[NODE] Could not broadcast block because serialization of the message failed")
-		return
-	}
-	// Send the marshalled message to each connected consumer
-	for _, conn := range r.Connections {
-		log.Printf("[%v->%v] BLOCK:%v", conn.LocalAddr(), conn.RemoteAddr(), block.Hash)
-		fmt.Fprint(conn, string(msgBuffer))
-	}
+	// Announce the block, peers that want it request it with GETDATA
+	r.announce(blockInv(block))
 }
 
 func (r *Relay) BroadcastTx(tx model.Transaction) {
-	// Marhsall the transaction
-	bin, err := json.Marshal(tx)
-	if err != nil {
-		log.Println("[NODE] Could not broadcast transaction because serialization of the transaction failed")
-		return
-	}
-	// Create our broadcast message
-	msg := protocol.Message{Type: protocol.NEW_TX, Content: string(bin)}
-	// Marshall the message
-	msgBuffer, err := json.Marshal(msg)
-	if err != nil {
-		log.Println("[NODE] Could not broadcast transaction because serialization of the message failed")
-		return
-	}
-	// Send the marshalled message to each connected consumer
-	for _, conn := range r.Connections {
-		log.Printf("[%v->%v] TX:%v", conn.LocalAddr(), conn.RemoteAddr(), tx.Hash)
-		fmt.Fprint(conn, string(msgBuffer))
-	}
+	// Announce the transaction, peers that want it request it with GETDATA
+	r.announce(txInv(tx))
 }
 
 func (r *Relay) BroadcastRx(rx model.Registration) {
-	// Marhsall the Registration
-	bin, err := json.Marshal(rx)
-	if err != nil {
-		log.Println("[NODE] Could not broadcast registration because serialization of the registration failed")
-		return
-	}
-	// Create our broadcast message
-	msg := protocol.Message{Type: protocol.NEW_RX, Content: string(bin)}
-	// Marshall the message
-	msgBuffer, err := json.Marshal(msg)
-	if err != nil {
-		log.Println("[NODE] Could not broadcast registration because serialization of the message failed")
-		return
-	}
-	// Send the marshalled message to each connected consumer
-	for _, conn := range r.Connections {
-		log.Printf("[%v->%v] RX:%v", conn.LocalAddr(), conn.RemoteAddr(), rx.Wallet)
-		fmt.Fprint(conn, string(msgBuffer))
-	}
+	// Announce the registration, peers that want it request it with GETDATA
+	r.announce(rxInv(rx))
 }
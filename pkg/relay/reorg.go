@@ -0,0 +1,108 @@
+package relay
+
+import (
+	"coins/pkg/blockchain"
+	"coins/pkg/model"
+	"fmt"
+	"log"
+)
+
+// reorganize replaces the blocks after the fork point with the blocks of a longer fork. If one of the new
+// blocks turns out to be invalid the old blocks are restored and the reason is returned, the error reports
+// that we could not switch at all
+func (r *Relay) reorganize(fork uint64, blocks []model.Block) (blockchain.BLOCK_VALIDATION_RESULT, error) {
+	r.ChainMutex.Lock()
+	oldHead := r.Blockchain.Chainstate.LastBlock
+	// Only switch to a fork that is longer than our chain
+	if len(blocks) == 0 || blocks[len(blocks)-1].ID <= oldHead.ID {
+		r.ChainMutex.Unlock()
+		return blockchain.B_ACCEPT, fmt.Errorf("fork is no longer than our chain at %v", oldHead.ID)
+	}
+	// Rolling back without undo data replays the chain, which a pruned chain cannot and which is too slow to do
+	// under the lock. So we only switch to forks within the undo window, which also keeps the undo data of the
+	// new blocks around in case we have to restore our chain
+	if !r.Blockchain.CanUndo(fork) || len(blocks) > blockchain.MaxUndoDepth {
+		r.ChainMutex.Unlock()
+		return blockchain.B_ACCEPT, fmt.Errorf("fork point %v is outside of our undo window", fork)
+	}
+	// Keep the blocks we disconnect, so we can restore them or return their transactions to the floating pool
+	disconnected := []model.Block{}
+	for id := fork + 1; id <= oldHead.ID; id++ {
+		block := r.Blockchain.GetBlock(id)
+		if block == nil {
+			r.ChainMutex.Unlock()
+			return blockchain.B_ACCEPT, fmt.Errorf("block %v after the fork point is not stored", id)
+		}
+		disconnected = append(disconnected, *block)
+	}
+	err := r.Blockchain.Rollback(fork)
+	if err != nil {
+		r.ChainMutex.Unlock()
+		return blockchain.B_ACCEPT, fmt.Errorf("could not roll back to block %v with error %v", fork, err)
+	}
+	res := blockchain.B_ACCEPT
+	// The balances after each of the new blocks, a later block of the fork may change them again
+	events := make([][]WalletEvent, 0, len(blocks))
+	for _, block := range blocks {
+		res = r.Blockchain.ValidateBlock(block)
+		if res != blockchain.B_ACCEPT {
+			break
+		}
+		r.Blockchain.ProcessBlock(block)
+		events = append(events, r.walletEvents(block))
+	}
+	// Put our old chain back if the fork breaks the rules
+	if res != blockchain.B_ACCEPT {
+		log.Printf("[NODE] fork block rejected with reason=%v, restoring our chain\n", res)
+		err = r.Blockchain.Rollback(fork)
+		if err == nil {
+			for _, block := range disconnected {
+				r.Blockchain.ProcessBlock(block)
+			}
+		}
+		r.ChainMutex.Unlock()
+		if err != nil {
+			return res, fmt.Errorf("could not restore our chain with error %v", err)
+		}
+		return res, nil
+	}
+	// Log the new blocks so a restart follows the same rollback, see storage.Replay
+	for i := range blocks {
+		err = r.WAL.Append(&blocks[i])
+		if err != nil {
+			log.Printf("[NODE] failed to log block id=%v with error %v\n", blocks[i].ID, err)
+		}
+	}
+	if r.PruneDepth > 0 {
+		r.Blockchain.Prune(r.PruneDepth)
+	}
+	newHead := r.Blockchain.Chainstate.LastBlock
+	// Return the transactions and registrations the new chain does not contain to the floating pool
+	for _, block := range disconnected {
+		for _, tx := range block.Transactions {
+			if _, ok := r.Blockchain.FindTransaction(tx.Hash); !ok {
+				r.FloatingTx = append(r.FloatingTx, tx)
+			}
+		}
+		for _, rx := range block.Registrations {
+			if r.Blockchain.Chainstate.Wallets[rx.Wallet] == nil {
+				r.FloatingRx = append(r.FloatingRx, rx)
+			}
+		}
+	}
+	r.ChainMutex.Unlock()
+	log.Printf("[NODE] reorganized from %v to %v at fork point %v, %v blocks disconnected\n", oldHead.ID, newHead.ID, fork, len(disconnected))
+	for _, block := range blocks {
+		r.Seen.Add(blockInv(block))
+	}
+	// Notify our subscribers
+	if r.Events != nil {
+		r.Events.Reorg.Push(ReorgEvent{ForkPoint: fork, OldHead: oldHead.Hash, NewHead: newHead.Hash})
+	}
+	for i, block := range blocks {
+		r.emitBlock(block, events[i])
+	}
+	// Restart our miner on the new head
+	r.RestartMining()
+	return blockchain.B_ACCEPT, nil
+}
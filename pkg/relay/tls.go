@@ -0,0 +1,119 @@
+package relay
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"time"
+)
+
+// CERTIFICATE_VALIDITY is how long the certificate a node presents is valid, it is recreated on every start
+const CERTIFICATE_VALIDITY = time.Hour * 24 * 365
+
+// TLSConfig builds the configuration for encrypted peer connections. There is no certificate authority, both
+// sides present a certificate self-signed with their identity key and are known by that key. With an allowlist
+// only the nodes on it may connect, in either direction
+func TLSConfig(id *Identity, allow *Allowlist) (*tls.Config, error) {
+	cert, err := certificate(id)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:   tls.VersionTLS13,
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		// The chain cannot be verified without an authority, VerifyPeerCertificate checks the identity instead
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			pub, err := certificateKey(raw)
+			if err != nil {
+				return err
+			}
+			if !allow.Allowed(IdentityID(pub)) {
+				return fmt.Errorf("node %v is not on the allowlist", IdentityID(pub))
+			}
+			return nil
+		},
+	}, nil
+}
+
+// certificate creates a certificate for the identity key, signed by itself
+func certificate(id *Identity) (tls.Certificate, error) {
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(now.UnixNano()),
+		Subject:      pkix.Name{CommonName: id.ID()},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(CERTIFICATE_VALIDITY),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, id.Key.Public(), id.Key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("could not create certificate with error %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: id.Key}, nil
+}
+
+// certificateKey returns the identity key of the certificate a peer presented
+func certificateKey(raw [][]byte) (ed25519.PublicKey, error) {
+	if len(raw) == 0 {
+		return nil, errors.New("peer presented no certificate")
+	}
+	cert, err := x509.ParseCertificate(raw[0])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse peer certificate with error %v", err)
+	}
+	pub, ok := cert.PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("peer certificate does not carry an identity key")
+	}
+	err = cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("peer certificate is not signed by its key with error %v", err)
+	}
+	return pub, nil
+}
+
+// secure runs the TLS handshake on the connection if encryption is enabled, otherwise it returns the connection
+func (r *Relay) secure(conn net.Conn, outbound bool) (net.Conn, error) {
+	if r.TLS == nil {
+		return conn, nil
+	}
+	var tc *tls.Conn
+	if outbound {
+		tc = tls.Client(conn, r.TLS)
+	} else {
+		tc = tls.Server(conn, r.TLS)
+	}
+	tc.SetDeadline(time.Now().Add(HandshakeTimeout))
+	err := tc.Handshake()
+	if err != nil {
+		return nil, fmt.Errorf("tls handshake failed with error %v", err)
+	}
+	tc.SetDeadline(time.Time{})
+	return tc, nil
+}
+
+// PeerIdentity returns the identity the peer authenticated with, or an empty string on a plaintext connection
+func PeerIdentity(conn net.Conn) string {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	pub, ok := certs[0].PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return ""
+	}
+	return IdentityID(pub)
+}
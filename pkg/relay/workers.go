@@ -0,0 +1,41 @@
+package relay
+
+// MESSAGE_WORKERS is the amount of messages a relay processes concurrently
+const MESSAGE_WORKERS = 8
+
+// MESSAGE_QUEUE is the amount of messages that may wait for a worker
+const MESSAGE_QUEUE = 256
+
+// WorkerPool runs submitted jobs on a fixed amount of goroutines
+type WorkerPool struct {
+	jobs chan func()
+}
+
+func NewWorkerPool(workers int, queue int) *WorkerPool {
+	wp := &WorkerPool{jobs: make(chan func(), queue)}
+	for i := 0; i < workers; i++ {
+		go wp.work()
+	}
+	return wp
+}
+
+func (wp *WorkerPool) work() {
+	for job := range wp.jobs {
+		job()
+	}
+}
+
+// Submit queues the job, waiting for room in the queue
+func (wp *WorkerPool) Submit(job func()) {
+	wp.jobs <- job
+}
+
+// TrySubmit queues the job if there is room in the queue
+func (wp *WorkerPool) TrySubmit(job func()) bool {
+	select {
+	case wp.jobs <- job:
+		return true
+	default:
+		return false
+	}
+}
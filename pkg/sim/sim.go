@@ -0,0 +1,327 @@
+package sim
+
+import (
+	"coins/pkg/blockchain"
+	"coins/pkg/crypto"
+	"coins/pkg/model"
+	"coins/pkg/relay"
+	"coins/pkg/storage"
+	"coins/pkg/transport"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// PORT is the port every simulated relay listens on
+const PORT = 10500
+
+// POLL_INTERVAL is how often the simulation checks the nodes while waiting for them
+const POLL_INTERVAL = time.Millisecond * 50
+
+// SUPPLY_TOLERANCE is how far the sum of all balances may drift from the mined supply through rounding
+const SUPPLY_TOLERANCE = 1e-6
+
+// Config describes the network to simulate
+type Config struct {
+	Nodes   int            // amount of relays
+	Miners  int            // the first Miners relays mine
+	Peers   int            // amount of earlier relays each relay is initially told about
+	Link    transport.Link // how the network treats writes between relays
+	Seed    int64          // seeds the network and the transaction generator
+	Threads int            // mining goroutines of each miner, 0 uses one per cpu
+}
+
+// Node is a simulated relay and the host it runs on
+type Node struct {
+	Host   string
+	Addr   string
+	Relay  *relay.Relay
+	Miner  bool
+	Reorgs int // amount of times the relay switched to a fork
+	mutex  *sync.Mutex
+}
+
+// Sim runs relays in one process, connected through an in-memory network
+type Sim struct {
+	Network *transport.Network
+	Nodes   []*Node
+	config  Config
+	rand    *rand.Rand
+}
+
+// New creates the relays, all of them start from the same genesis block
+func New(config Config) (*Sim, error) {
+	if config.Nodes < 1 {
+		return nil, fmt.Errorf("cannot simulate %v nodes", config.Nodes)
+	}
+	s := &Sim{Network: transport.NewNetwork(config.Seed), config: config, rand: rand.New(rand.NewSource(config.Seed))}
+	s.Network.SetDefaultLink(config.Link)
+	for i := 0; i < config.Nodes; i++ {
+		host := fmt.Sprintf("10.0.%v.%v", i/250, i%250+1)
+		node, err := s.newNode(host, i < config.Miners)
+		if err != nil {
+			return nil, fmt.Errorf("could not create node %v with error %v", host, err)
+		}
+		s.Nodes = append(s.Nodes, node)
+	}
+	return s, nil
+}
+
+func (s *Sim) newNode(host string, miner bool) (*Node, error) {
+	wallet, err := blockchain.NewWallet()
+	if err != nil {
+		return nil, err
+	}
+	// Relays without a path keep their addresses and bans in memory
+	addrs, err := relay.OpenAddrBook("")
+	if err != nil {
+		return nil, err
+	}
+	bans, err := relay.OpenBanList("")
+	if err != nil {
+		return nil, err
+	}
+	r := &relay.Relay{
+		Blockchain:     *blockchain.NewBlockChain(),
+		Wallet:         *wallet,
+		Events:         relay.NewEvents(),
+		ChainMutex:     &sync.RWMutex{},
+		Store:          storage.NewMemoryStore(),
+		Workers:        relay.NewWorkerPool(relay.MESSAGE_WORKERS, relay.MESSAGE_QUEUE),
+		Metrics:        relay.NewMetrics(),
+		Bans:           bans,
+		PeerManager:    relay.NewPeerManager(),
+		Seen:           relay.NewInvCache(relay.SEEN_CACHE_SIZE),
+		Requests:       relay.NewRequests(),
+		Sync:           relay.NewHeaderSync(),
+		Addrs:          addrs,
+		Outbound:       relay.NewPeerSet(),
+		TargetOutbound: relay.TARGET_OUTBOUND,
+		ListenPort:     PORT,
+		Transport:      s.Network.Host(host),
+	}
+	if miner {
+		r.Miner = relay.NewMiner(s.config.Threads)
+	}
+	node := &Node{Host: host, Addr: net.JoinHostPort(host, strconv.Itoa(PORT)), Relay: r, Miner: miner, mutex: &sync.Mutex{}}
+	r.Events.Reorg.Subscribe(func(v interface{}) {
+		node.mutex.Lock()
+		node.Reorgs++
+		node.mutex.Unlock()
+	})
+	return node, nil
+}
+
+// Start lets every relay listen, tells it about some of the earlier relays and starts the miners
+func (s *Sim) Start() {
+	for i, node := range s.Nodes {
+		node.Relay.RegisterOrNop()
+		go node.Relay.Listen(":" + strconv.Itoa(PORT))
+		peers := []string{}
+		for j := i - 1; j >= 0 && len(peers) < s.config.Peers; j-- {
+			peers = append(peers, s.Nodes[j].Addr)
+		}
+		go node.Relay.ConsumePeers(peers)
+		go node.Relay.SyncBlocks()
+		node.Relay.StartMining()
+	}
+}
+
+// StopMining stops the miners and waits until they returned, so the chains of the nodes no longer grow
+func (s *Sim) StopMining() {
+	for _, node := range s.Nodes {
+		node.Relay.StopMining()
+	}
+}
+
+// Partition splits the nodes into the groups, nodes in different groups cannot reach each other
+func (s *Sim) Partition(groups ...[]*Node) {
+	hosts := make([][]string, len(groups))
+	for i, group := range groups {
+		for _, node := range group {
+			hosts[i] = append(hosts[i], node.Host)
+		}
+	}
+	s.Network.Partition(hosts...)
+}
+
+// Heal lets all nodes reach each other again
+func (s *Sim) Heal() {
+	s.Network.Heal()
+}
+
+// Halves returns the first and the second half of the nodes
+func (s *Sim) Halves() ([]*Node, []*Node) {
+	half := len(s.Nodes) / 2
+	return s.Nodes[:half], s.Nodes[half:]
+}
+
+// Head returns the height and hash of the head of the node
+func (n *Node) Head() (uint64, string) {
+	n.Relay.ChainMutex.RLock()
+	defer n.Relay.ChainMutex.RUnlock()
+	return n.Relay.Blockchain.Chainstate.LastBlock.ID, n.Relay.Blockchain.Chainstate.LastBlock.Hash
+}
+
+// TransactionCount returns the amount of transactions on the chain of the node
+func (n *Node) TransactionCount() uint64 {
+	n.Relay.ChainMutex.RLock()
+	defer n.Relay.ChainMutex.RUnlock()
+	return n.Relay.Blockchain.Chainstate.TransactionVolume
+}
+
+// ReorgCount returns how often the node switched to a fork
+func (n *Node) ReorgCount() int {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.Reorgs
+}
+
+// Converged checks whether all nodes agree on the head
+func (s *Sim) Converged() error {
+	height, hash := s.Nodes[0].Head()
+	for _, node := range s.Nodes[1:] {
+		h, other := node.Head()
+		if other != hash {
+			return fmt.Errorf("node %v is at %v while node %v is at %v", node.Host, h, s.Nodes[0].Host, height)
+		}
+	}
+	return nil
+}
+
+// WaitConverged waits until all nodes agree on the head, a single moment of agreement is enough
+func (s *Sim) WaitConverged(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := s.Converged()
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("nodes did not converge within %v, %v", timeout, err)
+		}
+		time.Sleep(POLL_INTERVAL)
+	}
+}
+
+// WaitHeight waits until every node reached the height
+func (s *Sim) WaitHeight(height uint64, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for _, node := range s.Nodes {
+		for {
+			h, _ := node.Head()
+			if h >= height {
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("node %v is at %v instead of %v after %v", node.Host, h, height, timeout)
+			}
+			time.Sleep(POLL_INTERVAL)
+		}
+	}
+	return nil
+}
+
+// CheckSupply checks on every node that the balances add up to the mined supply and that the
+// chainstate matches the state root of the head
+func (s *Sim) CheckSupply() error {
+	for _, node := range s.Nodes {
+		err := node.checkSupply()
+		if err != nil {
+			return fmt.Errorf("node %v: %v", node.Host, err)
+		}
+	}
+	return nil
+}
+
+func (n *Node) checkSupply() error {
+	n.Relay.ChainMutex.RLock()
+	defer n.Relay.ChainMutex.RUnlock()
+	cs := &n.Relay.Blockchain.Chainstate
+	total := 0.0
+	for _, info := range cs.Wallets {
+		if info.Amount < 0 {
+			return fmt.Errorf("wallet has a negative balance of %v", info.Amount)
+		}
+		total += info.Amount
+	}
+	mined := float64(cs.LastBlock.ID) * model.BlockReward
+	if math.Abs(cs.MarketVolume-mined) > SUPPLY_TOLERANCE {
+		return fmt.Errorf("market volume %v does not match the %v coins mined up to block %v", cs.MarketVolume, mined, cs.LastBlock.ID)
+	}
+	if math.Abs(total-mined) > SUPPLY_TOLERANCE {
+		return fmt.Errorf("balances add up to %v instead of the %v coins mined", total, mined)
+	}
+	if cs.LastBlock.ID > 0 && cs.StateRoot() != cs.LastBlock.StateRoot {
+		return fmt.Errorf("chainstate does not match the state root of block %v", cs.LastBlock.ID)
+	}
+	return nil
+}
+
+// SendTransactions makes up to count random transfers between the registered wallets of the nodes, each
+// submitted to the node owning the sending wallet. It returns how many were sent
+func (s *Sim) SendTransactions(count int) int {
+	sent := 0
+	for i := 0; i < count; i++ {
+		from := s.Nodes[s.rand.Intn(len(s.Nodes))]
+		to := s.Nodes[s.rand.Intn(len(s.Nodes))]
+		if from == to {
+			continue
+		}
+		tx, ok := from.transfer(to.Relay.Wallet.Address, s.rand.Float64())
+		if !ok {
+			continue
+		}
+		// Submit it like a client would, the relay announces it to its peers
+		from.Relay.AddFloatingTx(tx)
+		go from.Relay.BroadcastTx(tx)
+		sent++
+	}
+	return sent
+}
+
+// transfer signs a transaction sending the fraction of the balance of the node that is not spent by its
+// floating transactions yet. It takes the id after the ones of the floating transactions, so a node can have
+// several transactions waiting to be mined
+func (n *Node) transfer(recipient string, fraction float64) (model.Transaction, bool) {
+	r := n.Relay
+	r.ChainMutex.RLock()
+	// Copy the wallet, the chainstate keeps changing once we unlock
+	var sender blockchain.WalletInfo
+	info := r.Blockchain.Chainstate.Wallets[r.Wallet.Address]
+	if info != nil {
+		sender = *info
+	}
+	registered := r.Blockchain.Chainstate.Wallets[recipient] != nil
+	for _, tx := range r.FloatingTx {
+		if tx.Sender == r.Wallet.Address && tx.TXID > sender.TXC {
+			sender.TXC++
+			sender.Amount -= tx.Amount
+		}
+	}
+	r.ChainMutex.RUnlock()
+	if info == nil || !registered || sender.Amount <= 0 {
+		return model.Transaction{}, false
+	}
+	tx := model.Transaction{
+		TXID:      sender.TXC + 1,
+		Sender:    r.Wallet.Address,
+		Recipient: recipient,
+		Amount:    sender.Amount * fraction,
+		Comment:   "sim",
+	}
+	hash, err := tx.GetHash()
+	if err != nil {
+		return model.Transaction{}, false
+	}
+	tx.Hash = hash
+	tx.Signature, err = crypto.SignHashB64(crypto.ToBytes(tx.Hash), r.Wallet.KP)
+	if err != nil {
+		return model.Transaction{}, false
+	}
+	return tx, true
+}
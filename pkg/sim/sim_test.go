@@ -0,0 +1,79 @@
+package sim
+
+import (
+	"coins/pkg/transport"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	// The relays log every message they handle
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// waitGrown waits until the first node of the group is more than grow blocks past the height
+func waitGrown(t *testing.T, group []*Node, height uint64, grow uint64, timeout time.Duration) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for {
+		h, _ := group[0].Head()
+		if h > height+grow {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("node %v did not grow past %v within %v", group[0].Host, height+grow, timeout)
+		}
+		time.Sleep(POLL_INTERVAL)
+	}
+}
+
+func TestPartitionConverges(t *testing.T) {
+	s, err := New(Config{
+		Nodes:   4,
+		Miners:  4,
+		Peers:   3,
+		Link:    transport.Link{Latency: time.Millisecond * 5, Jitter: time.Millisecond * 5},
+		Seed:    1,
+		Threads: 1,
+	})
+	if err != nil {
+		t.Fatalf("could not create simulation with error %v", err)
+	}
+	s.Start()
+	defer s.StopMining()
+	if err := s.WaitHeight(3, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	s.SendTransactions(10)
+	// Both halves mine their own fork while they cannot reach each other
+	a, b := s.Halves()
+	s.Partition(a, b)
+	heightA, _ := a[0].Head()
+	heightB, _ := b[0].Head()
+	waitGrown(t, a, heightA, 2, time.Minute)
+	waitGrown(t, b, heightB, 2, time.Minute)
+	s.SendTransactions(10)
+	// Forks that keep growing on both sides could outrun the undo window, a single miner breaks ties between forks of the same height
+	s.StopMining()
+	s.Heal()
+	s.Nodes[0].Relay.StartMining()
+	if err := s.WaitConverged(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	s.StopMining()
+	if err := s.CheckSupply(); err != nil {
+		t.Fatal(err)
+	}
+	// One of the halves had to give up its fork
+	reorgs := 0
+	for _, node := range s.Nodes {
+		reorgs += node.ReorgCount()
+	}
+	if reorgs == 0 {
+		t.Fatal("no node switched to the fork of the other half")
+	}
+}
@@ -0,0 +1,490 @@
+package storage
+
+import (
+	"coins/pkg/crypto"
+	"coins/pkg/fsutil"
+	"coins/pkg/model"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// SegmentSize is the size in bytes after which we start a new block segment
+const SegmentSize = 16 << 20
+
+// entrySize is the size of a single index entry: id(8) segment(4) offset(8) length(4) hash(32)
+const entrySize = 56
+
+const indexFile = "blocks.idx"
+const stateFile = "chainstate.json"
+const snapshotDir = "snapshots"
+
+type entry struct {
+	ID      uint64 // ID of the block
+	Segment uint32 // Number of the segment file the block is stored in
+	Offset  uint64 // Offset of the block record inside the segment
+	Length  uint32 // Length of the serialized block
+	Hash    string // Hash of the block
+}
+
+// DiskStore appends blocks to segment files and keeps an index of where each block is stored.
+// The chainstate is persisted separately, so blocks never have to be rewritten
+type DiskStore struct {
+	mutex       *sync.Mutex
+	dir         string
+	entries     []entry
+	index       *os.File
+	segment     *os.File
+	segmentNum  uint32
+	segmentSize uint64
+}
+
+func OpenDiskStore(dir string) (*DiskStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("could not create store directory with error %v", err)
+	}
+	ds := &DiskStore{mutex: &sync.Mutex{}, dir: dir, entries: []entry{}}
+	// Read the index
+	bin, err := ioutil.ReadFile(filepath.Join(dir, indexFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("could not read block index with error %v", err)
+	}
+	for i := 0; i+entrySize <= len(bin); i += entrySize {
+		ds.entries = append(ds.entries, decodeEntry(bin[i:i+entrySize]))
+	}
+	ds.index, err = os.OpenFile(filepath.Join(dir, indexFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open block index with error %v", err)
+	}
+	// Continue writing to the last segment
+	if len(ds.entries) > 0 {
+		ds.segmentNum = ds.entries[len(ds.entries)-1].Segment
+	}
+	err = ds.openSegment(ds.segmentNum)
+	if err != nil {
+		return nil, err
+	}
+	err = ds.recover(len(bin))
+	if err != nil {
+		return nil, err
+	}
+	return ds, nil
+}
+
+// recover drops index entries and segment data that were only partially written before a crash
+func (ds *DiskStore) recover(indexSize int) error {
+	valid := len(ds.entries)
+	// Entries must point at data that actually exists in their segment
+	for valid > 0 {
+		e := ds.entries[valid-1]
+		info, err := os.Stat(ds.segmentPath(e.Segment))
+		if err == nil && e.Offset+uint64(e.Length) <= uint64(info.Size()) {
+			break
+		}
+		valid--
+	}
+	// Find where the valid data ends
+	segment, end := uint32(0), uint64(0)
+	if valid > 0 {
+		last := ds.entries[valid-1]
+		segment, end = last.Segment, last.Offset+uint64(last.Length)
+	}
+	// Find the last segment that was created, it may have no entries yet
+	ds.segmentNum = segment
+	for num := segment + 1; ; num++ {
+		if _, err := os.Stat(ds.segmentPath(num)); err != nil {
+			break
+		}
+		ds.segmentNum = num
+	}
+	// Nothing to do if the index and the segments end at the same block
+	info, err := os.Stat(ds.segmentPath(segment))
+	if err != nil {
+		return fmt.Errorf("could not stat segment %v with error %v", segment, err)
+	}
+	if valid == len(ds.entries) && indexSize == valid*entrySize && ds.segmentNum == segment && uint64(info.Size()) == end {
+		return nil
+	}
+	log.Printf("[STORE] recovering block store, keeping %v of %v indexed blocks\n", valid, len(ds.entries))
+	return ds.truncateAt(valid, segment, end)
+}
+
+func (ds *DiskStore) Append(block *model.Block) error {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	if len(ds.entries) > 0 && ds.entries[len(ds.entries)-1].ID+1 != block.ID {
+		return fmt.Errorf("block %v does not follow stored head %v", block.ID, ds.entries[len(ds.entries)-1].ID)
+	}
+	hash := crypto.ToBytes(block.Hash)
+	if len(hash) != 32 {
+		return fmt.Errorf("block %v has malformed hash %v", block.ID, block.Hash)
+	}
+	// Serialize the block
+	bin, err := json.Marshal(block)
+	if err != nil {
+		return fmt.Errorf("could not serialize block with error %v", err)
+	}
+	// Start a new segment once the current one is full
+	if ds.segmentSize > 0 && ds.segmentSize+uint64(len(bin)) > SegmentSize {
+		ds.segment.Close()
+		err = ds.openSegment(ds.segmentNum + 1)
+		if err != nil {
+			return err
+		}
+	}
+	// Append the block to the segment
+	e := entry{ID: block.ID, Segment: ds.segmentNum, Offset: ds.segmentSize, Length: uint32(len(bin)), Hash: block.Hash}
+	_, err = ds.segment.Write(bin)
+	if err != nil {
+		return fmt.Errorf("could not write block with error %v", err)
+	}
+	ds.segmentSize += uint64(len(bin))
+	// Append the entry to the index
+	_, err = ds.index.Write(encodeEntry(e))
+	if err != nil {
+		return fmt.Errorf("could not write block index with error %v", err)
+	}
+	ds.entries = append(ds.entries, e)
+	return nil
+}
+
+func (ds *DiskStore) Truncate(id uint64) error {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	idx, ok := ds.position(id)
+	if !ok {
+		return fmt.Errorf("block %v is not stored", id)
+	}
+	// Nothing to do if the block is already our head
+	if idx == len(ds.entries)-1 {
+		return nil
+	}
+	return ds.truncateAt(idx+1, ds.entries[idx+1].Segment, ds.entries[idx+1].Offset)
+}
+
+func (ds *DiskStore) Reset() error {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	return ds.truncateAt(0, 0, 0)
+}
+
+// Prune drops whole segments, so blocks before the id that share a segment with it are kept
+func (ds *DiskStore) Prune(id uint64) error {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	idx, ok := ds.position(id)
+	if !ok {
+		return nil
+	}
+	// Find the first block in the segment of the block
+	segment := ds.entries[idx].Segment
+	for idx > 0 && ds.entries[idx-1].Segment == segment {
+		idx--
+	}
+	if idx == 0 {
+		return nil
+	}
+	// Rewrite the index without the pruned blocks before their data goes away
+	kept := append([]entry{}, ds.entries[idx:]...)
+	bin := make([]byte, 0, len(kept)*entrySize)
+	for _, e := range kept {
+		bin = append(bin, encodeEntry(e)...)
+	}
+	ds.index.Close()
+	err := fsutil.WriteFileAtomic(filepath.Join(ds.dir, indexFile), bin, 0644)
+	if err != nil {
+		return fmt.Errorf("could not rewrite block index with error %v", err)
+	}
+	ds.index, err = os.OpenFile(filepath.Join(ds.dir, indexFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open block index with error %v", err)
+	}
+	// Remove the segments of the pruned blocks
+	for num := ds.entries[0].Segment; num < segment; num++ {
+		err = os.Remove(ds.segmentPath(num))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove segment %v with error %v", num, err)
+		}
+	}
+	ds.entries = kept
+	return nil
+}
+
+func (ds *DiskStore) Block(id uint64) (*model.Block, error) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	idx, ok := ds.position(id)
+	if !ok {
+		return nil, fmt.Errorf("block %v is not stored", id)
+	}
+	e := ds.entries[idx]
+	// Read the record from its segment
+	f, err := os.Open(ds.segmentPath(e.Segment))
+	if err != nil {
+		return nil, fmt.Errorf("could not open segment %v with error %v", e.Segment, err)
+	}
+	defer f.Close()
+	bin := make([]byte, e.Length)
+	_, err = f.ReadAt(bin, int64(e.Offset))
+	if err != nil {
+		return nil, fmt.Errorf("could not read block %v with error %v", id, err)
+	}
+	return decodeBlock(e, bin)
+}
+
+func (ds *DiskStore) Blocks() ([]*model.Block, error) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	blocks := make([]*model.Block, 0, len(ds.entries))
+	// Read each segment once and cut the blocks out of it
+	var segment []byte
+	loaded := -1
+	for _, e := range ds.entries {
+		if int(e.Segment) != loaded {
+			bin, err := ioutil.ReadFile(ds.segmentPath(e.Segment))
+			if err != nil {
+				return nil, fmt.Errorf("could not read segment %v with error %v", e.Segment, err)
+			}
+			segment = bin
+			loaded = int(e.Segment)
+		}
+		if e.Offset+uint64(e.Length) > uint64(len(segment)) {
+			return nil, fmt.Errorf("block %v exceeds segment %v", e.ID, e.Segment)
+		}
+		block, err := decodeBlock(e, segment[e.Offset:e.Offset+uint64(e.Length)])
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, block)
+	}
+	return blocks, nil
+}
+
+func (ds *DiskStore) Head() (uint64, string, bool) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	if len(ds.entries) == 0 {
+		return 0, "", false
+	}
+	head := ds.entries[len(ds.entries)-1]
+	return head.ID, head.Hash, true
+}
+
+func (ds *DiskStore) Hash(id uint64) (string, bool) {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	idx, ok := ds.position(id)
+	if !ok {
+		return "", false
+	}
+	return ds.entries[idx].Hash, true
+}
+
+func (ds *DiskStore) SaveState(state *State) error {
+	bin, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("could not serialize chainstate with error %v", err)
+	}
+	// The chainstate may never be ahead of the blocks on disk
+	err = ds.sync()
+	if err != nil {
+		return err
+	}
+	err = fsutil.WriteFileAtomic(filepath.Join(ds.dir, stateFile), bin, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write chainstate with error %v", err)
+	}
+	return nil
+}
+
+func (ds *DiskStore) LoadState() (*State, error) {
+	bin, err := ioutil.ReadFile(filepath.Join(ds.dir, stateFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read chainstate with error %v", err)
+	}
+	var state State
+	err = json.Unmarshal(bin, &state)
+	if err != nil {
+		return nil, fmt.Errorf("could not deserialize chainstate with error %v", err)
+	}
+	return &state, nil
+}
+
+func (ds *DiskStore) SaveSnapshot(snap *Snapshot) error {
+	dir := filepath.Join(ds.dir, snapshotDir)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return fmt.Errorf("could not create snapshot directory with error %v", err)
+	}
+	// Zero padded heights make the file names sort by height
+	err = WriteSnapshot(filepath.Join(dir, fmt.Sprintf("%020d-%v.json", snap.Height, snap.BlockHash)), snap)
+	if err != nil {
+		return err
+	}
+	// Drop the oldest snapshots
+	names, err := ds.snapshotNames()
+	if err != nil {
+		return err
+	}
+	for i := SnapshotsKept; i < len(names); i++ {
+		os.Remove(filepath.Join(dir, names[i]))
+	}
+	return nil
+}
+
+func (ds *DiskStore) Snapshots() ([]*Snapshot, error) {
+	names, err := ds.snapshotNames()
+	if err != nil {
+		return nil, err
+	}
+	snaps := []*Snapshot{}
+	for _, name := range names {
+		snap, err := ReadSnapshot(filepath.Join(ds.dir, snapshotDir, name))
+		if err != nil {
+			log.Printf("[STORE] ignoring snapshot %v with error %v\n", name, err)
+			continue
+		}
+		snaps = append(snaps, snap)
+	}
+	return snaps, nil
+}
+
+// snapshotNames lists the snapshot files, newest first
+func (ds *DiskStore) snapshotNames() ([]string, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(ds.dir, snapshotDir))
+	if os.IsNotExist(err) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not list snapshots with error %v", err)
+	}
+	names := []string{}
+	for i := len(infos) - 1; i >= 0; i-- {
+		if strings.HasSuffix(infos[i].Name(), ".json") {
+			names = append(names, infos[i].Name())
+		}
+	}
+	return names, nil
+}
+
+func (ds *DiskStore) Close() error {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	ds.segment.Close()
+	return ds.index.Close()
+}
+
+// sync flushes the segment and the index to disk
+func (ds *DiskStore) sync() error {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	err := ds.segment.Sync()
+	if err != nil {
+		return fmt.Errorf("could not sync segment %v with error %v", ds.segmentNum, err)
+	}
+	err = ds.index.Sync()
+	if err != nil {
+		return fmt.Errorf("could not sync block index with error %v", err)
+	}
+	return nil
+}
+
+// truncateAt drops the entry at position idx and everything after it, which begins in the segment at the offset
+func (ds *DiskStore) truncateAt(idx int, segment uint32, offset uint64) error {
+	// Shorten the index first, so a crash never leaves entries pointing at missing data
+	err := ds.index.Truncate(int64(idx * entrySize))
+	if err != nil {
+		return fmt.Errorf("could not truncate block index with error %v", err)
+	}
+	// Remove the segments that only contain dropped blocks
+	ds.segment.Close()
+	for num := segment + 1; num <= ds.segmentNum; num++ {
+		err = os.Remove(ds.segmentPath(num))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("could not remove segment %v with error %v", num, err)
+		}
+	}
+	// Cut the dropped blocks off the segment and continue writing there
+	err = os.Truncate(ds.segmentPath(segment), int64(offset))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("could not truncate segment %v with error %v", segment, err)
+	}
+	ds.entries = ds.entries[:idx]
+	return ds.openSegment(segment)
+}
+
+// openSegment opens the segment with the specified number for appending
+func (ds *DiskStore) openSegment(num uint32) error {
+	f, err := os.OpenFile(ds.segmentPath(num), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open segment %v with error %v", num, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("could not stat segment %v with error %v", num, err)
+	}
+	ds.segment = f
+	ds.segmentNum = num
+	ds.segmentSize = uint64(info.Size())
+	return nil
+}
+
+func (ds *DiskStore) segmentPath(num uint32) string {
+	return filepath.Join(ds.dir, fmt.Sprintf("blocks-%06d.dat", num))
+}
+
+// position returns the position of the entry of the block with the specified id
+func (ds *DiskStore) position(id uint64) (int, bool) {
+	if len(ds.entries) == 0 || id < ds.entries[0].ID {
+		return 0, false
+	}
+	idx := id - ds.entries[0].ID
+	if idx >= uint64(len(ds.entries)) {
+		return 0, false
+	}
+	return int(idx), true
+}
+
+func encodeEntry(e entry) []byte {
+	bin := make([]byte, entrySize)
+	binary.BigEndian.PutUint64(bin[0:8], e.ID)
+	binary.BigEndian.PutUint32(bin[8:12], e.Segment)
+	binary.BigEndian.PutUint64(bin[12:20], e.Offset)
+	binary.BigEndian.PutUint32(bin[20:24], e.Length)
+	copy(bin[24:56], crypto.ToBytes(e.Hash))
+	return bin
+}
+
+func decodeEntry(bin []byte) entry {
+	return entry{
+		ID:      binary.BigEndian.Uint64(bin[0:8]),
+		Segment: binary.BigEndian.Uint32(bin[8:12]),
+		Offset:  binary.BigEndian.Uint64(bin[12:20]),
+		Length:  binary.BigEndian.Uint32(bin[20:24]),
+		Hash:    hex.EncodeToString(bin[24:56]),
+	}
+}
+
+func decodeBlock(e entry, bin []byte) (*model.Block, error) {
+	var block model.Block
+	err := json.Unmarshal(bin, &block)
+	if err != nil {
+		return nil, fmt.Errorf("could not deserialize block %v with error %v", e.ID, err)
+	}
+	if block.ID != e.ID || block.Hash != e.Hash {
+		return nil, fmt.Errorf("stored block %v does not match its index entry", e.ID)
+	}
+	return &block, nil
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// appendFile appends the data to the file, as a write that did not make it into the index would
+func appendFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// truncateFile cuts the amount of bytes off the end of the file, as a torn write would
+func truncateFile(t *testing.T, path string, cut int64) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-cut); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiskStoreRecovery(t *testing.T) {
+	bc := testChain(t, 4)
+	segment := func(dir string, num uint32) string {
+		return (&DiskStore{dir: dir}).segmentPath(num)
+	}
+	tests := []struct {
+		name  string
+		crash func(t *testing.T, dir string)
+		head  uint64 // head of the recovered store
+		empty bool   // whether no block survives
+	}{
+		{
+			name:  "clean shutdown",
+			crash: func(t *testing.T, dir string) {},
+			head:  4,
+		},
+		{
+			name: "torn block",
+			crash: func(t *testing.T, dir string) {
+				truncateFile(t, segment(dir, 0), 10)
+			},
+			head: 3,
+		},
+		{
+			name: "torn index entry",
+			crash: func(t *testing.T, dir string) {
+				truncateFile(t, filepath.Join(dir, indexFile), entrySize/2)
+			},
+			head: 3,
+		},
+		{
+			name: "block without an index entry",
+			crash: func(t *testing.T, dir string) {
+				appendFile(t, segment(dir, 0), []byte(`{"ID":5`))
+			},
+			head: 4,
+		},
+		{
+			name: "segment without an index entry",
+			crash: func(t *testing.T, dir string) {
+				appendFile(t, segment(dir, 1), []byte(`{"ID":5`))
+			},
+			head: 4,
+		},
+		{
+			name: "missing segment",
+			crash: func(t *testing.T, dir string) {
+				if err := os.Remove(segment(dir, 0)); err != nil {
+					t.Fatal(err)
+				}
+			},
+			empty: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			ds, err := OpenDiskStore(dir)
+			if err != nil {
+				t.Fatalf("could not open store with error %v", err)
+			}
+			for _, block := range bc.Blocks {
+				if err := ds.Append(block); err != nil {
+					t.Fatalf("could not append block %v with error %v", block.ID, err)
+				}
+			}
+			ds.Close()
+			test.crash(t, dir)
+			ds, err = OpenDiskStore(dir)
+			if err != nil {
+				t.Fatalf("could not reopen store with error %v", err)
+			}
+			defer ds.Close()
+			// Only complete blocks are left and the store continues after them
+			head, hash, ok := ds.Head()
+			if test.empty {
+				if ok {
+					t.Fatalf("store without segments has head %v", head)
+				}
+			} else if !ok || head != test.head || hash != bc.Blocks[head].Hash {
+				t.Fatalf("recovered store has head %v instead of %v", head, test.head)
+			}
+			blocks, err := ds.Blocks()
+			if err != nil {
+				t.Fatalf("could not read recovered blocks with error %v", err)
+			}
+			if len(blocks) != len(ds.entries) {
+				t.Fatalf("read %v of %v recovered blocks", len(blocks), len(ds.entries))
+			}
+			for _, block := range bc.Blocks[len(blocks):] {
+				if err := ds.Append(block); err != nil {
+					t.Fatalf("could not append block %v after recovery with error %v", block.ID, err)
+				}
+			}
+			if _, err := os.Stat(segment(dir, 1)); err == nil {
+				t.Fatal("segment without blocks was kept")
+			}
+			// The repaired store opens without another recovery
+			ds.Close()
+			ds, err = OpenDiskStore(dir)
+			if err != nil {
+				t.Fatalf("could not reopen recovered store with error %v", err)
+			}
+			if head, _, _ := ds.Head(); head != 4 {
+				t.Fatalf("reopened store has head %v instead of 4", head)
+			}
+		})
+	}
+}
@@ -0,0 +1,174 @@
+package storage
+
+import (
+	"coins/pkg/model"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// MemoryStore keeps everything in memory, it is meant for tests and throwaway nodes
+type MemoryStore struct {
+	mutex  *sync.Mutex
+	blocks []*model.Block
+	state  []byte
+	snaps  [][]byte
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{mutex: &sync.Mutex{}, blocks: []*model.Block{}}
+}
+
+func (ms *MemoryStore) Append(block *model.Block) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if len(ms.blocks) > 0 && ms.blocks[len(ms.blocks)-1].ID+1 != block.ID {
+		return fmt.Errorf("block %v does not follow stored head %v", block.ID, ms.blocks[len(ms.blocks)-1].ID)
+	}
+	// store a copy so later changes by the caller dont leak into the store
+	alloc := *block
+	ms.blocks = append(ms.blocks, &alloc)
+	return nil
+}
+
+func (ms *MemoryStore) Truncate(id uint64) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	idx, ok := ms.index(id)
+	if !ok {
+		return fmt.Errorf("block %v is not stored", id)
+	}
+	ms.blocks = ms.blocks[:idx+1]
+	return nil
+}
+
+func (ms *MemoryStore) Reset() error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.blocks = []*model.Block{}
+	return nil
+}
+
+func (ms *MemoryStore) Prune(id uint64) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	idx, ok := ms.index(id)
+	if !ok {
+		return nil
+	}
+	ms.blocks = append([]*model.Block{}, ms.blocks[idx:]...)
+	return nil
+}
+
+func (ms *MemoryStore) Block(id uint64) (*model.Block, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	idx, ok := ms.index(id)
+	if !ok {
+		return nil, fmt.Errorf("block %v is not stored", id)
+	}
+	alloc := *ms.blocks[idx]
+	return &alloc, nil
+}
+
+func (ms *MemoryStore) Blocks() ([]*model.Block, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	blocks := make([]*model.Block, len(ms.blocks))
+	for i, block := range ms.blocks {
+		alloc := *block
+		blocks[i] = &alloc
+	}
+	return blocks, nil
+}
+
+func (ms *MemoryStore) Head() (uint64, string, bool) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if len(ms.blocks) == 0 {
+		return 0, "", false
+	}
+	head := ms.blocks[len(ms.blocks)-1]
+	return head.ID, head.Hash, true
+}
+
+func (ms *MemoryStore) Hash(id uint64) (string, bool) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	idx, ok := ms.index(id)
+	if !ok {
+		return "", false
+	}
+	return ms.blocks[idx].Hash, true
+}
+
+func (ms *MemoryStore) SaveState(state *State) error {
+	// Serialize the state so the caller can keep mutating its chainstate
+	bin, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("could not serialize chainstate with error %v", err)
+	}
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.state = bin
+	return nil
+}
+
+func (ms *MemoryStore) LoadState() (*State, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if ms.state == nil {
+		return nil, nil
+	}
+	var state State
+	err := json.Unmarshal(ms.state, &state)
+	if err != nil {
+		return nil, fmt.Errorf("could not deserialize chainstate with error %v", err)
+	}
+	return &state, nil
+}
+
+func (ms *MemoryStore) SaveSnapshot(snap *Snapshot) error {
+	bin, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("could not serialize snapshot with error %v", err)
+	}
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	ms.snaps = append(ms.snaps, bin)
+	if len(ms.snaps) > SnapshotsKept {
+		ms.snaps = ms.snaps[len(ms.snaps)-SnapshotsKept:]
+	}
+	return nil
+}
+
+func (ms *MemoryStore) Snapshots() ([]*Snapshot, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	snaps := []*Snapshot{}
+	for i := len(ms.snaps) - 1; i >= 0; i-- {
+		var snap Snapshot
+		err := json.Unmarshal(ms.snaps[i], &snap)
+		if err != nil {
+			return nil, fmt.Errorf("could not deserialize snapshot with error %v", err)
+		}
+		snaps = append(snaps, &snap)
+	}
+	return snaps, nil
+}
+
+func (ms *MemoryStore) Close() error {
+	return nil
+}
+
+// index returns the position of the block with the specified id
+func (ms *MemoryStore) index(id uint64) (int, bool) {
+	if len(ms.blocks) == 0 || id < ms.blocks[0].ID {
+		return 0, false
+	}
+	idx := id - ms.blocks[0].ID
+	if idx >= uint64(len(ms.blocks)) {
+		return 0, false
+	}
+	return int(idx), true
+}
@@ -0,0 +1,104 @@
+package storage
+
+import (
+	"coins/pkg/blockchain"
+	"coins/pkg/fsutil"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+)
+
+// SnapshotInterval is the amount of blocks between two chainstate snapshots
+const SnapshotInterval = 100
+
+// SnapshotsKept is the amount of snapshots a store keeps around
+const SnapshotsKept = 3
+
+// Snapshot is the chainstate after a specific block together with its digest
+type Snapshot struct {
+	Height     uint64 // ID of the block the snapshot was taken after
+	BlockHash  string // Hash of the block the snapshot was taken after
+	Digest     string // Digest of the chainstate
+	Chainstate blockchain.Chainstate
+}
+
+func NewSnapshot(bc *blockchain.BlockChain) *Snapshot {
+	return &Snapshot{
+		Height:     bc.Chainstate.LastBlock.ID,
+		BlockHash:  bc.Chainstate.LastBlock.Hash,
+		Digest:     bc.Chainstate.Digest(),
+		Chainstate: bc.Chainstate,
+	}
+}
+
+// Verify checks that the snapshot is internally consistent and that its chainstate is the one its last block
+// commits to, as Bootstrap does
+func (snap *Snapshot) Verify() error {
+	last := snap.Chainstate.LastBlock
+	if last.ID != snap.Height || last.Hash != snap.BlockHash {
+		return fmt.Errorf("snapshot chainstate does not end at block %v", snap.Height)
+	}
+	if last.Hash != last.GetHash() {
+		return fmt.Errorf("snapshot block %v does not match its hash", last.ID)
+	}
+	if snap.Chainstate.Wallets == nil {
+		return fmt.Errorf("snapshot contains no wallets")
+	}
+	if digest := snap.Chainstate.Digest(); digest != snap.Digest {
+		return fmt.Errorf("snapshot digest %v does not match chainstate digest %v", snap.Digest, digest)
+	}
+	if root := snap.Chainstate.StateRoot(); root != last.StateRoot {
+		return fmt.Errorf("snapshot chainstate root %v does not match the state root %v of block %v", root, last.StateRoot, last.ID)
+	}
+	return nil
+}
+
+// WriteSnapshot exports the snapshot to a file
+func WriteSnapshot(path string, snap *Snapshot) error {
+	bin, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("could not serialize snapshot with error %v", err)
+	}
+	err = fsutil.WriteFileAtomic(path, bin, 0644)
+	if err != nil {
+		return fmt.Errorf("could not write snapshot with error %v", err)
+	}
+	return nil
+}
+
+// ReadSnapshot imports a snapshot from a file and verifies it
+func ReadSnapshot(path string) (*Snapshot, error) {
+	bin, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read snapshot with error %v", err)
+	}
+	var snap Snapshot
+	err = json.Unmarshal(bin, &snap)
+	if err != nil {
+		return nil, fmt.Errorf("could not deserialize snapshot with error %v", err)
+	}
+	err = snap.Verify()
+	if err != nil {
+		return nil, err
+	}
+	return &snap, nil
+}
+
+// Import installs a snapshot into the store. An empty store is seeded with the snapshot block,
+// so the node can follow the chain from there without the history before it
+func Import(s Store, snap *Snapshot) error {
+	err := snap.Verify()
+	if err != nil {
+		return err
+	}
+	if _, _, ok := s.Head(); !ok {
+		block := snap.Chainstate.LastBlock
+		err = s.Append(&block)
+		if err != nil {
+			return fmt.Errorf("could not seed store with snapshot block with error %v", err)
+		}
+	} else if hash, ok := s.Hash(snap.Height); !ok || hash != snap.BlockHash {
+		return fmt.Errorf("snapshot block %v is not part of the stored chain", snap.Height)
+	}
+	return s.SaveSnapshot(snap)
+}
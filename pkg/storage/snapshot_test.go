@@ -0,0 +1,145 @@
+package storage
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// copySnapshot returns a deep copy of the snapshot, so a test can tamper with it
+func copySnapshot(t *testing.T, snap *Snapshot) *Snapshot {
+	t.Helper()
+	bin, err := json.Marshal(snap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var copied Snapshot
+	if err := json.Unmarshal(bin, &copied); err != nil {
+		t.Fatal(err)
+	}
+	return &copied
+}
+
+func TestSnapshotVerify(t *testing.T) {
+	snap := NewSnapshot(testChain(t, 3))
+	tests := []struct {
+		name   string
+		tamper func(snap *Snapshot)
+		err    string
+	}{
+		{
+			name:   "valid snapshot",
+			tamper: func(snap *Snapshot) {},
+		},
+		{
+			name: "other height",
+			tamper: func(snap *Snapshot) {
+				snap.Height++
+			},
+			err: "does not end at block",
+		},
+		{
+			name: "balance with a recomputed digest",
+			tamper: func(snap *Snapshot) {
+				snap.Chainstate.Wallets[testWallet.Address].Amount += 100
+				snap.Digest = snap.Chainstate.Digest()
+			},
+			err: "does not match the state root",
+		},
+		{
+			name: "block committing to a forged balance",
+			tamper: func(snap *Snapshot) {
+				snap.Chainstate.Wallets[testWallet.Address].Amount += 100
+				snap.Chainstate.LastBlock.StateRoot = snap.Chainstate.StateRoot()
+				snap.Digest = snap.Chainstate.Digest()
+			},
+			err: "does not match its hash",
+		},
+		{
+			name: "balance without a new digest",
+			tamper: func(snap *Snapshot) {
+				snap.Chainstate.Wallets[testWallet.Address].Amount += 100
+			},
+			err: "does not match chainstate digest",
+		},
+		{
+			name: "no wallets",
+			tamper: func(snap *Snapshot) {
+				snap.Chainstate.Wallets = nil
+			},
+			err: "contains no wallets",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			snap := copySnapshot(t, snap)
+			test.tamper(snap)
+			err := snap.Verify()
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("valid snapshot rejected with error %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("snapshot verified with error %v instead of %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestImport(t *testing.T) {
+	bc := testChain(t, 3)
+	snap := NewSnapshot(bc)
+	forged := copySnapshot(t, snap)
+	forged.Chainstate.Wallets[testWallet.Address].Amount += 100
+	forged.Digest = forged.Chainstate.Digest()
+	tests := []struct {
+		name   string
+		stored int // amount of blocks of bc in the store
+		other  bool
+		snap   *Snapshot
+		err    bool
+	}{
+		{name: "empty store", snap: snap},
+		{name: "store holding the snapshot block", stored: 4, snap: snap},
+		{name: "store on another chain", stored: 4, other: true, snap: snap, err: true},
+		{name: "forged snapshot", snap: forged, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := NewMemoryStore()
+			blocks := bc.Blocks
+			if test.other {
+				blocks = testChain(t, 3).Blocks
+			}
+			for _, block := range blocks[:test.stored] {
+				if err := s.Append(block); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := Import(s, test.snap)
+			if test.err {
+				if err == nil {
+					t.Fatal("imported a snapshot that does not belong to the store")
+				}
+				// A rejected snapshot leaves the store as it was
+				if head, _, ok := s.Head(); test.stored == 0 && ok {
+					t.Fatalf("rejected snapshot seeded the store with block %v", head)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("could not import snapshot with error %v", err)
+			}
+			// The imported snapshot is enough to load the chain up to its block
+			chain, err := Load(s)
+			if err != nil {
+				t.Fatalf("could not load imported snapshot with error %v", err)
+			}
+			if chain.Chainstate.LastBlock.Hash != snap.BlockHash || chain.Chainstate.StateRoot() != snap.Chainstate.LastBlock.StateRoot {
+				t.Fatalf("loaded chain ends at %v instead of the snapshot block %v", chain.Chainstate.LastBlock.ID, snap.Height)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"coins/pkg/blockchain"
+	"coins/pkg/model"
+	"fmt"
+	"log"
+)
+
+// Store persists the blocks of a chain and the chainstate that results from them.
+// Blocks are stored in sequence, a store never contains gaps
+type Store interface {
+	Append(block *model.Block) error       // Append stores the block after the current head
+	Truncate(id uint64) error              // Truncate drops all blocks after the block with the specified id
+	Reset() error                          // Reset drops all blocks
+	Prune(id uint64) error                 // Prune drops blocks before the block with the specified id, it may keep some of them
+	Block(id uint64) (*model.Block, error) // Block reads a single stored block
+	Blocks() ([]*model.Block, error)       // Blocks reads all stored blocks in order
+	Head() (uint64, string, bool)          // Head returns id and hash of the last stored block, false if the store is empty
+	Hash(id uint64) (string, bool)         // Hash returns the hash of a stored block
+	SaveState(state *State) error          // SaveState replaces the persisted chainstate
+	LoadState() (*State, error)            // LoadState reads the persisted chainstate, nil if none was saved
+	SaveSnapshot(snap *Snapshot) error     // SaveSnapshot stores the snapshot, dropping old ones beyond SnapshotsKept
+	Snapshots() ([]*Snapshot, error)       // Snapshots reads the stored snapshots, newest first
+	Close() error
+}
+
+// State is the part of a blockchain that is derived from its blocks
+type State struct {
+	Chainstate blockchain.Chainstate
+	Digest     string // Digest of the chainstate, used to detect a corrupted state
+	Undo       map[uint64]*blockchain.BlockUndo
+}
+
+// Commit brings the store in line with the blockchain, dropping stored blocks that are no longer part of it
+func Commit(s Store, bc *blockchain.BlockChain) error {
+	// Find the last stored block that is still part of the chain
+	head, hash, ok := s.Head()
+	for ok {
+		block := bc.GetBlock(head)
+		if block != nil && block.Hash == hash {
+			break
+		}
+		if head == 0 {
+			ok = false
+			break
+		}
+		head--
+		hash, ok = s.Hash(head)
+	}
+	previous := head
+	// Drop everything after the fork, or everything if we share no block at all
+	var err error
+	if ok {
+		err = s.Truncate(head)
+	} else {
+		err = s.Reset()
+	}
+	if err != nil {
+		return fmt.Errorf("could not drop stale blocks with error %v", err)
+	}
+	// Append the blocks the store is missing
+	for _, block := range bc.Blocks {
+		if ok && block.ID <= head {
+			continue
+		}
+		err := s.Append(block)
+		if err != nil {
+			return fmt.Errorf("could not append block %v with error %v", block.ID, err)
+		}
+	}
+	// Drop the blocks a pruned chain no longer keeps
+	if bc.Pruned() {
+		err = s.Prune(bc.Blocks[0].ID)
+		if err != nil {
+			return fmt.Errorf("could not prune store with error %v", err)
+		}
+	}
+	// Persist the chainstate
+	err = s.SaveState(&State{Chainstate: bc.Chainstate, Digest: bc.Chainstate.Digest(), Undo: bc.Undo})
+	if err != nil {
+		return err
+	}
+	// Take a snapshot whenever the chain crossed a snapshot interval
+	if !ok || bc.Chainstate.LastBlock.ID/SnapshotInterval > previous/SnapshotInterval {
+		err = s.SaveSnapshot(NewSnapshot(bc))
+		if err != nil {
+			return fmt.Errorf("could not save snapshot with error %v", err)
+		}
+	}
+	return nil
+}
+
+// Load reads a blockchain from the store. It uses the last committed chainstate if it is intact,
+// otherwise the latest valid snapshot plus the blocks after it, and only as a last resort replays the whole chain
+func Load(s Store) (*blockchain.BlockChain, error) {
+	blocks, err := s.Blocks()
+	if err != nil {
+		return nil, fmt.Errorf("could not read blocks with error %v", err)
+	}
+	// The stored blocks have to form a chain
+	for i := 1; i < len(blocks); i++ {
+		if blocks[i].ID != blocks[i-1].ID+1 || blocks[i].Previous != blocks[i-1].Hash {
+			return nil, fmt.Errorf("stored block %v does not link to block %v", blocks[i].ID, blocks[i-1].ID)
+		}
+	}
+	bc := &blockchain.BlockChain{Blocks: blocks}
+	// Try the chainstate of the last commit
+	state, err := s.LoadState()
+	if err != nil {
+		log.Printf("[STORE] could not read chainstate with error %v\n", err)
+	} else if state != nil && len(blocks) > 0 && state.Chainstate.LastBlock.Hash == blocks[len(blocks)-1].Hash {
+		if state.Digest == state.Chainstate.Digest() {
+			bc.Chainstate = state.Chainstate
+			bc.Undo = state.Undo
+			bc.Reindex()
+			return bc, nil
+		}
+		log.Println("[STORE] committed chainstate does not match its digest")
+	}
+	// Try the snapshots, newest first
+	snaps, err := s.Snapshots()
+	if err != nil {
+		log.Printf("[STORE] could not read snapshots with error %v\n", err)
+	}
+	for _, snap := range snaps {
+		err = snap.Verify()
+		if err != nil {
+			log.Printf("[STORE] skipping snapshot at block %v with error %v\n", snap.Height, err)
+			continue
+		}
+		if hash, ok := s.Hash(snap.Height); !ok || hash != snap.BlockHash {
+			continue
+		}
+		log.Printf("[STORE] loading snapshot at block %v\n", snap.Height)
+		return loadSnapshot(blocks, snap)
+	}
+	// Replay the whole chain
+	if len(blocks) > 0 && blocks[0].ID != 0 {
+		return nil, fmt.Errorf("no valid chainstate for a chain starting at block %v", blocks[0].ID)
+	}
+	bc.ProcessAll()
+	return bc, nil
+}
+
+// loadSnapshot installs the snapshot and replays the blocks after it
+func loadSnapshot(blocks []*model.Block, snap *Snapshot) (*blockchain.BlockChain, error) {
+	pos := snap.Height - blocks[0].ID
+	bc := &blockchain.BlockChain{
+		Blocks:     blocks[:pos+1],
+		Chainstate: snap.Chainstate,
+		Undo:       make(map[uint64]*blockchain.BlockUndo),
+	}
+	bc.Reindex()
+	for _, block := range blocks[pos+1:] {
+		res := bc.ValidateBlock(*block)
+		if res != blockchain.B_ACCEPT {
+			return nil, fmt.Errorf("stored block %v is invalid with reason %v", block.ID, res)
+		}
+		bc.ProcessBlock(*block)
+	}
+	return bc, nil
+}
@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"coins/pkg/blockchain"
+	"coins/pkg/model"
+	"context"
+	"io/ioutil"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// The store logs every recovery
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// testWallet is the miner of the test chains, generating its key is slow
+var testWallet *blockchain.Wallet
+
+// testChain returns a valid chain of the amount of blocks after the genesis block, all mined by the test wallet
+func testChain(t *testing.T, count int) *blockchain.BlockChain {
+	t.Helper()
+	bc := blockchain.NewBlockChain()
+	extendChain(t, bc, count)
+	return bc
+}
+
+// extendChain mines the amount of blocks on top of the chain, the first block registers the test wallet
+func extendChain(t *testing.T, bc *blockchain.BlockChain, count int) {
+	t.Helper()
+	if testWallet == nil {
+		wallet, err := blockchain.NewWallet()
+		if err != nil {
+			t.Fatalf("could not create wallet with error %v", err)
+		}
+		testWallet = wallet
+	}
+	key, err := blockchain.KeyToString(&testWallet.KP.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		head := bc.Chainstate.LastBlock
+		block := model.Block{ID: head.ID + 1, Previous: head.Hash, Miner: testWallet.Address}
+		if bc.Chainstate.Wallets[testWallet.Address] == nil {
+			block.Registrations = []model.Registration{{Wallet: testWallet.Address, PublicKey: key}}
+		}
+		block.TxRoot = block.ComputeTxRoot()
+		root, res := bc.StateRootAfter(block)
+		if res != blockchain.B_ACCEPT {
+			t.Fatalf("could not compute state root with reason=%v", res)
+		}
+		block.StateRoot = root
+		block.Mine(context.Background(), 1, nil)
+		if res := bc.ValidateBlock(block); res != blockchain.B_ACCEPT {
+			t.Fatalf("block %v rejected with reason=%v", block.ID, res)
+		}
+		bc.ProcessBlock(block)
+	}
+}
+
+// prefixChain returns a chain of the blocks of bc up to the block with the id
+func prefixChain(t *testing.T, bc *blockchain.BlockChain, id uint64) *blockchain.BlockChain {
+	t.Helper()
+	prefix := blockchain.NewBlockChain()
+	for _, block := range bc.Blocks[1 : id+1] {
+		if res := prefix.ValidateBlock(*block); res != blockchain.B_ACCEPT {
+			t.Fatalf("block %v rejected with reason=%v", block.ID, res)
+		}
+		prefix.ProcessBlock(*block)
+	}
+	return prefix
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"bytes"
+	"coins/pkg/blockchain"
+	"coins/pkg/model"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+)
+
+// walHeaderSize is the size of the header in front of every log record: length(4) crc32(4)
+const walHeaderSize = 8
+
+// WAL is a write-ahead log of the blocks a node accepted since the store was last committed
+type WAL struct {
+	mutex *sync.Mutex
+	path  string
+	file  *os.File
+}
+
+func OpenWAL(path string) (*WAL, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open write-ahead log with error %v", err)
+	}
+	return &WAL{mutex: &sync.Mutex{}, path: path, file: f}, nil
+}
+
+// Append durably logs the block before the call returns, a nil log keeps nothing
+func (w *WAL) Append(block *model.Block) error {
+	if w == nil {
+		return nil
+	}
+	bin, err := json.Marshal(block)
+	if err != nil {
+		return fmt.Errorf("could not serialize block with error %v", err)
+	}
+	// Prefix the record with its length and checksum so torn writes can be detected
+	record := make([]byte, walHeaderSize+len(bin))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(bin)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(bin))
+	copy(record[walHeaderSize:], bin)
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	_, err = w.file.Write(record)
+	if err != nil {
+		return fmt.Errorf("could not write block to log with error %v", err)
+	}
+	err = w.file.Sync()
+	if err != nil {
+		return fmt.Errorf("could not sync log with error %v", err)
+	}
+	return nil
+}
+
+// Reset empties the log, it must only be called once the logged blocks are committed
+func (w *WAL) Reset() error {
+	if w == nil {
+		return nil
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	err := w.file.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("could not truncate log with error %v", err)
+	}
+	return w.file.Sync()
+}
+
+// Blocks reads the logged blocks in order, stopping at the first torn or corrupt record
+func (w *WAL) Blocks() ([]*model.Block, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	bin, err := ioutil.ReadFile(w.path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read log with error %v", err)
+	}
+	blocks := []*model.Block{}
+	reader := bytes.NewReader(bin)
+	for reader.Len() > 0 {
+		// Read the record header
+		header := make([]byte, walHeaderSize)
+		_, err := io.ReadFull(reader, header)
+		length := binary.BigEndian.Uint32(header[0:4])
+		if err != nil || uint64(length) > uint64(reader.Len()) {
+			log.Printf("[STORE] ignoring torn record at the end of the write-ahead log\n")
+			break
+		}
+		payload := make([]byte, length)
+		io.ReadFull(reader, payload)
+		// A bad checksum means the rest of the log cannot be trusted
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			log.Printf("[STORE] ignoring corrupt record in the write-ahead log\n")
+			break
+		}
+		var block model.Block
+		err = json.Unmarshal(payload, &block)
+		if err != nil {
+			log.Printf("[STORE] ignoring undecodable record in the write-ahead log\n")
+			break
+		}
+		blocks = append(blocks, &block)
+	}
+	return blocks, nil
+}
+
+func (w *WAL) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.file.Close()
+}
+
+// Replay applies the logged blocks to the chain, following the same rollbacks the node made before it stopped.
+// It returns the amount of blocks that were applied
+func Replay(bc *blockchain.BlockChain, w *WAL) (int, error) {
+	blocks, err := w.Blocks()
+	if err != nil {
+		return 0, err
+	}
+	applied := 0
+	for _, block := range blocks {
+		// Skip blocks that already made it into the store
+		if known := bc.GetBlock(block.ID); known != nil && known.Hash == block.Hash {
+			continue
+		}
+		// A logged block below our head means the node switched to a fork
+		if block.ID <= bc.Chainstate.LastBlock.ID {
+			err = bc.Rollback(block.ID - 1)
+			if err != nil {
+				return applied, fmt.Errorf("could not roll back to block %v with error %v", block.ID-1, err)
+			}
+		}
+		res := bc.ValidateBlock(*block)
+		if res != blockchain.B_ACCEPT {
+			return applied, fmt.Errorf("logged block %v is invalid with reason %v", block.ID, res)
+		}
+		bc.ProcessBlock(*block)
+		applied++
+	}
+	return applied, nil
+}
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"coins/pkg/model"
+	"encoding/binary"
+	"hash/crc32"
+	"path/filepath"
+	"testing"
+)
+
+// walRecord frames the payload the way Append does
+func walRecord(payload []byte) []byte {
+	record := make([]byte, walHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+	copy(record[walHeaderSize:], payload)
+	return record
+}
+
+func TestWALBlocks(t *testing.T) {
+	bc := testChain(t, 3)
+	tests := []struct {
+		name   string
+		crash  func(t *testing.T, path string)
+		blocks int // amount of blocks read back
+	}{
+		{
+			name:   "complete records",
+			crash:  func(t *testing.T, path string) {},
+			blocks: 3,
+		},
+		{
+			name: "torn header",
+			crash: func(t *testing.T, path string) {
+				appendFile(t, path, walRecord([]byte(`{"ID":4}`))[:5])
+			},
+			blocks: 3,
+		},
+		{
+			name: "torn payload",
+			crash: func(t *testing.T, path string) {
+				truncateFile(t, path, 10)
+			},
+			blocks: 2,
+		},
+		{
+			name: "corrupt checksum",
+			crash: func(t *testing.T, path string) {
+				record := walRecord([]byte(`{"ID":4}`))
+				record[4] ^= 0xff
+				appendFile(t, path, record)
+				appendFile(t, path, walRecord([]byte(`{"ID":5}`)))
+			},
+			blocks: 3,
+		},
+		{
+			name: "undecodable record",
+			crash: func(t *testing.T, path string) {
+				appendFile(t, path, walRecord([]byte(`{"ID":`)))
+			},
+			blocks: 3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "blocks.wal")
+			w, err := OpenWAL(path)
+			if err != nil {
+				t.Fatalf("could not open log with error %v", err)
+			}
+			defer w.Close()
+			for _, block := range bc.Blocks[1:] {
+				if err := w.Append(block); err != nil {
+					t.Fatalf("could not log block %v with error %v", block.ID, err)
+				}
+			}
+			test.crash(t, path)
+			// Reading stops at the first record that cannot be trusted
+			blocks, err := w.Blocks()
+			if err != nil {
+				t.Fatalf("could not read log with error %v", err)
+			}
+			if len(blocks) != test.blocks {
+				t.Fatalf("read %v blocks instead of %v", len(blocks), test.blocks)
+			}
+			for i, block := range blocks {
+				if block.Hash != bc.Blocks[i+1].Hash {
+					t.Fatalf("logged block %v does not match the appended one", block.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	bc := testChain(t, 4)
+	// The node switched from the last two blocks of bc to a longer fork
+	fork := prefixChain(t, bc, 2)
+	extendChain(t, fork, 3)
+	tests := []struct {
+		name    string
+		stored  uint64         // head of the chain committed to the store
+		logged  []*model.Block // blocks in the log, in order
+		torn    bool           // whether the log ends in a torn record
+		head    string
+		applied int
+	}{
+		{
+			name:    "blocks after the commit",
+			stored:  2,
+			logged:  bc.Blocks[3:],
+			head:    bc.Blocks[4].Hash,
+			applied: 2,
+		},
+		{
+			name:   "blocks already committed",
+			stored: 4,
+			logged: bc.Blocks[3:],
+			head:   bc.Blocks[4].Hash,
+		},
+		{
+			name:    "torn record",
+			stored:  2,
+			logged:  bc.Blocks[3:],
+			torn:    true,
+			head:    bc.Blocks[4].Hash,
+			applied: 2,
+		},
+		{
+			name:    "switch to a fork",
+			stored:  4,
+			logged:  append(append([]*model.Block{}, bc.Blocks[3:]...), fork.Blocks[3:]...),
+			head:    fork.Blocks[5].Hash,
+			applied: 3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "blocks.wal")
+			w, err := OpenWAL(path)
+			if err != nil {
+				t.Fatalf("could not open log with error %v", err)
+			}
+			defer w.Close()
+			for _, block := range test.logged {
+				if err := w.Append(block); err != nil {
+					t.Fatalf("could not log block %v with error %v", block.ID, err)
+				}
+			}
+			if test.torn {
+				appendFile(t, path, walRecord([]byte(`{"ID":5}`))[:10])
+			}
+			chain := prefixChain(t, bc, test.stored)
+			applied, err := Replay(chain, w)
+			if err != nil {
+				t.Fatalf("could not replay log with error %v", err)
+			}
+			if applied != test.applied || chain.Chainstate.LastBlock.Hash != test.head {
+				t.Fatalf("replay applied %v blocks up to %v instead of %v", applied, chain.Chainstate.LastBlock.ID, test.applied)
+			}
+		})
+	}
+}
@@ -0,0 +1,408 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// FIRST_EPHEMERAL_PORT is the first port handed to the outgoing connections of a host
+const FIRST_EPHEMERAL_PORT = 40000
+
+// ACCEPT_QUEUE is the amount of connections that may wait to be accepted by a listener
+const ACCEPT_QUEUE = 16
+
+var ErrRefused = errors.New("connection refused")
+var ErrUnreachable = errors.New("host unreachable")
+
+// Link describes how the network treats the writes from one host to another
+type Link struct {
+	Latency time.Duration // how long a write takes to arrive
+	Jitter  time.Duration // up to how much longer a write may take, writes still arrive in order
+	Loss    float64       // the probability that a write is dropped, a write carries a whole protocol frame
+}
+
+// Network is an in-process network of hosts. Its connections behave like tcp connections, except that the
+// network can delay and drop writes and partition the hosts. Random decisions come from the seed, so a run
+// can be repeated
+type Network struct {
+	mutex     *sync.Mutex
+	rand      *rand.Rand
+	listeners map[string]*memListener
+	ports     map[string]int // the next ephemeral port of each host
+	link      Link
+	links     map[string]Link
+	groups    map[string]int // the partition of each host, hosts without one are in partition 0
+}
+
+func NewNetwork(seed int64) *Network {
+	return &Network{
+		mutex:     &sync.Mutex{},
+		rand:      rand.New(rand.NewSource(seed)),
+		listeners: make(map[string]*memListener),
+		ports:     make(map[string]int),
+		links:     make(map[string]Link),
+		groups:    make(map[string]int),
+	}
+}
+
+// Host returns the transport a relay on the host uses
+func (n *Network) Host(host string) *Memory {
+	return &Memory{network: n, host: host}
+}
+
+// SetDefaultLink sets how writes between hosts without their own link are treated
+func (n *Network) SetDefaultLink(link Link) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.link = link
+}
+
+// SetLink sets how writes between the two hosts are treated, in both directions
+func (n *Network) SetLink(a string, b string, link Link) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.links[linkKey(a, b)] = link
+}
+
+// Partition splits the network into the groups, hosts in different groups cannot reach each other. Hosts that
+// are in no group form a group of their own. Open connections stay open but lose every write across groups
+func (n *Network) Partition(groups ...[]string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, host := range group {
+			n.groups[host] = i + 1
+		}
+	}
+}
+
+// Heal removes all partitions
+func (n *Network) Heal() {
+	n.Partition()
+}
+
+func linkKey(a string, b string) string {
+	if b < a {
+		a, b = b, a
+	}
+	return a + "|" + b
+}
+
+// route decides whether a write from one host to another arrives and when. The caller must hold the lock
+func (n *Network) route(from string, to string) (time.Duration, bool) {
+	if n.groups[from] != n.groups[to] {
+		return 0, false
+	}
+	link, ok := n.links[linkKey(from, to)]
+	if !ok {
+		link = n.link
+	}
+	if link.Loss > 0 && n.rand.Float64() < link.Loss {
+		return 0, false
+	}
+	delay := link.Latency
+	if link.Jitter > 0 {
+		delay += time.Duration(n.rand.Int63n(int64(link.Jitter)))
+	}
+	return delay, true
+}
+
+// Memory is the transport of a single host of a Network
+type Memory struct {
+	network *Network
+	host    string
+}
+
+// Listen accepts connections on the port of the address, the host of the address is ignored
+func (m *Memory) Listen(addr string) (net.Listener, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address %v with error %v", addr, err)
+	}
+	m.network.mutex.Lock()
+	defer m.network.mutex.Unlock()
+	if port == "" || port == "0" {
+		port = strconv.Itoa(m.ephemeral())
+	}
+	local := net.JoinHostPort(m.host, port)
+	if m.network.listeners[local] != nil {
+		return nil, fmt.Errorf("address %v already in use", local)
+	}
+	l := &memListener{network: m.network, addr: memAddr(local), conns: make(chan net.Conn, ACCEPT_QUEUE), done: make(chan struct{}), once: &sync.Once{}}
+	m.network.listeners[local] = l
+	return l, nil
+}
+
+func (m *Memory) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	m.network.mutex.Lock()
+	l := m.network.listeners[addr]
+	if l == nil {
+		m.network.mutex.Unlock()
+		return nil, ErrRefused
+	}
+	if m.network.groups[m.host] != m.network.groups[Host(addr)] {
+		m.network.mutex.Unlock()
+		return nil, ErrUnreachable
+	}
+	local := memAddr(net.JoinHostPort(m.host, strconv.Itoa(m.ephemeral())))
+	m.network.mutex.Unlock()
+	// Each side reads what the other one writes
+	up, down := newPipe(), newPipe()
+	client := newMemConn(m.network, local, l.addr, down, up)
+	server := newMemConn(m.network, l.addr, local, up, down)
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.done:
+		return nil, ErrRefused
+	case <-timer.C:
+		return nil, fmt.Errorf("dial %v timed out", addr)
+	}
+}
+
+// ephemeral returns the next free port of the host. The caller must hold the network lock
+func (m *Memory) ephemeral() int {
+	port := m.network.ports[m.host]
+	if port == 0 {
+		port = FIRST_EPHEMERAL_PORT
+	}
+	m.network.ports[m.host] = port + 1
+	return port
+}
+
+// Host returns the host of the address
+func Host(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+type memAddr string
+
+func (a memAddr) Network() string { return "mem" }
+func (a memAddr) String() string  { return string(a) }
+
+type memListener struct {
+	network *Network
+	addr    memAddr
+	conns   chan net.Conn
+	done    chan struct{}
+	once    *sync.Once
+}
+
+func (l *memListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *memListener) Close() error {
+	l.once.Do(func() {
+		l.network.mutex.Lock()
+		delete(l.network.listeners, string(l.addr))
+		l.network.mutex.Unlock()
+		close(l.done)
+	})
+	return nil
+}
+
+func (l *memListener) Addr() net.Addr {
+	return l.addr
+}
+
+// chunk is a write that becomes readable once it is ready
+type chunk struct {
+	data  []byte
+	ready time.Time
+}
+
+// pipe carries the writes of one side of a connection to the other
+type pipe struct {
+	mutex    *sync.Mutex
+	cond     *sync.Cond
+	chunks   []chunk
+	closed   bool // the writing side closed, the remaining chunks are still read
+	deadline time.Time
+}
+
+func newPipe() *pipe {
+	p := &pipe{mutex: &sync.Mutex{}}
+	p.cond = sync.NewCond(p.mutex)
+	return p
+}
+
+func (p *pipe) push(data []byte, ready time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return
+	}
+	// Keep the writes in order even if an earlier one was delayed longer
+	if n := len(p.chunks); n > 0 && ready.Before(p.chunks[n-1].ready) {
+		ready = p.chunks[n-1].ready
+	}
+	p.chunks = append(p.chunks, chunk{data: data, ready: ready})
+	p.cond.Broadcast()
+}
+
+func (p *pipe) read(b []byte) (int, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for {
+		now := time.Now()
+		if len(p.chunks) > 0 && !p.chunks[0].ready.After(now) {
+			n := copy(b, p.chunks[0].data)
+			p.chunks[0].data = p.chunks[0].data[n:]
+			if len(p.chunks[0].data) == 0 {
+				p.chunks = p.chunks[1:]
+			}
+			return n, nil
+		}
+		if p.closed && len(p.chunks) == 0 {
+			return 0, io.EOF
+		}
+		if !p.deadline.IsZero() && !now.Before(p.deadline) {
+			return 0, os.ErrDeadlineExceeded
+		}
+		// Wait until the next chunk is ready, the deadline passes or something changes
+		wake := time.Time{}
+		if len(p.chunks) > 0 {
+			wake = p.chunks[0].ready
+		}
+		if !p.deadline.IsZero() && (wake.IsZero() || p.deadline.Before(wake)) {
+			wake = p.deadline
+		}
+		var timer *time.Timer
+		if !wake.IsZero() {
+			timer = time.AfterFunc(wake.Sub(now), p.wake)
+		}
+		p.cond.Wait()
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+func (p *pipe) wake() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.cond.Broadcast()
+}
+
+func (p *pipe) setDeadline(t time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.deadline = t
+	p.cond.Broadcast()
+}
+
+// close lets the reader finish the remaining chunks
+func (p *pipe) close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	p.cond.Broadcast()
+}
+
+// discard drops the remaining chunks, used when the reading side closes
+func (p *pipe) discard() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	p.chunks = nil
+	p.cond.Broadcast()
+}
+
+// memConn is one side of a connection of a Network
+type memConn struct {
+	network *Network
+	local   memAddr
+	remote  memAddr
+	in      *pipe
+	out     *pipe
+	mutex   *sync.Mutex
+	closed  bool
+}
+
+func newMemConn(network *Network, local memAddr, remote memAddr, in *pipe, out *pipe) *memConn {
+	return &memConn{network: network, local: local, remote: remote, in: in, out: out, mutex: &sync.Mutex{}}
+}
+
+func (c *memConn) Read(b []byte) (int, error) {
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	n, err := c.in.read(b)
+	if err == io.EOF && c.isClosed() {
+		return n, net.ErrClosed
+	}
+	return n, err
+}
+
+// Write never blocks, the network decides whether and when the data arrives
+func (c *memConn) Write(b []byte) (int, error) {
+	if c.isClosed() {
+		return 0, net.ErrClosed
+	}
+	c.network.mutex.Lock()
+	delay, ok := c.network.route(Host(string(c.local)), Host(string(c.remote)))
+	c.network.mutex.Unlock()
+	if !ok {
+		return len(b), nil
+	}
+	data := make([]byte, len(b))
+	copy(data, b)
+	c.out.push(data, time.Now().Add(delay))
+	return len(b), nil
+}
+
+func (c *memConn) Close() error {
+	c.mutex.Lock()
+	if c.closed {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mutex.Unlock()
+	c.in.discard()
+	c.out.close()
+	return nil
+}
+
+func (c *memConn) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+func (c *memConn) LocalAddr() net.Addr  { return c.local }
+func (c *memConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *memConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *memConn) SetReadDeadline(t time.Time) error {
+	c.in.setDeadline(t)
+	return nil
+}
+
+// SetWriteDeadline has nothing to do since writes never block
+func (c *memConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,176 @@
+package transport
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// connect dials from the host to a listener on the other host and returns both sides of the connection
+func connect(t *testing.T, n *Network, from string, to string) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := n.Host(to).Listen(":9000")
+	if err != nil {
+		t.Fatalf("listen failed with error %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	client, err := n.Host(from).Dial(net.JoinHostPort(to, "9000"), time.Second)
+	if err != nil {
+		t.Fatalf("dial failed with error %v", err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatalf("accept failed with error %v", err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// readWithin reads exactly len(b) bytes unless the timeout passes first
+func readWithin(conn net.Conn, b []byte, timeout time.Duration) error {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	_, err := io.ReadFull(conn, b)
+	return err
+}
+
+func TestOrderUnderJitter(t *testing.T) {
+	n := NewNetwork(1)
+	n.SetDefaultLink(Link{Latency: time.Millisecond, Jitter: time.Millisecond * 20})
+	client, server := connect(t, n, "a", "b")
+	const writes = 100
+	for i := 0; i < writes; i++ {
+		client.Write([]byte{byte(i)})
+	}
+	b := make([]byte, writes)
+	if err := readWithin(server, b, time.Second*5); err != nil {
+		t.Fatalf("read failed with error %v", err)
+	}
+	for i := range b {
+		if b[i] != byte(i) {
+			t.Fatalf("write %v arrived at position %v", b[i], i)
+		}
+	}
+}
+
+func TestLatency(t *testing.T) {
+	n := NewNetwork(1)
+	n.SetLink("a", "b", Link{Latency: time.Millisecond * 50})
+	client, server := connect(t, n, "a", "b")
+	start := time.Now()
+	client.Write([]byte("ping"))
+	b := make([]byte, 4)
+	if err := readWithin(server, b, time.Second); err != nil {
+		t.Fatalf("read failed with error %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < time.Millisecond*50 {
+		t.Fatalf("write arrived after %v, before the latency of the link", elapsed)
+	}
+}
+
+func TestDroppedWrites(t *testing.T) {
+	n := NewNetwork(1)
+	n.SetDefaultLink(Link{Loss: 1})
+	client, server := connect(t, n, "a", "b")
+	written, err := client.Write([]byte("lost"))
+	if err != nil || written != 4 {
+		t.Fatalf("dropped write returned %v, %v", written, err)
+	}
+	err = readWithin(server, make([]byte, 4), time.Millisecond*50)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected no data, read returned %v", err)
+	}
+	// The writes that are not dropped still arrive
+	n.SetDefaultLink(Link{})
+	client.Write([]byte("kept"))
+	b := make([]byte, 4)
+	if err := readWithin(server, b, time.Second); err != nil || string(b) != "kept" {
+		t.Fatalf("expected kept, read %q with error %v", b, err)
+	}
+}
+
+func TestPartitionAndHeal(t *testing.T) {
+	n := NewNetwork(1)
+	client, server := connect(t, n, "a", "b")
+	n.Partition([]string{"a"}, []string{"b"})
+	// Open connections stay open but lose every write across the partition
+	client.Write([]byte("lost"))
+	err := readWithin(server, make([]byte, 4), time.Millisecond*50)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected no data across the partition, read returned %v", err)
+	}
+	if _, err := n.Host("a").Dial("b:9000", time.Second); err != ErrUnreachable {
+		t.Fatalf("expected dial across the partition to fail, got %v", err)
+	}
+	// Hosts in the same group still reach each other
+	if _, err := n.Host("c").Listen(":9000"); err != nil {
+		t.Fatalf("listen failed with error %v", err)
+	}
+	if _, err := n.Host("d").Dial("c:9000", time.Second); err != nil {
+		t.Fatalf("dial within a group failed with error %v", err)
+	}
+	n.Heal()
+	client.Write([]byte("back"))
+	b := make([]byte, 4)
+	if err := readWithin(server, b, time.Second); err != nil || string(b) != "back" {
+		t.Fatalf("expected back, read %q with error %v", b, err)
+	}
+	if _, err := n.Host("a").Dial("b:9000", time.Second); err != nil {
+		t.Fatalf("dial after healing failed with error %v", err)
+	}
+}
+
+func TestReadDeadline(t *testing.T) {
+	n := NewNetwork(1)
+	client, server := connect(t, n, "a", "b")
+	server.SetReadDeadline(time.Now().Add(time.Millisecond * 20))
+	start := time.Now()
+	_, err := server.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the deadline to pass, read returned %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("read returned %v after the deadline", elapsed)
+	}
+	// A deadline in the past fails right away, clearing it lets the read wait for data again
+	server.SetReadDeadline(time.Now().Add(-time.Second))
+	if _, err := server.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a passed deadline to fail the read, got %v", err)
+	}
+	server.SetReadDeadline(time.Time{})
+	go func() {
+		time.Sleep(time.Millisecond * 20)
+		client.Write([]byte{1})
+	}()
+	if _, err := server.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("read without a deadline failed with error %v", err)
+	}
+}
+
+func TestEOFAfterPeerCloses(t *testing.T) {
+	n := NewNetwork(1)
+	n.SetDefaultLink(Link{Latency: time.Millisecond * 10})
+	client, server := connect(t, n, "a", "b")
+	server.Write([]byte("bye"))
+	server.Close()
+	// Writes made before closing are still delivered
+	b := make([]byte, 3)
+	if err := readWithin(client, b, time.Second); err != nil || string(b) != "bye" {
+		t.Fatalf("expected bye, read %q with error %v", b, err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected EOF after the peer closed, got %v", err)
+	}
+	if _, err := server.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected reading a closed connection to fail, got %v", err)
+	}
+	if _, err := server.Write([]byte{1}); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected writing a closed connection to fail, got %v", err)
+	}
+}
@@ -0,0 +1,24 @@
+package transport
+
+import (
+	"net"
+	"time"
+)
+
+// Transport opens the connections between relays, so a relay does not care whether its peers are reached
+// through real sockets or a simulated network
+type Transport interface {
+	Dial(addr string, timeout time.Duration) (net.Conn, error)
+	Listen(addr string) (net.Listener, error)
+}
+
+// TCP connects relays through tcp sockets
+type TCP struct{}
+
+func (TCP) Dial(addr string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", addr, timeout)
+}
+
+func (TCP) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}